@@ -2,131 +2,248 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strings"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
-	"github.com/gelm0/dotsync/internal/app/dotsync"
-	"golang.org/x/term"
 
-	//"github.com/muesli/termenv"
-	//"os"
+	"github.com/gelm0/dotsync/internal/app/dotsync"
 )
 
+// Picks the dotfiles to track, for dotsync add -i
 type model struct {
-	choices  []string
+	choices []dotsync.Candidate
+	// Indexes of the choices shown, after searching and filtering
+	visible  []int
 	cursor   int
 	selected map[int]struct{}
+	// Typing a search
+	searching bool
+	search    string
+	// Hide the choices that are tracked already
+	hideTracked bool
+	width       int
+	done        bool
 }
 
-func initialModel() model {
-	return model{
-		// Our shopping list is a grocery list
-		choices: []string{"Buy carrots", "Buy celery", "Buy kohlrabi"},
+var (
+	trackedStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	searchStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("6"))
+)
 
-		// A map which indicates which choices are selected. We're using
-		// the  map like a mathematical set. The keys refer to the indexes
-		// of the `choices` slice, above.
+func initialModel(choices []dotsync.Candidate) model {
+	m := model{
+		choices:  choices,
 		selected: make(map[int]struct{}),
+		width:    80,
+	}
+	m.filter()
+	return m
+}
+
+// Updates the visible choices and keeps the cursor on them
+func (m *model) filter() {
+	m.visible = []int{}
+	search := strings.ToLower(m.search)
+	for i, c := range m.choices {
+		if m.hideTracked && c.FullyTracked() {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(c.Path), search) {
+			continue
+		}
+		m.visible = append(m.visible, i)
+	}
+	if m.cursor >= len(m.visible) {
+		m.cursor = len(m.visible) - 1
+	}
+	if m.cursor < 0 {
+		m.cursor = 0
 	}
 }
 
 func (m model) Init() tea.Cmd {
-	// Just return `nil`, which means "no I/O right now, please."
 	return nil
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
-
-	// Is it a key press?
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
 	case tea.KeyMsg:
-
-		// Cool, what was the actual key pressed?
+		if msg.String() == "ctrl+c" {
+			return m, tea.Quit
+		}
+		if m.searching {
+			m.updateSearch(msg)
+			return m, nil
+		}
 		switch msg.String() {
-
-		// These keys should exit the program.
-		case "ctrl+c", "q":
+		case "q", "esc":
 			return m, tea.Quit
-
-		// The "up" and "k" keys move the cursor up
 		case "up", "k":
 			if m.cursor > 0 {
 				m.cursor--
 			}
-
-		// The "down" and "j" keys move the cursor down
 		case "down", "j":
-			if m.cursor < len(m.choices)-1 {
+			if m.cursor < len(m.visible)-1 {
 				m.cursor++
 			}
-
-		// The "enter" key and the spacebar (a literal space) toggle
-		// the selected state for the item that the cursor is pointing at.
-		case "enter", " ":
-			_, ok := m.selected[m.cursor]
-			if ok {
-				delete(m.selected, m.cursor)
-			} else {
-				m.selected[m.cursor] = struct{}{}
+		case " ", "x":
+			m.toggle(m.cursor)
+		case "a":
+			// Select all shown, or none if they are all selected
+			all := true
+			for i := range m.visible {
+				if _, ok := m.selected[m.visible[i]]; !ok && !m.choices[m.visible[i]].FullyTracked() {
+					all = false
+				}
 			}
+			for i := range m.visible {
+				if _, ok := m.selected[m.visible[i]]; ok == all {
+					m.toggle(i)
+				}
+			}
+		case "/":
+			m.searching = true
+		case "t":
+			m.hideTracked = !m.hideTracked
+			m.filter()
+		case "enter":
+			m.done = true
+			return m, tea.Quit
 		}
 	}
-
-	// Return the updated model to the Bubble Tea runtime for processing.
-	// Note that we're not returning a command.
 	return m, nil
 }
 
-func (m model) View() string {
-	// The header
-	//s := termenv.String("What should we buy at the market?\n\n").Bold().String()
+func (m *model) updateSearch(msg tea.KeyMsg) {
+	switch msg.Type {
+	case tea.KeyEnter:
+		m.searching = false
+	case tea.KeyEsc:
+		m.searching = false
+		m.search = ""
+	case tea.KeyBackspace:
+		if len(m.search) > 0 {
+			runes := []rune(m.search)
+			m.search = string(runes[:len(runes)-1])
+		}
+	case tea.KeyRunes, tea.KeySpace:
+		m.search += string(msg.Runes)
+	}
+	m.filter()
+}
 
-	w, _, err := term.GetSize(0)
-	if err != nil {
-		panic(err)
+// Toggles the visible choice, files that are all tracked can't be selected
+func (m *model) toggle(visible int) {
+	if visible >= len(m.visible) {
+		return
+	}
+	i := m.visible[visible]
+	if m.choices[i].FullyTracked() {
+		return
+	}
+	if _, ok := m.selected[i]; ok {
+		delete(m.selected, i)
+	} else {
+		m.selected[i] = struct{}{}
 	}
+}
+
+// The selected paths, in the order they are shown
+func (m model) selection() []string {
+	paths := []string{}
+	for i, c := range m.choices {
+		if _, ok := m.selected[i]; ok {
+			paths = append(paths, c.Path)
+		}
+	}
+	return paths
+}
+
+func (m model) View() string {
 	style := lipgloss.NewStyle().
 		Bold(true).
 		Foreground(lipgloss.Color("#FAFAFA")).
 		Background(lipgloss.Color("#7D56F4")).
-		BorderStyle(lipgloss.RoundedBorder()).
-		Align(lipgloss.Position(lipgloss.Center)).
-		Width(w)
-	//s := style.Render("What should we buy at the market?\n\n")
-	s := lipgloss.PlaceHorizontal(80, lipgloss.Center, style.Render("What should we buy at the market?\n\n"))
-	s += "\n"
-
-	// Iterate over our choices
-	for i, choice := range m.choices {
-
-		// Is the cursor pointing at this choice?
-		cursor := " " // no cursor
-		if m.cursor == i {
-			cursor = ">" // cursor!
+		Padding(0, 1)
+	s := style.Render("Which files should be tracked?") + "\n\n"
+	if m.searching || m.search != "" {
+		cursor := ""
+		if m.searching {
+			cursor = "_"
 		}
-
-		// Is this choice selected?
-		checked := " " // not selected
+		s += searchStyle.Render("/"+m.search+cursor) + "\n\n"
+	}
+	if len(m.visible) == 0 {
+		s += "  Nothing found\n"
+	}
+	for row, i := range m.visible {
+		c := m.choices[i]
+		cursor := " "
+		if m.cursor == row {
+			cursor = ">"
+		}
+		checked := " "
 		if _, ok := m.selected[i]; ok {
-			checked = "x" // selected!
+			checked = "x"
 		}
-
-		// Render the row
-		s += fmt.Sprintf("%s [%s] %s\n", cursor, checked, choice)
+		detail := formatSize(c.Size)
+		if c.Dir {
+			detail = fmt.Sprintf("%d files, %s", len(c.Files), detail)
+		}
+		line := fmt.Sprintf("%s [%s] %s  %s", cursor, checked, c.Path, trackedStyle.Render(detail))
+		switch {
+		case c.FullyTracked():
+			line = trackedStyle.Render(fmt.Sprintf("%s [-] %s  tracked", cursor, c.Path))
+		case c.Tracked > 0:
+			line += trackedStyle.Render(fmt.Sprintf("  %d tracked", c.Tracked))
+		}
+		s += lipgloss.NewStyle().MaxWidth(m.width).Render(line) + "\n"
 	}
-
-	// The footer
-	s += "\nPress q to quit.\n"
-
-	// Send the UI for rendering
+	s += "\n" + helpStyle.Render(
+		"space: select  a: select all  /: search  t: hide tracked  enter: add  q: quit") + "\n"
 	return s
 }
 
-func main() {
-	// p := tea.NewProgram(initialModel(), tea.WithAltScreen())
-	// if err := p.Start(); err != nil {
-	// 	fmt.Printf("Alas, there's been an error: %v", err)
-	// 	os.Exit(1)
-	// }
-	dotsync.SyncOrigin()
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// Lets the user pick the dotfiles to track, then adds them
+func pickFiles(opts dotsync.Options) {
+	requireTerminal("add -i", "give the files to add instead")
+	candidates, err := dotsync.Candidates(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to open config:", err)
+		os.Exit(1)
+	}
+	if len(candidates) == 0 {
+		fmt.Println("No dotfiles found")
+		return
+	}
+	final, err := tea.NewProgram(initialModel(candidates)).StartReturningModel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	m := final.(model)
+	paths := m.selection()
+	if !m.done || len(paths) == 0 {
+		fmt.Println("Nothing added")
+		return
+	}
+	opts.Progress = newProgress()
+	dotsync.AddFiles(paths, opts)
 }
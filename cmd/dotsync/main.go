@@ -1 +1,318 @@
-package main
\ No newline at end of file
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gelm0/dotsync/internal/app/dotsync"
+)
+
+const usage = `Usage: dotsync [--wait duration] [--profile name] [--color mode] [--output format] [command] [options]
+
+Commands:
+  push      Sync the tracked files to the git repository (default)
+  pull      Sync the git repository to the tracked files
+  sync      Push local changes and pull remote changes in one go
+            push, pull and sync take --tag to only sync files with that tag
+  status    Show which tracked files changed since the last sync
+  config show
+            Print the config with the active profile applied
+  resolve   Resolve conflicting changes file by file or hunk by hunk, then sync
+            --tool merges every conflict in the merge tool instead
+  undo      Revert the files changed by the last pull
+            --force also reverts files changed since the pull
+  diff      Show local changes to the tracked files since the last sync
+            --tool opens them in the diff tool, --stat only counts changed lines
+  log       Show the last syncs recorded in the repository, -n limits how many
+  add       Start tracking files, directories are added file by file
+            -i picks them from the dotfiles found in the home directory
+  rm        Stop tracking files and remove them from the repository
+  watch     Watch the tracked files and sync them whenever they change
+  daemon    Periodically pull and push changes in the background
+  keygen    Generate an identity for decrypting files shared with recipients
+            --key generates the key file for encrypted files instead
+  recipients [list | add KEY [NAME] | rm [--force] KEY|NAME]
+            Manage who can decrypt the encrypted files, --force removes the
+            last recipient
+
+Daemon commands:
+  daemon status
+            Show the status of the running daemon
+  sync-now  Make the running daemon sync immediately
+  pause     Pause periodic syncs of the running daemon
+  resume    Resume periodic syncs of the running daemon
+
+Options:
+  --wait    How long to wait for another sync holding the lock (default 0s)
+  --profile Profile to apply to the config, overrides DOTSYNC_PROFILE
+  --color   When to color the output: auto, always or never (default auto)
+            auto colors terminals unless NO_COLOR is set
+  --output  Output format: text or json (default text). json is supported by
+            status, push, pull, sync, diff --stat, log and config show
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+	}
+	wait := flag.Duration("wait", 0, "how long to wait for another sync holding the lock")
+	profile := flag.String("profile", "", "profile to apply to the config")
+	color := flag.String("color", colorAuto, "when to color the output")
+	output := flag.String("output", dotsync.OutputText, "output format")
+	flag.Parse()
+	if err := setupColor(*color); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := dotsync.ValidateOutput(*output); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	opts := dotsync.Options{
+		LockWait: *wait,
+		Profile:  *profile,
+		Output:   *output,
+	}
+
+	command := "push"
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+	}
+	args := flag.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	jsonOutput := opts.Output == dotsync.OutputJSON
+	if jsonOutput && !jsonCommands[command] {
+		fmt.Fprintf(os.Stderr, "%s doesn't support --output json\n", command)
+		os.Exit(2)
+	}
+
+	switch command {
+	case "push":
+		opts.Tags = parseTags("push", args)
+		// The daemon always syncs every file, and only reports its status
+		if jsonOutput || len(opts.Tags) > 0 || !delegateToDaemon(dotsync.CmdPushNow, opts) {
+			// With JSON stdout is for the result
+			if !jsonOutput {
+				opts.Progress = newProgress()
+			}
+			dotsync.SyncOrigin(opts)
+		}
+	case "pull":
+		opts.Tags = parseTags("pull", args)
+		if jsonOutput || len(opts.Tags) > 0 || !delegateToDaemon(dotsync.CmdPullNow, opts) {
+			if !jsonOutput {
+				opts.Progress = newProgress()
+			}
+			dotsync.SyncLocal(opts)
+		}
+	case "resolve":
+		resolveCmd := flag.NewFlagSet("resolve", flag.ExitOnError)
+		tool := resolveCmd.Bool("tool", false, "merge every conflict in the merge tool")
+		resolveCmd.Parse(args)
+		resolve(*tool, opts)
+	case "undo":
+		undoCmd := flag.NewFlagSet("undo", flag.ExitOnError)
+		force := undoCmd.Bool("force", false, "also revert files changed since the pull")
+		undoCmd.Parse(args)
+		dotsync.Undo(*force, opts)
+	case "sync":
+		opts.Tags = parseTags("sync", args)
+		if !jsonOutput {
+			opts.Progress = newProgress()
+		}
+		dotsync.SyncBoth(opts)
+	case "diff":
+		diffCmd := flag.NewFlagSet("diff", flag.ExitOnError)
+		tool := diffCmd.Bool("tool", false, "open the changes in the diff tool")
+		stat := diffCmd.Bool("stat", false, "only count the changed lines")
+		diffCmd.Parse(args)
+		if jsonOutput && !*stat {
+			fmt.Fprintln(os.Stderr, "diff only supports --output json with --stat")
+			os.Exit(2)
+		}
+		if *tool {
+			dotsync.DiffTool(diffCmd.Args(), opts)
+			return
+		}
+		dotsync.Diff(diffCmd.Args(), *stat, opts)
+	case "log":
+		logCmd := flag.NewFlagSet("log", flag.ExitOnError)
+		n := logCmd.Int("n", 0, "number of syncs to show, all when 0")
+		logCmd.Parse(args)
+		dotsync.Log(*n, opts)
+	case "add":
+		addCmd := flag.NewFlagSet("add", flag.ExitOnError)
+		interactive := addCmd.Bool("i", false, "pick the files from the dotfiles found in the home directory")
+		addCmd.Parse(args)
+		if *interactive {
+			pickFiles(opts)
+			return
+		}
+		if addCmd.NArg() == 0 {
+			fmt.Fprintln(os.Stderr, "add needs at least one file, or -i")
+			os.Exit(2)
+		}
+		opts.Progress = newProgress()
+		dotsync.AddFiles(addCmd.Args(), opts)
+	case "rm":
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, "rm needs at least one file")
+			os.Exit(2)
+		}
+		opts.Progress = newProgress()
+		dotsync.RemoveFiles(args, opts)
+	case "watch":
+		watchCmd := flag.NewFlagSet("watch", flag.ExitOnError)
+		debounce := watchCmd.Duration("debounce", dotsync.DefaultDebounce,
+			"time to wait for further changes before syncing")
+		watchCmd.Parse(args)
+		dotsync.WatchOrigin(*debounce, opts)
+	case "status":
+		dotsync.Status(opts)
+		if jsonOutput {
+			return
+		}
+		// Include the daemon, if one is running
+		if status, err := dotsync.SendDaemonCommand(dotsync.CmdStatus, opts); err == nil {
+			fmt.Println()
+			printDaemonStatus(status)
+		}
+	case "daemon":
+		if len(args) > 0 && args[0] == dotsync.CmdStatus {
+			sendDaemonCommand(dotsync.CmdStatus, opts)
+			return
+		}
+		dotsync.RunDaemon(opts)
+	case "config":
+		if len(args) != 1 || args[0] != "show" {
+			fmt.Fprintln(os.Stderr, "usage: dotsync config show")
+			os.Exit(2)
+		}
+		dotsync.ShowConfig(opts)
+	case "keygen":
+		keygenCmd := flag.NewFlagSet("keygen", flag.ExitOnError)
+		key := keygenCmd.Bool("key", false, "generate the key file for encrypted files instead")
+		keygenCmd.Parse(args)
+		dotsync.Keygen(*key, opts)
+	case "recipients":
+		recipients(args, opts)
+	case dotsync.CmdSyncNow, dotsync.CmdPause, dotsync.CmdResume:
+		sendDaemonCommand(command, opts)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// Commands that print their result as JSON with --output json
+var jsonCommands = map[string]bool{
+	"push":   true,
+	"pull":   true,
+	"sync":   true,
+	"status": true,
+	"diff":   true,
+	"log":    true,
+	"config": true,
+}
+
+// Tags are given as --tag shell --tag editor or as --tag shell,editor
+type tagsFlag []string
+
+func (t *tagsFlag) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *tagsFlag) Set(value string) error {
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			*t = append(*t, tag)
+		}
+	}
+	return nil
+}
+
+func parseTags(command string, args []string) []string {
+	tags := tagsFlag{}
+	cmd := flag.NewFlagSet(command, flag.ExitOnError)
+	cmd.Var(&tags, "tag", "only sync files with this tag, can be repeated")
+	cmd.Parse(args)
+	return tags
+}
+
+func recipients(args []string, opts dotsync.Options) {
+	if len(args) == 0 || args[0] == "list" {
+		dotsync.ListRecipients(opts)
+		return
+	}
+	switch {
+	case args[0] == "add" && len(args) > 1:
+		// Keys from authorized_keys are given either quoted or as separate arguments
+		dotsync.AddRecipient(strings.Join(args[1:], " "), opts)
+	case args[0] == "rm" && len(args) > 1:
+		rmCmd := flag.NewFlagSet("recipients rm", flag.ExitOnError)
+		force := rmCmd.Bool("force", false, "also remove the last recipient")
+		rmCmd.Parse(args[1:])
+		if rmCmd.NArg() == 0 {
+			fmt.Fprintln(os.Stderr, "usage: dotsync recipients rm [--force] KEY|NAME")
+			os.Exit(2)
+		}
+		dotsync.RemoveRecipient(strings.Join(rmCmd.Args(), " "), *force, opts)
+	default:
+		fmt.Fprintln(os.Stderr, "usage: dotsync recipients [list | add KEY [NAME] | rm [--force] KEY|NAME]")
+		os.Exit(2)
+	}
+}
+
+func sendDaemonCommand(command string, opts dotsync.Options) {
+	status, err := dotsync.DelegateToDaemon(command, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	printDaemonStatus(status)
+}
+
+// One-shot syncs must not run alongside the daemon, ask the daemon
+// to sync instead. Returns false if no daemon could be reached
+func delegateToDaemon(command string, opts dotsync.Options) bool {
+	status, err := dotsync.DelegateToDaemon(command, opts)
+	if errors.Is(err, dotsync.ErrDaemonFailed) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err != nil {
+		return false
+	}
+	fmt.Println("Synced by the running daemon")
+	printDaemonStatus(status)
+	return true
+}
+
+func printDaemonStatus(status dotsync.DaemonStatus) {
+	state := "running"
+	if status.Syncing {
+		state = "syncing"
+	} else if status.Paused {
+		state = "paused"
+	}
+	fmt.Println("State:     ", state)
+	fmt.Println("Last sync: ", formatTime(status.LastSync))
+	fmt.Println("Next sync: ", formatTime(status.NextSync))
+	if status.LastError != "" {
+		fmt.Println("Last error:", status.LastError)
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC1123)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+
+	"github.com/gelm0/dotsync/internal/app/dotsync"
+)
+
+// Shows the progress of a sync, in a dashboard on a terminal and as plain
+// lines otherwise
+func newProgress() dotsync.Progress {
+	if isTerminal(os.Stdout) {
+		return &dashboard{exited: make(chan struct{})}
+	}
+	return &lineProgress{out: os.Stdout, tally: newTally()}
+}
+
+// Results worth showing, with how they are counted in the summary
+var resultLabels = map[dotsync.FileResult]string{
+	dotsync.ResultCopied:   "pushed",
+	dotsync.ResultRestored: "restored",
+	dotsync.ResultMerged:   "merged",
+	dotsync.ResultConflict: "conflicts",
+	dotsync.ResultKept:     "kept",
+	dotsync.ResultMissing:  "missing",
+}
+
+// Counts the results of a sync for its summary
+type tally struct {
+	start  time.Time
+	counts map[dotsync.FileResult]int
+}
+
+func newTally() tally {
+	return tally{start: time.Now(), counts: map[dotsync.FileResult]int{}}
+}
+
+func (t tally) summary(err error) string {
+	elapsed := time.Since(t.start).Round(100 * time.Millisecond)
+	if err != nil {
+		return fmt.Sprintf("Failed after %s: %s", elapsed, err)
+	}
+	counts := []string{}
+	for _, result := range []dotsync.FileResult{
+		dotsync.ResultCopied, dotsync.ResultRestored, dotsync.ResultMerged,
+		dotsync.ResultConflict, dotsync.ResultKept, dotsync.ResultMissing,
+	} {
+		if n := t.counts[result]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, resultLabels[result]))
+		}
+	}
+	if len(counts) == 0 {
+		counts = append(counts, "no changes")
+	}
+	return fmt.Sprintf("Done in %s: %s", elapsed, strings.Join(counts, ", "))
+}
+
+// Progress for logs and pipes, one line per step
+type lineProgress struct {
+	out   io.Writer
+	tally tally
+	phase dotsync.Phase
+}
+
+func (p *lineProgress) Phase(phase dotsync.Phase, total int) {
+	if phase == p.phase && total == 0 {
+		return
+	}
+	p.phase = phase
+	if total > 0 {
+		fmt.Fprintf(p.out, "%s %d files\n", phase, total)
+	} else {
+		fmt.Fprintf(p.out, "%s\n", phase)
+	}
+}
+
+func (p *lineProgress) File(path string, result dotsync.FileResult) {
+	p.tally.counts[result]++
+	if _, ok := resultLabels[result]; ok {
+		fmt.Fprintf(p.out, "  %-9s %s\n", result, path)
+	}
+}
+
+func (p *lineProgress) Transfer(message string, final bool) {
+	if final {
+		fmt.Fprintf(p.out, "  %s\n", message)
+	}
+}
+
+func (p *lineProgress) Done(err error) {
+	fmt.Fprintln(p.out, p.tally.summary(err))
+}
+
+const recentFiles = 6
+
+type phaseProgress struct {
+	phase       dotsync.Phase
+	total, done int
+}
+
+type dashboardState struct {
+	phases   []phaseProgress
+	recent   []string
+	transfer string
+	tally    tally
+	done     bool
+	err      error
+}
+
+// Progress shown live on the terminal. The sync reports to it from its own
+// goroutine, the dashboard polls the state to render it
+type dashboard struct {
+	mu      sync.Mutex
+	state   dashboardState
+	started bool
+	exited  chan struct{}
+	logs    bytes.Buffer
+}
+
+// Starts showing the dashboard once there is something to show. Logs are
+// held back until it is done so they don't garble it
+func (d *dashboard) start() {
+	if d.started {
+		return
+	}
+	d.started = true
+	d.state.tally = newTally()
+	dotsync.SetLogOutput(&d.logs)
+	// Without input ctrl+c stays an interrupt
+	program := tea.NewProgram(dashboardModel{dashboard: d, width: 80}, tea.WithInput(&bytes.Buffer{}))
+	go func() {
+		// Without the dashboard, or once ctrl+c quit it, the sync carries on
+		// until it is done or stops where that is safe
+		program.Start()
+		close(d.exited)
+	}()
+}
+
+func (d *dashboard) flushLogs() {
+	dotsync.SetLogOutput(os.Stderr)
+	os.Stderr.Write(d.logs.Bytes())
+}
+
+func (d *dashboard) Phase(phase dotsync.Phase, total int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.start()
+	d.state.transfer = ""
+	// Fetching twice, when cloning and then pulling, shows as one phase
+	if n := len(d.state.phases); n > 0 && d.state.phases[n-1].phase == phase {
+		d.state.phases[n-1].total += total
+		return
+	}
+	d.state.phases = append(d.state.phases, phaseProgress{phase: phase, total: total})
+}
+
+func (d *dashboard) File(path string, result dotsync.FileResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if n := len(d.state.phases); n > 0 {
+		d.state.phases[n-1].done++
+	}
+	d.state.tally.counts[result]++
+	if _, ok := resultLabels[result]; ok {
+		d.state.recent = append(d.state.recent, fmt.Sprintf("%-9s %s", result, path))
+		if len(d.state.recent) > recentFiles {
+			d.state.recent = d.state.recent[1:]
+		}
+	}
+}
+
+func (d *dashboard) Transfer(message string, final bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.state.transfer = message
+}
+
+func (d *dashboard) Done(err error) {
+	d.mu.Lock()
+	if !d.started {
+		d.mu.Unlock()
+		return
+	}
+	d.state.done, d.state.err = true, err
+	d.mu.Unlock()
+	<-d.exited
+	d.flushLogs()
+}
+
+// A copy of the state, safe to render
+func (d *dashboard) snapshot() dashboardState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state := d.state
+	state.phases = append([]phaseProgress{}, d.state.phases...)
+	state.recent = append([]string{}, d.state.recent...)
+	state.tally.counts = map[dotsync.FileResult]int{}
+	for result, n := range d.state.tally.counts {
+		state.tally.counts[result] = n
+	}
+	return state
+}
+
+type tickMsg struct{}
+
+func tick() tea.Cmd {
+	return tea.Tick(100*time.Millisecond, func(time.Time) tea.Msg {
+		return tickMsg{}
+	})
+}
+
+type dashboardModel struct {
+	dashboard *dashboard
+	state     dashboardState
+	width     int
+	frame     int
+}
+
+var (
+	spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+	doneStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("2"))
+	failedStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("1"))
+)
+
+func (m dashboardModel) Init() tea.Cmd {
+	return tick()
+}
+
+func (m dashboardModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+	case tickMsg:
+		m.state = m.dashboard.snapshot()
+		m.frame = (m.frame + 1) % len(spinnerFrames)
+		if m.state.done {
+			return m, tea.Quit
+		}
+		return m, tick()
+	}
+	return m, nil
+}
+
+func (m dashboardModel) View() string {
+	var s strings.Builder
+	for i, p := range m.state.phases {
+		status := doneStyle.Render("✓")
+		last := i == len(m.state.phases)-1
+		if last && !m.state.done {
+			status = spinnerFrames[m.frame]
+		} else if last && m.state.err != nil {
+			status = failedStyle.Render("✗")
+		}
+		line := fmt.Sprintf("%s %-11s", status, p.phase)
+		if p.total > 0 {
+			line += fmt.Sprintf(" %d/%d", p.done, p.total)
+		}
+		if last && !m.state.done && m.state.transfer != "" {
+			line += "  " + helpStyle.Render(m.state.transfer)
+		}
+		s.WriteString(lipgloss.NewStyle().MaxWidth(m.width).Render(line) + "\n")
+	}
+	if len(m.state.recent) > 0 {
+		s.WriteString("\n")
+		for _, file := range m.state.recent {
+			s.WriteString(lipgloss.NewStyle().MaxWidth(m.width).Render("  "+file) + "\n")
+		}
+	}
+	if m.state.done {
+		s.WriteString("\n" + m.state.tally.summary(m.state.err) + "\n")
+	}
+	return s.String()
+}
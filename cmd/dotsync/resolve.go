@@ -0,0 +1,526 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+
+	"github.com/gelm0/dotsync/internal/app/dotsync"
+)
+
+// How a conflicting file is resolved
+type fileChoice int
+
+const (
+	choicePending fileChoice = iota
+	choiceLocal
+	choiceRemote
+	// Hunk by hunk
+	choiceMerge
+	choiceEdited
+	choiceSkip
+)
+
+func (c fileChoice) String() string {
+	return [...]string{"pending", "local", "remote", "merge", "edited", "skip"}[c]
+}
+
+type resolveFile struct {
+	conflict dotsync.Conflict
+	choice   fileChoice
+	// One choice per conflicting hunk
+	hunks  []dotsync.HunkChoice
+	edited []byte
+}
+
+func (f resolveFile) conflicts() int {
+	return len(f.hunks)
+}
+
+// Content of the file as it is resolved so far, unresolved hunks have markers
+func (f resolveFile) content() []byte {
+	switch f.choice {
+	case choiceLocal:
+		return f.conflict.Local
+	case choiceRemote:
+		return f.conflict.Remote
+	case choiceEdited:
+		return f.edited
+	}
+	if f.conflict.Binary {
+		return f.conflict.Local
+	}
+	return dotsync.ResolveHunks(f.conflict.Hunks, f.hunks)
+}
+
+// Reports if every hunk has a choice
+func (f resolveFile) resolved() bool {
+	switch f.choice {
+	case choiceLocal, choiceRemote, choiceEdited:
+		return true
+	case choiceMerge:
+		for _, h := range f.hunks {
+			if h == dotsync.HunkUnresolved {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+type editedMsg struct {
+	file int
+	path string
+	err  error
+}
+
+type mergedMsg struct {
+	file    int
+	content []byte
+	err     error
+}
+
+type resolveModel struct {
+	files  []resolveFile
+	cursor int
+	// Showing the hunks of the file under the cursor
+	open       bool
+	hunk       int
+	sideBySide bool
+	width      int
+	message    string
+	apply      bool
+	opts       dotsync.Options
+}
+
+var (
+	titleStyle = lipgloss.NewStyle().
+			Bold(true).
+			Foreground(lipgloss.Color("#FAFAFA")).
+			Background(lipgloss.Color("#7D56F4")).
+			Padding(0, 1)
+	localStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("2"))
+	remoteStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("4"))
+	baseStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	helpStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("8"))
+	messageStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("3"))
+)
+
+func newResolveModel(conflicts []dotsync.Conflict, opts dotsync.Options) resolveModel {
+	m := resolveModel{width: 80, sideBySide: true, opts: opts}
+	for _, c := range conflicts {
+		f := resolveFile{conflict: c}
+		for _, h := range c.Hunks {
+			if h.Conflict {
+				f.hunks = append(f.hunks, dotsync.HunkUnresolved)
+			}
+		}
+		m.files = append(m.files, f)
+	}
+	return m
+}
+
+func (m resolveModel) Init() tea.Cmd {
+	return nil
+}
+
+func (m resolveModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+	case editedMsg:
+		return m.edited(msg), nil
+	case mergedMsg:
+		if msg.err != nil {
+			m.message = "Merge tool: " + msg.err.Error()
+			break
+		}
+		m.files[msg.file].edited = msg.content
+		m.files[msg.file].choice = choiceEdited
+	case tea.KeyMsg:
+		m.message = ""
+		if msg.String() == "ctrl+c" {
+			return m, tea.Quit
+		}
+		if m.open {
+			return m.updateFile(msg)
+		}
+		return m.updateList(msg)
+	}
+	return m, nil
+}
+
+func (m resolveModel) updateList(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	f := &m.files[m.cursor]
+	switch msg.String() {
+	case "q", "esc":
+		return m, tea.Quit
+	case "up", "k":
+		if m.cursor > 0 {
+			m.cursor--
+		}
+	case "down", "j":
+		if m.cursor < len(m.files)-1 {
+			m.cursor++
+		}
+	case "enter":
+		if f.conflict.Binary {
+			m.message = "Binary file, keep the local or the remote version"
+			break
+		}
+		m.open, m.hunk = true, 0
+	case "l":
+		f.choice = choiceLocal
+	case "r":
+		f.choice = choiceRemote
+	case "s":
+		f.choice = choiceSkip
+	case "e":
+		return m, m.edit()
+	case "m":
+		return m, m.mergeTool()
+	case "a":
+		for _, f := range m.files {
+			if f.choice != choiceSkip && !f.resolved() {
+				m.message = fmt.Sprintf("%s is not resolved, resolve or skip it", f.conflict.ID)
+				return m, nil
+			}
+		}
+		m.apply = true
+		return m, tea.Quit
+	}
+	return m, nil
+}
+
+func (m resolveModel) updateFile(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	f := &m.files[m.cursor]
+	choose := func(choice dotsync.HunkChoice) {
+		if f.conflicts() == 0 {
+			return
+		}
+		f.choice = choiceMerge
+		f.hunks[m.hunk] = choice
+		if m.hunk < f.conflicts()-1 {
+			m.hunk++
+		}
+	}
+	switch msg.String() {
+	case "q", "esc":
+		m.open = false
+	case "up", "k":
+		if m.hunk > 0 {
+			m.hunk--
+		}
+	case "down", "j":
+		if m.hunk < f.conflicts()-1 {
+			m.hunk++
+		}
+	case "l":
+		choose(dotsync.HunkLocal)
+	case "r":
+		choose(dotsync.HunkRemote)
+	case "b":
+		choose(dotsync.HunkBoth)
+	case "L":
+		f.choice = choiceLocal
+	case "R":
+		f.choice = choiceRemote
+	case "s":
+		f.choice = choiceSkip
+		m.open = false
+	case "e":
+		return m, m.edit()
+	case "m":
+		return m, m.mergeTool()
+	case "tab":
+		m.sideBySide = !m.sideBySide
+	}
+	return m, nil
+}
+
+// Opens the file as it is resolved so far in the editor
+func (m resolveModel) edit() tea.Cmd {
+	f := m.files[m.cursor]
+	if f.conflict.Binary {
+		return func() tea.Msg {
+			return editedMsg{file: m.cursor, err: fmt.Errorf("can't edit a binary file")}
+		}
+	}
+	// Keep the name so the editor recognizes the type of file
+	tmp, err := os.CreateTemp("", "dotsync-*-"+filepath.Base(f.conflict.Path))
+	if err == nil {
+		_, err = tmp.Write(f.content())
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return func() tea.Msg {
+			return editedMsg{file: m.cursor, err: err}
+		}
+	}
+	editor := strings.Fields(editorCommand())
+	cmd := exec.Command(editor[0], append(editor[1:], tmp.Name())...)
+	file := m.cursor
+	return tea.ExecProcess(cmd, func(err error) tea.Msg {
+		return editedMsg{file: file, path: tmp.Name(), err: err}
+	})
+}
+
+// Opens the file in the external merge tool
+func (m resolveModel) mergeTool() tea.Cmd {
+	file := m.cursor
+	run, err := dotsync.MergeTool(m.files[file].conflict, m.opts)
+	if err != nil {
+		return func() tea.Msg {
+			return mergedMsg{file: file, err: err}
+		}
+	}
+	return tea.ExecProcess(run.Cmd, func(err error) tea.Msg {
+		content, err := run.Finish(err)
+		return mergedMsg{file: file, content: content, err: err}
+	})
+}
+
+func editorCommand() string {
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if editor := strings.TrimSpace(os.Getenv(env)); editor != "" {
+			return editor
+		}
+	}
+	return "vi"
+}
+
+func (m resolveModel) edited(msg editedMsg) resolveModel {
+	if msg.path != "" {
+		defer os.Remove(msg.path)
+	}
+	if msg.err != nil {
+		m.message = "Editor failed: " + msg.err.Error()
+		return m
+	}
+	content, err := os.ReadFile(msg.path)
+	if err != nil {
+		m.message = "Failed to read the edited file: " + err.Error()
+		return m
+	}
+	if hasMarkers(content) {
+		m.message = "The edited file still has conflict markers"
+		return m
+	}
+	m.files[msg.file].edited = content
+	m.files[msg.file].choice = choiceEdited
+	return m
+}
+
+func hasMarkers(content []byte) bool {
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "<<<<<<< ") || strings.HasPrefix(line, ">>>>>>> ") {
+			return true
+		}
+	}
+	return false
+}
+
+func (m resolveModel) View() string {
+	var s strings.Builder
+	if m.open {
+		m.viewFile(&s)
+	} else {
+		m.viewList(&s)
+	}
+	if m.message != "" {
+		s.WriteString("\n" + messageStyle.Render(m.message) + "\n")
+	}
+	return s.String()
+}
+
+func (m resolveModel) viewList(s *strings.Builder) {
+	s.WriteString(titleStyle.Render("Conflicts") + "\n\n")
+	for i, f := range m.files {
+		cursor := " "
+		if i == m.cursor {
+			cursor = ">"
+		}
+		detail := fmt.Sprintf("%d conflicts", f.conflicts())
+		if f.conflict.Binary {
+			detail = "binary"
+		} else if f.choice == choiceMerge {
+			resolved := 0
+			for _, h := range f.hunks {
+				if h != dotsync.HunkUnresolved {
+					resolved++
+				}
+			}
+			detail = fmt.Sprintf("%d of %d resolved", resolved, f.conflicts())
+		}
+		fmt.Fprintf(s, "%s [%-7s] %s %s\n", cursor, f.choice, f.conflict.ID, helpStyle.Render("("+detail+")"))
+	}
+	s.WriteString("\n" + helpStyle.Render(
+		"enter: hunks  l: keep local  r: keep remote  e: edit  m: merge tool  s: skip  a: apply  q: quit") + "\n")
+}
+
+func (m resolveModel) viewFile(s *strings.Builder) {
+	f := m.files[m.cursor]
+	s.WriteString(titleStyle.Render(f.conflict.ID) + "\n\n")
+	if f.choice == choiceLocal || f.choice == choiceRemote || f.choice == choiceEdited {
+		fmt.Fprintf(s, "Resolved as %s\n\n", f.choice)
+	}
+	conflict := 0
+	for i, h := range f.conflict.Hunks {
+		if !h.Conflict {
+			continue
+		}
+		if conflict == m.hunk {
+			fmt.Fprintf(s, "Hunk %d of %d: %s\n\n", conflict+1, f.conflicts(), hunkChoiceName(f.hunks[conflict]))
+			if i > 0 {
+				lines := f.conflict.Hunks[i-1].Lines
+				if len(lines) > 3 {
+					lines = lines[len(lines)-3:]
+				}
+				writeStyled(s, baseStyle, "  ", lines)
+			}
+			if m.sideBySide && m.width >= 40 {
+				m.viewSideBySide(s, h)
+			} else {
+				m.viewUnified(s, h)
+			}
+			if i < len(f.conflict.Hunks)-1 {
+				lines := f.conflict.Hunks[i+1].Lines
+				if len(lines) > 3 {
+					lines = lines[:3]
+				}
+				writeStyled(s, baseStyle, "  ", lines)
+			}
+		}
+		conflict++
+	}
+	s.WriteString("\n" + helpStyle.Render(
+		"j/k: next/previous hunk  l: local  r: remote  b: both  L/R: whole file  e: edit  m: merge tool  tab: layout  esc: back") + "\n")
+}
+
+func (m resolveModel) viewUnified(s *strings.Builder, h dotsync.Hunk) {
+	if len(h.Base) > 0 {
+		s.WriteString(baseStyle.Render("base") + "\n")
+		writeStyled(s, baseStyle, "  ", h.Base)
+	}
+	s.WriteString(localStyle.Render("local") + "\n")
+	writeStyled(s, localStyle, "- ", h.Local)
+	s.WriteString(remoteStyle.Render("remote") + "\n")
+	writeStyled(s, remoteStyle, "+ ", h.Remote)
+}
+
+func (m resolveModel) viewSideBySide(s *strings.Builder, h dotsync.Hunk) {
+	width := (m.width - 3) / 2
+	column := func(style lipgloss.Style, title string, lines []string) string {
+		var c strings.Builder
+		c.WriteString(style.Copy().Bold(true).Render(title) + "\n")
+		for _, line := range lines {
+			c.WriteString(style.Copy().MaxWidth(width).Render(displayLine(line)) + "\n")
+		}
+		return lipgloss.NewStyle().Width(width).Render(strings.TrimSuffix(c.String(), "\n"))
+	}
+	rows := len(h.Local)
+	if len(h.Remote) > rows {
+		rows = len(h.Remote)
+	}
+	separator := strings.TrimSuffix(strings.Repeat(" | \n", rows+1), "\n")
+	s.WriteString(lipgloss.JoinHorizontal(lipgloss.Top,
+		column(localStyle, "local", h.Local), separator, column(remoteStyle, "remote", h.Remote)) + "\n")
+	if len(h.Base) > 0 {
+		s.WriteString(baseStyle.Render("base") + "\n")
+		writeStyled(s, baseStyle, "  ", h.Base)
+	}
+}
+
+func writeStyled(s *strings.Builder, style lipgloss.Style, prefix string, lines []string) {
+	for _, line := range lines {
+		s.WriteString(style.Render(prefix+displayLine(line)) + "\n")
+	}
+}
+
+func displayLine(line string) string {
+	return strings.ReplaceAll(strings.TrimRight(line, "\r\n"), "\t", "    ")
+}
+
+func hunkChoiceName(c dotsync.HunkChoice) string {
+	return [...]string{"unresolved", "local", "remote", "both"}[c]
+}
+
+// Resolutions of the files that aren't skipped
+func (m resolveModel) resolutions() []dotsync.Resolution {
+	resolutions := []dotsync.Resolution{}
+	for _, f := range m.files {
+		if f.choice != choiceSkip && f.resolved() {
+			resolutions = append(resolutions, dotsync.Resolution{ID: f.conflict.ID, Content: f.content()})
+		}
+	}
+	return resolutions
+}
+
+// Merges every conflict in the merge tool, one after the other
+func mergeAll(conflicts []dotsync.Conflict, opts dotsync.Options) []dotsync.Resolution {
+	resolutions := []dotsync.Resolution{}
+	for _, conflict := range conflicts {
+		fmt.Printf("Merging %s\n", conflict.ID)
+		run, err := dotsync.MergeTool(conflict, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		content, err := run.Run()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %s\n", conflict.ID, err)
+			continue
+		}
+		resolutions = append(resolutions, dotsync.Resolution{ID: conflict.ID, Content: content})
+	}
+	return resolutions
+}
+
+func resolve(tool bool, opts dotsync.Options) {
+	conflicts, err := dotsync.Conflicts(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read conflicts:", err)
+		os.Exit(1)
+	}
+	if len(conflicts) == 0 {
+		fmt.Println("No conflicts")
+		return
+	}
+	var resolutions []dotsync.Resolution
+	if tool {
+		resolutions = mergeAll(conflicts, opts)
+	} else {
+		requireTerminal("resolve", "use --tool or resolve the conflicts in the files")
+		final, err := tea.NewProgram(newResolveModel(conflicts, opts)).StartReturningModel()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if m := final.(resolveModel); m.apply {
+			resolutions = m.resolutions()
+		}
+	}
+	if len(resolutions) == 0 {
+		fmt.Println("Nothing resolved")
+		return
+	}
+	changes, err := dotsync.ResolveConflicts(resolutions, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to resolve conflicts:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Resolved %d files\n", len(resolutions))
+	for _, change := range changes {
+		if change.Change != dotsync.ChangeNone {
+			fmt.Printf("%-15s %s\n", change.Change, change.Path)
+		}
+	}
+}
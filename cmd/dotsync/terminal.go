@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+	"golang.org/x/term"
+
+	"github.com/gelm0/dotsync/internal/app/dotsync"
+)
+
+// dotsync runs from cron, systemd and CI as much as from a terminal. Screens
+// and the dashboard are only shown on a terminal, everything else is printed
+// line by line. Colors follow --color, where auto colors terminals unless
+// NO_COLOR is set, see https://no-color.org
+
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+var (
+	errNoTTY        = errors.New("not running in a terminal")
+	errInvalidColor = errors.New("invalid color mode")
+)
+
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd())) && os.Getenv("TERM") != "dumb"
+}
+
+// Screens need a terminal to read keys from and to draw on
+func interactive() bool {
+	return isTerminal(os.Stdin) && isTerminal(os.Stdout)
+}
+
+// Exits with an error when the command needs a terminal and there is none
+func requireTerminal(command, alternative string) {
+	if interactive() {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s, %s\n", command, errNoTTY, alternative)
+	os.Exit(1)
+}
+
+func useColor(mode string, f *os.File) bool {
+	switch mode {
+	case colorAlways:
+		return true
+	case colorNever:
+		return false
+	}
+	return os.Getenv("NO_COLOR") == "" && isTerminal(f)
+}
+
+// Sets up the colors of the screens and of the log
+func setupColor(mode string) error {
+	switch mode {
+	case colorAuto, colorAlways, colorNever:
+	default:
+		return fmt.Errorf("%w: %s, use auto, always or never", errInvalidColor, mode)
+	}
+	if !useColor(mode, os.Stdout) {
+		lipgloss.SetColorProfile(termenv.Ascii)
+	} else if lipgloss.ColorProfile() == termenv.Ascii {
+		// Forced colors when the output isn't a terminal
+		lipgloss.SetColorProfile(termenv.ANSI256)
+	}
+	dotsync.SetLogColors(useColor(mode, os.Stderr))
+	return nil
+}
@@ -0,0 +1,225 @@
+package dotsync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+# Adding files
+Files are added to the config by path, written with ~ for the home directory
+so the config works on machines with a different home. Only files are
+tracked, adding a directory adds the files inside it.
+
+To pick files, the home directory and the XDG config directory are scanned for
+dotfiles and directories commonly kept in a dotfiles repository. Git
+checkouts inside directories, like vim plugins, are left out.
+*/
+
+// Directories with more files than this are left out of the candidates
+const maxCandidateFiles = 500
+
+// Dotfiles and directories in the home directory worth tracking
+var knownDotfiles = []string{
+	".bash_aliases", ".bash_logout", ".bash_profile", ".bashrc", ".curlrc",
+	".editorconfig", ".emacs", ".emacs.d/init.el", ".gemrc", ".gitconfig",
+	".gitignore_global", ".gnupg/gpg-agent.conf", ".gnupg/gpg.conf", ".hgrc",
+	".inputrc", ".irbrc", ".nanorc", ".npmrc", ".profile", ".psqlrc",
+	".pythonrc", ".screenrc", ".ssh/config", ".tmux.conf", ".vim", ".vimrc",
+	".wgetrc", ".Xresources", ".xinitrc", ".xprofile", ".zlogin", ".zprofile",
+	".zshenv", ".zshrc",
+}
+
+// Files and directories in the XDG config directory worth tracking
+var knownConfigDirs = []string{
+	"alacritty", "bat", "dunst", "fish", "foot", "gh/config.yml", "ghostty",
+	"git", "helix", "htop", "hypr", "i3", "kitty", "lazygit", "nvim", "picom",
+	"polybar", "ranger", "rofi", "starship.toml", "sway", "tmux", "waybar",
+	"wezterm", "zed/settings.json", "Code/User/settings.json",
+	"Code/User/keybindings.json",
+}
+
+// A dotfile or directory that can be added
+type Candidate struct {
+	// With ~ for the home directory
+	Path string
+	Dir  bool
+	// The files that would be tracked, with ~ like Path
+	Files []string
+	// Size of the files in bytes
+	Size int64
+	// How many of the files are tracked already
+	Tracked int
+}
+
+func (c Candidate) FullyTracked() bool {
+	return c.Tracked == len(c.Files)
+}
+
+// Replaces the home directory with ~
+func shortenHome(path string) string {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return path
+	}
+	if path == home {
+		return "~"
+	}
+	if strings.HasPrefix(path, home+string(filepath.Separator)) {
+		return "~/" + filepath.ToSlash(path[len(home)+1:])
+	}
+	return path
+}
+
+func xdgConfigHome() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return dir
+	}
+	return expandHome("~/.config")
+}
+
+// Returns the regular files at path and their total size. Git checkouts and
+// symlinks are skipped
+func regularFiles(path string) ([]string, int64, error) {
+	files := []string{}
+	var size int64
+	err := afero.Walk(aferoFs, path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, p)
+			size += info.Size()
+		}
+		return nil
+	})
+	return files, size, err
+}
+
+// Scans the home directory and the XDG config directory for known dotfiles
+func scanCandidates(syncConfig SyncConfig) []Candidate {
+	paths := []string{}
+	for _, name := range knownDotfiles {
+		paths = append(paths, expandHome("~/"+name))
+	}
+	for _, name := range knownConfigDirs {
+		paths = append(paths, filepath.Join(xdgConfigHome(), name))
+	}
+	candidates := []Candidate{}
+	for _, path := range paths {
+		info, err := aferoFs.Stat(path)
+		if err != nil {
+			continue
+		}
+		files, size, err := regularFiles(path)
+		if err != nil || len(files) == 0 || len(files) > maxCandidateFiles {
+			continue
+		}
+		candidate := Candidate{Path: shortenHome(path), Dir: info.IsDir(), Size: size}
+		for _, file := range files {
+			candidate.Files = append(candidate.Files, shortenHome(file))
+			if isTracked(syncConfig, file) {
+				candidate.Tracked++
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Path < candidates[j].Path
+	})
+	return candidates
+}
+
+func isTracked(syncConfig SyncConfig, path string) bool {
+	for _, entry := range syncConfig.Files {
+		if samePath(entry.Path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the files to the config, directories are added file by file. Returns
+// the paths that were added, files tracked already are left alone
+func addConfigFiles(configPath string, paths []string) ([]string, error) {
+	doc, err := readConfigNode(configPath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filesNode(doc)
+	if err != nil {
+		return nil, err
+	}
+	tracked := func(path string) bool {
+		for _, node := range files.Content {
+			if samePath(entryNodePath(node), path) {
+				return true
+			}
+		}
+		return false
+	}
+	added := []string{}
+	for _, path := range paths {
+		found, _, err := regularFiles(expandHome(path))
+		if err != nil {
+			return added, err
+		}
+		for _, file := range found {
+			if file = shortenHome(file); tracked(file) {
+				continue
+			}
+			files.Content = append(files.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: file})
+			added = append(added, file)
+		}
+	}
+	if len(added) == 0 {
+		return added, nil
+	}
+	return added, writeConfigNode(configPath, doc)
+}
+
+// Returns the dotfiles found in the home directory that can be added
+func Candidates(opts Options) ([]Candidate, error) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return scanCandidates(syncConfig), nil
+}
+
+// Starts tracking the files and pushes them
+func AddFiles(paths []string, opts Options) {
+	for i, path := range paths {
+		path, err := filepath.Abs(expandHome(path))
+		if err == nil {
+			_, err = aferoFs.Stat(path)
+		}
+		if err != nil {
+			log.WithField("file", paths[i]).Error("Can't add file ", err)
+			os.Exit(1)
+		}
+		paths[i] = path
+	}
+	added, err := addConfigFiles(opts.configPath(), paths)
+	if err != nil {
+		log.WithField("path", opts.configPath()).Error("Failed to update config file ", err)
+		os.Exit(1)
+	}
+	if len(added) == 0 {
+		fmt.Println("The files are tracked already")
+		return
+	}
+	for _, path := range added {
+		fmt.Println("Added", path)
+	}
+	SyncOrigin(opts)
+}
@@ -0,0 +1,54 @@
+package dotsync
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupHome(t *testing.T, files ...string) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	t.Setenv("HOME", "/home/user")
+	t.Setenv("XDG_CONFIG_HOME", "")
+	for _, file := range files {
+		assert.NoError(t, aferoFs.WriteFile(expandHome(file), []byte(file), 0644))
+	}
+}
+
+func TestAddConfigFilesKeepsComments(t *testing.T) {
+	setupHome(t, "~/.bashrc", "~/.zshrc", "~/.config/nvim/init.lua", "~/.config/nvim/lua/plugins.lua")
+	configPath := "/home/user/.dotsync/config"
+	assert.NoError(t, aferoFs.WriteFile(configPath, []byte(testConfig), 0644))
+
+	added, err := addConfigFiles(configPath, []string{"/home/user/.bashrc", "/home/user/.zshrc", "~/.config/nvim"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"~/.zshrc", "~/.config/nvim/init.lua", "~/.config/nvim/lua/plugins.lua"}, added)
+
+	bytesRead, err := aferoFs.ReadFile(configPath)
+	assert.NoError(t, err)
+	assert.Equal(t, testConfig+`  - ~/.zshrc
+  - ~/.config/nvim/init.lua
+  - ~/.config/nvim/lua/plugins.lua
+`, string(bytesRead))
+
+	added, err = addConfigFiles(configPath, []string{"~/.zshrc"})
+	assert.NoError(t, err)
+	assert.Empty(t, added)
+}
+
+func TestScanCandidates(t *testing.T) {
+	setupHome(t, "~/.bashrc", "~/.vimrc", "~/.unknownrc", "~/.config/git/config",
+		"~/.config/git/ignore", "~/.vim/pack/plugin/.git/HEAD", "~/.vim/pack/plugin/plugin.vim")
+	syncConfig := syncConfigWith("~/.bashrc", "/home/user/.config/git/config")
+
+	candidates := scanCandidates(syncConfig)
+	assert.Equal(t, []Candidate{
+		{Path: "~/.bashrc", Files: []string{"~/.bashrc"}, Size: 9, Tracked: 1},
+		{Path: "~/.config/git", Dir: true, Files: []string{"~/.config/git/config", "~/.config/git/ignore"}, Size: 40, Tracked: 1},
+		{Path: "~/.vim", Dir: true, Files: []string{"~/.vim/pack/plugin/plugin.vim"}, Size: 29},
+		{Path: "~/.vimrc", Files: []string{"~/.vimrc"}, Size: 8},
+	}, candidates)
+	assert.True(t, candidates[0].FullyTracked())
+	assert.False(t, candidates[1].FullyTracked())
+}
@@ -0,0 +1,370 @@
+package dotsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+# Backups
+Before a restore overwrites a local file, the file is copied to a backup
+directory. Every restore that changes a file gets its own directory, named
+after the time it started, with a manifest listing each file, the name of its
+copy and the hash of what the restore wrote. Files that didn't exist before
+the restore are listed without a copy, files the restore removed are marked
+as deleted. The manifest is written after every file, so a restore that fails
+halfway can be undone as well.
+
+Undo reverts the newest backup: copies are written back, files created by the
+restore are removed, then the backup directory is removed so the next undo
+reverts the restore before it. Files changed since the restore are not
+touched unless forced. The manifest keeps the synced hashes of the local state
+from before the restore, the reverted files get them back so that the next
+sync sees them as they were before the pull.
+
+Backups are pruned on every new backup, keeping the newest ones and dropping
+those older than the max age.
+*/
+
+const (
+	DefaultBackupDirName = "backups"
+	DefaultBackupKeep    = 10
+	BackupManifestName   = "manifest.json"
+	// Sorts in the order the backups were made
+	backupTimeLayout = "20060102T150405.000000000Z"
+)
+
+var (
+	ErrNoBackup            = errors.New("no backup to undo")
+	ErrChangedSinceRestore = errors.New("files changed since the restore")
+)
+
+type BackupConfig struct {
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Directory of the backups, ~/.dotsync/backups by default
+	Dir string `yaml:"dir,omitempty"`
+	// Number of backups to keep
+	Keep   int           `yaml:"keep,omitempty"`
+	MaxAge time.Duration `yaml:"maxAge,omitempty"`
+}
+
+type backupManifest struct {
+	Created time.Time    `json:"created"`
+	Files   []backupFile `json:"files"`
+	// Synced hashes of the local state before the restore, see sync.go. Nil
+	// for backups made outside a restore
+	Synced map[string]string `json:"synced"`
+}
+
+type backupFile struct {
+	Path string `json:"path"`
+	// Name of the copy in the backup directory, empty if the file didn't exist
+	Copy string      `json:"copy,omitempty"`
+	Perm os.FileMode `json:"perm,omitempty"`
+	// Hash of the content written by the restore
+	Restored string `json:"restored,omitempty"`
+	// The restore removed the file
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// The backup of a single restore. The directory is only created once the
+// first file is saved
+type backup struct {
+	config   BackupConfig
+	dir      string
+	manifest backupManifest
+	saved    map[string]bool
+}
+
+func (c BackupConfig) dir() string {
+	if c.Dir != "" {
+		return expandHome(c.Dir)
+	}
+	return filepath.Join(filepath.Dir(getConfigPath()), DefaultBackupDirName)
+}
+
+func newBackup(config BackupConfig) *backup {
+	created := now().UTC()
+	return &backup{
+		config:   config,
+		dir:      filepath.Join(config.dir(), created.Format(backupTimeLayout)),
+		manifest: backupManifest{Created: created, Files: []backupFile{}},
+		saved:    make(map[string]bool),
+	}
+}
+
+// Copies the file to the backup before it is overwritten. Only the first
+// save of a path counts, later ones would copy what the restore wrote
+func (b *backup) save(filePath string) error {
+	if b.config.Disabled || b.saved[filePath] {
+		return nil
+	}
+	if len(b.saved) == 0 {
+		if err := aferoFs.MkdirAll(b.dir, 0700); err != nil {
+			return err
+		}
+		if err := pruneBackups(b.config, b.dir); err != nil {
+			log.WithField("dir", b.config.dir()).Warning("Failed to prune backups ", err)
+		}
+	}
+	b.saved[filePath] = true
+	file := backupFile{Path: filePath}
+	info, err := aferoFs.Stat(filePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		content, err := aferoFs.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		file.Copy = strconv.Itoa(len(b.manifest.Files))
+		file.Perm = info.Mode().Perm()
+		if err = aferoFs.WriteFile(filepath.Join(b.dir, file.Copy), content, 0600); err != nil {
+			return err
+		}
+	}
+	b.manifest.Files = append(b.manifest.Files, file)
+	return b.writeManifest()
+}
+
+// Records what the restore wrote to the saved files
+func (b *backup) restored(filePaths ...string) error {
+	if b.config.Disabled {
+		return nil
+	}
+	for i, file := range b.manifest.Files {
+		for _, filePath := range filePaths {
+			if file.Path != filePath {
+				continue
+			}
+			content, err := aferoFs.ReadFile(filePath)
+			if errors.Is(err, os.ErrNotExist) {
+				b.manifest.Files[i].Deleted = file.Copy != ""
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			b.manifest.Files[i].Restored = sha1Hash(content)
+		}
+	}
+	return b.writeManifest()
+}
+
+func (b *backup) writeManifest() error {
+	bytes, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(b.dir, BackupManifestName), append(bytes, '\n'), 0600)
+}
+
+// Returns the backup directories, oldest first
+func listBackups(dir string) ([]string, error) {
+	infos, err := aferoFs.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backups := []string{}
+	for _, info := range infos {
+		if _, err := time.Parse(backupTimeLayout, info.Name()); err == nil && info.IsDir() {
+			backups = append(backups, info.Name())
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// Removes the backups beyond the limits. The current backup is always kept
+func pruneBackups(config BackupConfig, current string) error {
+	keep := config.Keep
+	if keep <= 0 {
+		keep = DefaultBackupKeep
+	}
+	backups, err := listBackups(config.dir())
+	if err != nil {
+		return err
+	}
+	for i, name := range backups {
+		backupPath := filepath.Join(config.dir(), name)
+		if backupPath == current {
+			continue
+		}
+		created, _ := time.Parse(backupTimeLayout, name)
+		tooOld := config.MaxAge > 0 && time.Since(created) > config.MaxAge
+		if len(backups)-i > keep || tooOld {
+			if err = aferoFs.RemoveAll(backupPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reverts the newest backup and resets the synced hashes of the reverted
+// files. Returns the reverted files
+func undoBackup(syncConfig SyncConfig, force bool) ([]string, error) {
+	config := syncConfig.Backups
+	backups, err := listBackups(config.dir())
+	if err != nil {
+		return nil, err
+	}
+	if len(backups) == 0 {
+		return nil, ErrNoBackup
+	}
+	dir := filepath.Join(config.dir(), backups[len(backups)-1])
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	reverted, err := revertFiles(dir, manifest, force)
+	if manifest.Synced == nil || len(reverted) == 0 {
+		return reverted, err
+	}
+	state, stateErr := readState(statePath())
+	if stateErr == nil {
+		state.revertSynced(syncConfig, manifest.Synced, reverted)
+		stateErr = state.write(statePath())
+	}
+	if err == nil {
+		err = stateErr
+	}
+	return reverted, err
+}
+
+// Puts back the synced hashes of the files whose local paths were reverted
+func (s *localState) revertSynced(syncConfig SyncConfig, synced map[string]string, reverted []string) {
+	for _, entry := range syncConfig.Files {
+		for _, filePath := range restoredPaths(entry) {
+			if !containsString(reverted, filePath) {
+				continue
+			}
+			if hash, ok := synced[entry.ID()]; ok {
+				s.Synced[entry.ID()] = hash
+			} else {
+				delete(s.Synced, entry.ID())
+			}
+			break
+		}
+	}
+}
+
+func readManifest(dir string) (backupManifest, error) {
+	manifest := backupManifest{}
+	bytes, err := aferoFs.ReadFile(filepath.Join(dir, BackupManifestName))
+	if err != nil {
+		return manifest, err
+	}
+	if err = json.Unmarshal(bytes, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest %s: %w", dir, err)
+	}
+	return manifest, nil
+}
+
+// Writes the backed up files back and removes the backup
+func revertBackup(dir string, force bool) ([]string, error) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	return revertFiles(dir, manifest, force)
+}
+
+func revertFiles(dir string, manifest backupManifest, force bool) ([]string, error) {
+	var err error
+	if !force {
+		changed := []string{}
+		for _, file := range manifest.Files {
+			current, err := aferoFs.ReadFile(file.Path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+			// Files the restore never got to are still as they were
+			if file.Restored != "" && (err != nil || sha1Hash(current) != file.Restored) {
+				changed = append(changed, file.Path)
+			}
+			if file.Deleted && err == nil {
+				changed = append(changed, file.Path)
+			}
+		}
+		if len(changed) > 0 {
+			return nil, fmt.Errorf("%w: %s", ErrChangedSinceRestore, strings.Join(changed, ", "))
+		}
+	}
+
+	reverted := []string{}
+	for _, file := range manifest.Files {
+		if file.Restored == "" && !file.Deleted {
+			continue
+		}
+		if file.Copy == "" {
+			if err = aferoFs.Remove(file.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return reverted, err
+			}
+		} else {
+			content, err := aferoFs.ReadFile(filepath.Join(dir, file.Copy))
+			if err != nil {
+				return reverted, err
+			}
+			if err = writeRestored(file.Path, content, file.Perm); err != nil {
+				return reverted, err
+			}
+			if err = aferoFs.Chmod(file.Path, file.Perm); err != nil {
+				return reverted, err
+			}
+		}
+		reverted = append(reverted, file.Path)
+	}
+	return reverted, aferoFs.RemoveAll(dir)
+}
+
+// Reverts the files changed by the last restore
+func Undo(force bool, opts Options) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		log.WithField("path", getConfigPath()).Error("Failed to open config file. Error: ", err)
+		os.Exit(1)
+	}
+	var reverted []string
+	err = withLock(syncConfig, opts.LockWait, func() error {
+		reverted, err = undoBackup(syncConfig, force)
+		return err
+	})
+	if errors.Is(err, ErrChangedSinceRestore) {
+		log.Error(err, ", undo with --force to overwrite them")
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Error("Failed to undo the last restore ", err)
+		os.Exit(1)
+	}
+	for _, filePath := range reverted {
+		fmt.Println("reverted", filePath)
+	}
+}
+
+// Backs up the files, writes them and records what was written. Partial
+// writes are recorded as well, so they can be undone
+func (b *backup) write(filePaths []string, write func() error) error {
+	for _, filePath := range filePaths {
+		if err := b.save(filePath); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", filePath, err)
+		}
+	}
+	err := write()
+	if backupErr := b.restored(filePaths...); err == nil {
+		err = backupErr
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package dotsync
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const backupPath = "/tmp/backups"
+
+func TestUndoRevertsRestore(t *testing.T) {
+	currentFiles, newFiles := initalise()
+	original := [][]byte{}
+	for _, path := range newFiles[:2] {
+		content, _ := aferoFs.ReadFile(path)
+		original = append(original, content)
+	}
+	// The remote has the files in the sync directory, and a file that doesn't exist locally
+	created := filepath.Join(otherPath, "created")
+	remote := make(map[string]FileInfo)
+	for i, hash := range hashesOf(currentFiles) {
+		path := newFiles[i]
+		if i == 2 {
+			path = created
+		}
+		remote[hash] = FileInfo{Path: path, Perm: 0644}
+		assert.NoError(t, aferoFs.Rename(currentFiles[i], filepath.Join(dotsyncPath, hash)))
+	}
+	syncConfig := syncConfigWith(newFiles[0], newFiles[1], created)
+	syncConfig.Pull = PullOverwrite
+	syncConfig.Backups.Dir = backupPath
+	restored, err := restoreFiles(syncConfig, map[string]FileInfo{}, remote, nil)
+	assert.NoError(t, err)
+	assert.Len(t, restored, 3)
+
+	reverted, err := undoBackup(syncConfig, false)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{newFiles[0], newFiles[1], created}, reverted)
+	for i, path := range newFiles[:2] {
+		content, _ := aferoFs.ReadFile(path)
+		assert.Equal(t, original[i], content)
+	}
+	exists, _ := aferoFs.Exists(created)
+	assert.False(t, exists)
+
+	// The backup is gone once undone
+	_, err = undoBackup(syncConfig, false)
+	assert.ErrorIs(t, err, ErrNoBackup)
+}
+
+func TestUndoKeepsFilesChangedSinceRestore(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	path := filepath.Join(otherPath, "file")
+	assert.NoError(t, aferoFs.WriteFile(path, []byte("hand edited"), 0644))
+	config := BackupConfig{Dir: backupPath}
+	backup := newBackup(config)
+	assert.NoError(t, backup.save(path))
+	assert.NoError(t, aferoFs.WriteFile(path, []byte("restored"), 0644))
+	assert.NoError(t, backup.restored(path))
+	assert.NoError(t, aferoFs.WriteFile(path, []byte("edited again"), 0644))
+
+	_, err := undoBackup(SyncConfig{Backups: config}, false)
+	assert.ErrorIs(t, err, ErrChangedSinceRestore)
+	content, _ := aferoFs.ReadFile(path)
+	assert.Equal(t, "edited again", string(content))
+
+	_, err = undoBackup(SyncConfig{Backups: config}, true)
+	assert.NoError(t, err)
+	content, _ = aferoFs.ReadFile(path)
+	assert.Equal(t, "hand edited", string(content))
+}
+
+func TestPruneBackups(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	now := time.Now().UTC()
+	for i := 5; i > 0; i-- {
+		name := now.Add(-time.Duration(i) * time.Hour).Format(backupTimeLayout)
+		assert.NoError(t, aferoFs.MkdirAll(filepath.Join(backupPath, name), 0700))
+	}
+	current := filepath.Join(backupPath, now.Format(backupTimeLayout))
+	assert.NoError(t, aferoFs.MkdirAll(current, 0700))
+
+	assert.NoError(t, pruneBackups(BackupConfig{Dir: backupPath, Keep: 4}, current))
+	backups, err := listBackups(backupPath)
+	assert.NoError(t, err)
+	assert.Len(t, backups, 4)
+	assert.Equal(t, filepath.Base(current), backups[3])
+
+	assert.NoError(t, pruneBackups(BackupConfig{Dir: backupPath, MaxAge: 150 * time.Minute}, current))
+	backups, err = listBackups(backupPath)
+	assert.NoError(t, err)
+	assert.Len(t, backups, 3, fmt.Sprint(backups))
+}
+
+func TestDisabledBackup(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	path := filepath.Join(otherPath, "file")
+	assert.NoError(t, aferoFs.WriteFile(path, []byte("content"), 0644))
+	config := BackupConfig{Dir: backupPath, Disabled: true}
+	assert.NoError(t, newBackup(config).save(path))
+	_, err := undoBackup(SyncConfig{Backups: config}, false)
+	assert.ErrorIs(t, err, ErrNoBackup)
+}
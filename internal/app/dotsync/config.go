@@ -0,0 +1,130 @@
+package dotsync
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Changes to the config file are made on the yaml document rather than on
+// SyncConfig, so that comments and ordering written by the user survive
+
+const defaultConfigPerm os.FileMode = 0600
+
+var ErrMalformedConfig = errors.New("malformed config")
+
+func readConfigNode(configPath string) (*yaml.Node, error) {
+	bytesRead, err := aferoFs.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	doc := &yaml.Node{}
+	if err = yaml.Unmarshal(bytesRead, doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind == 0 {
+		// Empty file
+		doc.Kind = yaml.DocumentNode
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, ErrMalformedConfig
+	}
+	return doc, nil
+}
+
+func writeConfigNode(configPath string, doc *yaml.Node) error {
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	perm := defaultConfigPerm
+	if info, err := aferoFs.Stat(configPath); err == nil {
+		perm = info.Mode().Perm()
+	}
+	return writeFileAtomic(configPath, buffer.Bytes(), perm)
+}
+
+// Returns the sequence of tracked files, adding an empty one if the config has none
+func filesNode(doc *yaml.Node) (*yaml.Node, error) {
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "files" {
+			files := root.Content[i+1]
+			if files.Kind == yaml.ScalarNode && files.Tag == "!!null" {
+				files.Kind = yaml.SequenceNode
+				files.Tag = "!!seq"
+				files.Value = ""
+			}
+			if files.Kind != yaml.SequenceNode {
+				return nil, ErrMalformedConfig
+			}
+			return files, nil
+		}
+	}
+	key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "files"}
+	files := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	root.Content = append(root.Content, key, files)
+	return files, nil
+}
+
+// Returns the path of a file entry, written either as a plain path or as
+// a mapping with a path key
+func entryNodePath(node *yaml.Node) string {
+	if node.Kind == yaml.ScalarNode {
+		return node.Value
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == "path" {
+			return node.Content[i+1].Value
+		}
+	}
+	return ""
+}
+
+// Paths in the config may or may not use ~ for the home directory
+func samePath(a, b string) bool {
+	return filepath.Clean(expandHome(a)) == filepath.Clean(expandHome(b))
+}
+
+// Removes the tracked files from the config. Returns the paths that were removed
+func removeConfigFiles(configPath string, paths []string) ([]string, error) {
+	doc, err := readConfigNode(configPath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filesNode(doc)
+	if err != nil {
+		return nil, err
+	}
+	removed := []string{}
+	kept := []*yaml.Node{}
+	for _, node := range files.Content {
+		entryPath := entryNodePath(node)
+		remove := false
+		for _, path := range paths {
+			if samePath(entryPath, path) {
+				remove = true
+				break
+			}
+		}
+		if remove {
+			removed = append(removed, entryPath)
+		} else {
+			kept = append(kept, node)
+		}
+	}
+	if len(removed) == 0 {
+		return removed, nil
+	}
+	files.Content = kept
+	return removed, writeConfigNode(configPath, doc)
+}
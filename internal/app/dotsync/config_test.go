@@ -0,0 +1,58 @@
+package dotsync
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig = `# Where the repository lives
+gitconfig:
+  url: git@github.com:user/dotfiles.git
+  sshKey: ~/.ssh/id_ed25519
+files:
+  # Shell
+  - ~/.bashrc
+  - path: ~/.tmux.conf # Terminal
+    pull: skip
+  - ~/.vimrc
+`
+
+func TestRemoveConfigFilesKeepsComments(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	configPath := "/home/user/.dotsync/config"
+	assert.NoError(t, aferoFs.WriteFile(configPath, []byte(testConfig), 0644))
+
+	removed, err := removeConfigFiles(configPath, []string{"~/.tmux.conf", "~/.vimrc", "~/.zshrc"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"~/.tmux.conf", "~/.vimrc"}, removed)
+
+	bytesRead, err := aferoFs.ReadFile(configPath)
+	assert.NoError(t, err)
+	assert.Equal(t, `# Where the repository lives
+gitconfig:
+  url: git@github.com:user/dotfiles.git
+  sshKey: ~/.ssh/id_ed25519
+files:
+  # Shell
+  - ~/.bashrc
+`, string(bytesRead))
+}
+
+func TestRemoveConfigFilesWithoutMatch(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	configPath := "/home/user/.dotsync/config"
+	assert.NoError(t, aferoFs.WriteFile(configPath, []byte(testConfig), 0644))
+
+	removed, err := removeConfigFiles(configPath, []string{"~/.zshrc"})
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+	bytesRead, _ := aferoFs.ReadFile(configPath)
+	assert.Equal(t, testConfig, string(bytesRead))
+}
+
+func TestOptionsConfigPath(t *testing.T) {
+	assert.Equal(t, "/etc/dotsync/config", Options{ConfigPath: "/etc/dotsync/config"}.configPath())
+	assert.Equal(t, getConfigPath(), Options{}.configPath())
+}
@@ -0,0 +1,229 @@
+package dotsync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/*
+# Resolving conflicts
+Markers replace the local version of a conflicting file, so the local
+version is kept in ~/.dotsync/conflicts under its hash until the conflict is
+resolved. Together with the base and the remote version from the sync
+directory or its history, every conflict can be shown and merged again.
+
+A resolution is the new content of a file, without markers. All resolutions
+are written at once, if one fails the ones already written are reverted from
+their backup. The resolved files are then synced with the remote version they
+conflicted with as their base, so they are pushed unless the remote changed
+again in the meantime.
+*/
+
+const ConflictsDirName = "conflicts"
+
+var (
+	ErrNoConflict = errors.New("file has no conflict")
+	ErrUnresolved = errors.New("resolution still has conflict markers")
+)
+
+// A file waiting for its conflict to be resolved, with every version of it
+type Conflict struct {
+	ID string
+	// The local file, the source of templates
+	Path string
+	// The remote version written next to the file, if any
+	Copy   string
+	Base   []byte
+	Local  []byte
+	Remote []byte
+	// Binary files can only be resolved by keeping one of the versions
+	Binary bool
+	Hunks  []Hunk
+}
+
+// The new content of a file with a conflict
+type Resolution struct {
+	ID      string
+	Content []byte
+}
+
+func conflictsDir() string {
+	return filepath.Join(filepath.Dir(getConfigPath()), ConflictsDirName)
+}
+
+func storeConflictVersion(hash string, content []byte) error {
+	if err := aferoFs.MkdirAll(conflictsDir(), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(conflictsDir(), hash), content, 0600)
+}
+
+func (s *localState) clearConflict(id string) {
+	conflict, ok := s.Conflicts[id]
+	if !ok {
+		return
+	}
+	aferoFs.Remove(filepath.Join(conflictsDir(), conflict.Local))
+	delete(s.Conflicts, id)
+}
+
+// Reads every version of the conflicting file
+func loadConflict(syncConfig SyncConfig, cipher *blobCipher, history blobHistory, id string, state conflictState) (Conflict, error) {
+	entry, ok := syncConfig.Entry(id)
+	if !ok {
+		return Conflict{}, fmt.Errorf("%w: %s is not tracked", ErrNoConflict, id)
+	}
+	conflict := Conflict{ID: id, Path: state.File, Copy: state.Copy}
+	var err error
+	conflict.Local, err = aferoFs.ReadFile(filepath.Join(conflictsDir(), state.Local))
+	if errors.Is(err, os.ErrNotExist) {
+		// Conflicts written to a copy leave the local file alone
+		conflict.Local, err = readFiltered(entry.sourcePath(), entry.Filters)
+	}
+	if err != nil {
+		return conflict, err
+	}
+	if conflict.Remote, err = readSyncedBlob(syncConfig, cipher, history, state.Remote); err != nil {
+		return conflict, fmt.Errorf("failed to read remote version of %s: %w", id, err)
+	}
+	if state.Base != "" {
+		if conflict.Base, err = readSyncedBlob(syncConfig, cipher, history, state.Base); err != nil {
+			log.WithField("file", id).Warning("Failed to read base version ", err)
+		}
+	}
+	conflict.Binary = isBinary(conflict.Base) || isBinary(conflict.Local) || isBinary(conflict.Remote)
+	if !conflict.Binary {
+		conflict.Hunks = mergeHunks(conflict.Base, conflict.Local, conflict.Remote)
+	}
+	return conflict, nil
+}
+
+// Returns the unresolved conflicts, sorted by file
+func loadConflicts(syncConfig SyncConfig, history blobHistory) ([]Conflict, error) {
+	state, err := readState(statePath())
+	if err != nil {
+		return nil, err
+	}
+	cipher := newSyncCipher(syncConfig)
+	ids := []string{}
+	for id := range state.Conflicts {
+		held, err := state.holdConflict(id)
+		if err != nil {
+			return nil, err
+		}
+		if held {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	conflicts := []Conflict{}
+	for _, id := range ids {
+		conflict, err := loadConflict(syncConfig, cipher, history, id, state.Conflicts[id])
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, nil
+}
+
+// Writes all resolutions or none. Resolved files get the remote version they
+// conflicted with as their synced version
+func applyResolutions(syncConfig SyncConfig, resolutions []Resolution) error {
+	r, err := newRestorer(syncConfig, nil)
+	if err != nil {
+		return err
+	}
+	for _, resolution := range resolutions {
+		if _, ok := r.state.Conflicts[resolution.ID]; !ok {
+			return fmt.Errorf("%w: %s", ErrNoConflict, resolution.ID)
+		}
+		if hasConflictMarkers(resolution.Content) {
+			return fmt.Errorf("%w: %s", ErrUnresolved, resolution.ID)
+		}
+	}
+	for _, resolution := range resolutions {
+		if err = r.resolve(resolution); err != nil {
+			if len(r.backup.saved) > 0 {
+				if _, revertErr := revertBackup(r.backup.dir, true); revertErr != nil {
+					log.Error("Failed to revert resolved files ", revertErr)
+				}
+			}
+			return fmt.Errorf("failed to resolve %s: %w", resolution.ID, err)
+		}
+	}
+	for _, resolution := range resolutions {
+		conflict := r.state.Conflicts[resolution.ID]
+		if conflict.Copy != "" {
+			if err = aferoFs.Remove(conflict.Copy); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		r.state.Synced[resolution.ID] = conflict.Remote
+		r.state.clearConflict(resolution.ID)
+	}
+	return r.state.write(statePath())
+}
+
+func (r *restorer) resolve(resolution Resolution) error {
+	entry, ok := r.syncConfig.Entry(resolution.ID)
+	if !ok {
+		return fmt.Errorf("%w: %s is not tracked", ErrNoConflict, resolution.ID)
+	}
+	secrets, err := r.secrets(entry)
+	if err != nil {
+		return err
+	}
+	if secrets != nil {
+		// Secrets of the local file win, like when merging
+		if content, err := aferoFs.ReadFile(entry.sourcePath()); err == nil {
+			if _, localSecrets, err := cleanContent(content, entry.Filters); err == nil {
+				for k, v := range localSecrets {
+					secrets[k] = v
+				}
+			}
+		}
+	}
+	info := FileInfo{Path: resolution.ID, Perm: 0644}
+	if stat, err := aferoFs.Stat(entry.sourcePath()); err == nil {
+		info.Perm = stat.Mode()
+	}
+	return r.backup.write(restoredPaths(entry), func() error {
+		return writeContent(r.syncConfig, info, entry, resolution.Content, secrets)
+	})
+}
+
+// Returns the unresolved conflicts with every version of the files
+func Conflicts(opts Options) ([]Conflict, error) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	repository, err := NewRepository(syncConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+	history := commitBlobs{repository: repository, commit: repository.headCommit(), syncConfig: syncConfig}
+	return loadConflicts(syncConfig, history)
+}
+
+// Writes the resolutions, then syncs to push them
+func ResolveConflicts(resolutions []Resolution, opts Options) ([]FileSync, error) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	SetupLogging(syncConfig.Path)
+	var changes []FileSync
+	err = withLock(syncConfig, opts.LockWait, func() error {
+		if err := applyResolutions(syncConfig, resolutions); err != nil {
+			return err
+		}
+		changes, err = syncBoth(syncConfig)
+		return err
+	})
+	return changes, err
+}
@@ -0,0 +1,67 @@
+package dotsync
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAndResolveConflict(t *testing.T) {
+	local, theirs := "one\nTWO\nthree\nfour\nfive\n", "one\nzwei\nthree\nfour\nFIVE\n"
+	path, base, remote, history := setupMerge(t, local, theirs)
+	syncConfig := syncConfigWith(path)
+	syncConfig.Backups.Dir = backupPath
+	_, err := restoreFiles(syncConfig, base, remote, history)
+	assert.NoError(t, err)
+
+	conflicts, err := loadConflicts(syncConfig, history)
+	assert.NoError(t, err)
+	assert.Len(t, conflicts, 1)
+	conflict := conflicts[0]
+	assert.Equal(t, path, conflict.ID)
+	assert.Equal(t, local, string(conflict.Local))
+	assert.Equal(t, theirs, string(conflict.Remote))
+	assert.Equal(t, mergeBase, string(conflict.Base))
+	assert.False(t, conflict.Binary)
+	assert.Len(t, conflict.Hunks, 3)
+	assert.True(t, conflict.Hunks[1].Conflict)
+
+	// Resolutions with markers are refused
+	unresolved := ResolveHunks(conflict.Hunks, nil)
+	err = applyResolutions(syncConfig, []Resolution{{ID: path, Content: unresolved}})
+	assert.ErrorIs(t, err, ErrUnresolved)
+	err = applyResolutions(syncConfig, []Resolution{{ID: "/other", Content: []byte("x")}})
+	assert.ErrorIs(t, err, ErrNoConflict)
+
+	resolved := ResolveHunks(conflict.Hunks, []HunkChoice{HunkBoth})
+	assert.Equal(t, "one\nTWO\nzwei\nthree\nfour\nFIVE\n", string(resolved))
+	assert.NoError(t, applyResolutions(syncConfig, []Resolution{{ID: path, Content: resolved}}))
+	content, _ := aferoFs.ReadFile(path)
+	assert.Equal(t, resolved, content)
+
+	state, err := readState(statePath())
+	assert.NoError(t, err)
+	assert.Empty(t, state.Conflicts)
+	assert.Equal(t, sha1Hash([]byte(theirs)), state.Synced[path])
+	exists, _ := aferoFs.Exists(filepath.Join(conflictsDir(), sha1Hash([]byte(local))))
+	assert.False(t, exists)
+}
+
+func TestResolveConflictCopy(t *testing.T) {
+	local, theirs := "one\nTWO\nthree\nfour\nfive\n", "one\nzwei\nthree\nfour\nfive\n"
+	path, base, remote, history := setupMerge(t, local, theirs)
+	syncConfig := syncConfigWith(path)
+	syncConfig.Conflict = ConflictCopy
+	_, err := restoreFiles(syncConfig, base, remote, history)
+	assert.NoError(t, err)
+
+	conflicts, err := loadConflicts(syncConfig, history)
+	assert.NoError(t, err)
+	assert.Equal(t, path+ConflictSuffix, conflicts[0].Copy)
+	assert.NoError(t, applyResolutions(syncConfig, []Resolution{{ID: path, Content: conflicts[0].Remote}}))
+	content, _ := aferoFs.ReadFile(path)
+	assert.Equal(t, theirs, string(content))
+	exists, _ := aferoFs.Exists(path + ConflictSuffix)
+	assert.False(t, exists)
+}
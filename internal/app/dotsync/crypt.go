@@ -0,0 +1,495 @@
+package dotsync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+/*
+# Encryption
+Files marked with encrypt are encrypted with XChaCha20-Poly1305 before they
+are written to the sync directory. The key is either read from a local key
+file, generated with dotsync keygen --key, or derived from a passphrase with
+scrypt.
+
+Encrypted blobs start with a header that tells how the key is obtained
+
+	magic "DSENC" | version | mode | salt (passphrase mode only) | nonce | ciphertext
+
+When the sync directory has a recipients file, see recipients.go, the
+recipients replace the key file and the passphrase
+
+	magic "DSENC" | version | mode | recipient count | stanzas | nonce | ciphertext
+
+The header is authenticated as additional data. Restoring and diffing tell
+encrypted blobs from plain ones by their name in the index rather than by the
+magic, so a plain file that happens to start with it is left alone.
+
+Encrypted files are named and indexed by an HMAC of the plaintext, a plain
+hash would let anyone with the repository confirm a guess of the content. The
+hash key is derived from the key file or the passphrase, the latter with a
+random salt kept in the sync directory so that repositories sharing a
+passphrase don't share hashes. With recipients it is a random key, kept in the
+sync directory encrypted for the recipients.
+Encrypting a file again with a new nonce doesn't count as a change.
+*/
+
+const (
+	DefaultKeyFileName = "key"
+	HashKeyFileName    = ".hashkey"
+	HashSaltFileName   = ".hashsalt"
+	PassphraseEnv      = "DOTSYNC_PASSPHRASE"
+
+	encryptionVersion      = 1
+	modeKeyFile       byte = 1
+	modePassphrase    byte = 2
+	modeRecipients    byte = 3
+	keySize                = chacha20poly1305.KeySize
+	saltSize               = 16
+	scryptN                = 1 << 15
+	scryptR                = 8
+	scryptP                = 1
+)
+
+var (
+	encryptionMagic = []byte("DSENC")
+	hashKeyInfo     = []byte("dotsync hash key")
+)
+
+var (
+	ErrMissingKey        = errors.New("missing encryption key")
+	ErrInvalidKey        = errors.New("invalid encryption key")
+	ErrMissingPassphrase = errors.New("missing passphrase")
+	ErrMalformedBlob     = errors.New("malformed encrypted file")
+	ErrDecrypt           = errors.New("failed to decrypt file")
+)
+
+type EncryptionConfig struct {
+	// Path of the local key file, defaults to key next to the config
+	KeyFile string `yaml:"keyFile,omitempty"`
+	// Derive the key from a passphrase instead of using a key file
+	Passphrase bool `yaml:"passphrase,omitempty"`
+	// Path of the identity used to decrypt files encrypted for recipients,
+	// defaults to identity next to the config, then ~/.ssh/id_ed25519
+	Identity string `yaml:"identity,omitempty"`
+}
+
+// Encrypts and decrypts blobs. Keys are loaded on first use and cached,
+// so a passphrase is asked for at most once
+type blobCipher struct {
+	config     EncryptionConfig
+	key        []byte
+	passphrase []byte
+	// Salt and key used for encrypting in passphrase mode
+	salt    []byte
+	saltKey []byte
+	// Keys derived from the passphrase for decrypting, keyed by salt
+	derived map[string][]byte
+	// Recipients file in the sync directory, empty when recipients aren't used
+	recipientsFile string
+	recipients     []recipient
+	identity       *identity
+	// Key of the hash of encrypted files
+	hashKey []byte
+}
+
+func newBlobCipher(config EncryptionConfig) *blobCipher {
+	return &blobCipher{
+		config:  config,
+		derived: make(map[string][]byte),
+	}
+}
+
+// Returns a cipher that encrypts for the recipients of the sync directory, if it has any
+func newSyncCipher(syncConfig SyncConfig) *blobCipher {
+	c := newBlobCipher(syncConfig.Encryption)
+	c.recipientsFile = recipientsPath(syncConfig)
+	return c
+}
+
+func (c *blobCipher) loadRecipients() ([]recipient, error) {
+	if c.recipients != nil || c.recipientsFile == "" {
+		return c.recipients, nil
+	}
+	recipients, err := readRecipients(c.recipientsFile)
+	if err != nil {
+		return nil, err
+	}
+	c.recipients = recipients
+	return recipients, nil
+}
+
+func (c *blobCipher) loadIdentity() (*identity, error) {
+	if c.identity != nil {
+		return c.identity, nil
+	}
+	id, err := readIdentity(c.config)
+	if err != nil {
+		return nil, err
+	}
+	c.identity = id
+	return id, nil
+}
+
+// Reports if the blob was written by encrypt
+func isEncrypted(blob []byte) bool {
+	return bytes.HasPrefix(blob, encryptionMagic)
+}
+
+// Reports if the blob stored under the hash in the sync directory is
+// encrypted. Plain blobs are named by the SHA1 of their content, encrypted
+// ones by the hash of their plaintext, which the magic can't tell apart
+func isEncryptedBlob(hash string, blob []byte) bool {
+	return isEncrypted(blob) && sha1Hash(blob) != hash
+}
+
+func (c *blobCipher) encrypt(plaintext []byte) ([]byte, error) {
+	header := append([]byte{}, encryptionMagic...)
+	header = append(header, encryptionVersion)
+	recipients, err := c.loadRecipients()
+	if err != nil {
+		return nil, err
+	}
+	var key []byte
+	if len(recipients) > 0 {
+		key = make([]byte, keySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		stanzas, err := wrapFileKey(key, recipients)
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, modeRecipients)
+		header = append(header, byte(len(recipients)>>8), byte(len(recipients)))
+		header = append(header, stanzas...)
+	} else if c.config.Passphrase {
+		if c.saltKey == nil {
+			salt := make([]byte, saltSize)
+			if _, err := rand.Read(salt); err != nil {
+				return nil, err
+			}
+			derived, err := c.deriveKey(salt)
+			if err != nil {
+				return nil, err
+			}
+			c.salt, c.saltKey = salt, derived
+		}
+		header = append(header, modePassphrase)
+		header = append(header, c.salt...)
+		key = c.saltKey
+	} else {
+		fileKey, err := c.fileKey()
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, modeKeyFile)
+		key = fileKey
+	}
+	return seal(key, header, plaintext)
+}
+
+func (c *blobCipher) decrypt(blob []byte) ([]byte, error) {
+	headerSize := len(encryptionMagic) + 2
+	if len(blob) < headerSize || !isEncrypted(blob) || blob[len(encryptionMagic)] != encryptionVersion {
+		return nil, ErrMalformedBlob
+	}
+	var key []byte
+	var err error
+	switch blob[headerSize-1] {
+	case modeKeyFile:
+		key, err = c.fileKey()
+	case modePassphrase:
+		if len(blob) < headerSize+saltSize {
+			return nil, ErrMalformedBlob
+		}
+		key, err = c.deriveKey(blob[headerSize : headerSize+saltSize])
+		headerSize += saltSize
+	case modeRecipients:
+		if len(blob) < headerSize+2 {
+			return nil, ErrMalformedBlob
+		}
+		count := int(binary.BigEndian.Uint16(blob[headerSize:]))
+		stanzasStart := headerSize + 2
+		headerSize = stanzasStart + count*stanzaSize
+		if len(blob) < headerSize {
+			return nil, ErrMalformedBlob
+		}
+		var id *identity
+		if id, err = c.loadIdentity(); err == nil {
+			key, err = unwrapFileKey(blob[stanzasStart:headerSize], id)
+		}
+	default:
+		return nil, ErrMalformedBlob
+	}
+	if err != nil {
+		return nil, err
+	}
+	return open(key, blob[:headerSize], blob[headerSize:])
+}
+
+// Decrypts the blob stored under the hash if it is encrypted, otherwise
+// returns it untouched
+func (c *blobCipher) decode(hash string, blob []byte) ([]byte, error) {
+	if !isEncryptedBlob(hash, blob) {
+		return blob, nil
+	}
+	return c.decrypt(blob)
+}
+
+// Encrypts with a random nonce, the nonce is written between header and ciphertext
+func seal(key, header, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	blob := append(header, nonce...)
+	return aead.Seal(blob, nonce, plaintext, header), nil
+}
+
+func open(key, header, sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformedBlob
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// Names the content in the index. Encrypted content is hashed with the hash key
+func (c *blobCipher) contentHash(encrypt bool, content []byte) (string, error) {
+	if !encrypt {
+		return sha1Hash(content), nil
+	}
+	key, err := c.loadHashKey()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha1.New, key)
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (c *blobCipher) loadHashKey() ([]byte, error) {
+	if c.hashKey != nil {
+		return c.hashKey, nil
+	}
+	recipients, err := c.loadRecipients()
+	if err != nil {
+		return nil, err
+	}
+	var key []byte
+	switch {
+	case len(recipients) > 0:
+		key, err = c.sharedHashKey()
+	case c.config.Passphrase:
+		var salt []byte
+		if salt, err = c.hashSalt(); err == nil {
+			key, err = c.deriveKey(salt)
+		}
+	default:
+		key, err = c.fileKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		// Not the key of any blob
+		mac := hmac.New(sha256.New, key)
+		mac.Write(hashKeyInfo)
+		key = mac.Sum(nil)
+	}
+	c.hashKey = key
+	return key, nil
+}
+
+func hashKeyPath(recipientsFile string) string {
+	return filepath.Join(filepath.Dir(recipientsFile), HashKeyFileName)
+}
+
+func hashSaltPath(recipientsFile string) string {
+	return filepath.Join(filepath.Dir(recipientsFile), HashSaltFileName)
+}
+
+// Reads the salt of the hash key derived from the passphrase, generates it
+// the first time. It has to be the same on every machine, unlike the salt of
+// a blob, so it is synced with the files
+func (c *blobCipher) hashSalt() ([]byte, error) {
+	if c.recipientsFile == "" {
+		return nil, fmt.Errorf("%w: no sync directory to keep the %s in", ErrMissingKey, HashSaltFileName)
+	}
+	path := hashSaltPath(c.recipientsFile)
+	encoded, err := aferoFs.ReadFile(path)
+	if err == nil {
+		salt, err := hex.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || len(salt) != saltSize {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidKey, path)
+		}
+		return salt, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	salt := make([]byte, saltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(path, []byte(hex.EncodeToString(salt)+"\n"), 0666); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Reads the hash key shared with the recipients, generates it the first time
+func (c *blobCipher) sharedHashKey() ([]byte, error) {
+	path := hashKeyPath(c.recipientsFile)
+	blob, err := aferoFs.ReadFile(path)
+	if err == nil {
+		key, err := c.decrypt(blob)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", HashKeyFileName, err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key := make([]byte, keySize)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	if blob, err = c.encrypt(key); err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(path, blob, 0666); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Reports if any tracked file is encrypted
+func (s *SyncConfig) encrypts() bool {
+	for _, f := range s.Files {
+		if f.Encrypt {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *blobCipher) keyFilePath() string {
+	if c.config.KeyFile != "" {
+		return expandHome(c.config.KeyFile)
+	}
+	return filepath.Join(filepath.Dir(getConfigPath()), DefaultKeyFileName)
+}
+
+// Reads the hex encoded key from the key file. A missing key file is never
+// generated here, files encrypted with a new key wouldn't decrypt on the
+// machines that have the old one
+func (c *blobCipher) fileKey() ([]byte, error) {
+	if c.key != nil {
+		return c.key, nil
+	}
+	keyPath := c.keyFilePath()
+	encoded, err := aferoFs.ReadFile(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s, copy it from a machine that syncs the encrypted files, "+
+			"or create the first key with dotsync keygen --key", ErrMissingKey, keyPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidKey, keyPath)
+	}
+	c.key = key
+	return key, nil
+}
+
+// Writes a new random key to the key file
+func (c *blobCipher) generateKey(keyPath string) ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := aferoFs.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(keyPath, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	log.WithField("path", keyPath).
+		Warning("Generated new encryption key, copy it to your other machines and keep a backup")
+	c.key = key
+	return key, nil
+}
+
+func (c *blobCipher) deriveKey(salt []byte) ([]byte, error) {
+	if key, ok := c.derived[string(salt)]; ok {
+		return key, nil
+	}
+	passphrase, err := c.readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		return nil, err
+	}
+	c.derived[string(salt)] = key
+	return key, nil
+}
+
+// The passphrase is read from the environment, or asked for when
+// running in a terminal
+func (c *blobCipher) readPassphrase() ([]byte, error) {
+	if c.passphrase != nil {
+		return c.passphrase, nil
+	}
+	if passphrase, ok := os.LookupEnv(PassphraseEnv); ok {
+		c.passphrase = []byte(passphrase)
+		return c.passphrase, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("%w: set %s", ErrMissingPassphrase, PassphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, "dotsync passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, ErrMissingPassphrase
+	}
+	c.passphrase = passphrase
+	return passphrase, nil
+}
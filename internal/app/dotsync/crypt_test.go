@@ -0,0 +1,145 @@
+package dotsync
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryptWithGeneratedKeyFile(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	config := EncryptionConfig{KeyFile: "/home/user/.dotsync/key"}
+	plaintext := []byte("machine github.com login user password secret\n")
+	_, err := newBlobCipher(config).encrypt(plaintext)
+	assert.ErrorIs(t, err, ErrMissingKey)
+	_, err = newBlobCipher(config).generateKey(config.KeyFile)
+	assert.NoError(t, err)
+
+	blob, err := newBlobCipher(config).encrypt(plaintext)
+	assert.NoError(t, err)
+	assert.True(t, isEncrypted(blob))
+	assert.NotContains(t, string(blob), "secret")
+	info, err := aferoFs.Stat(config.KeyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "-rw-------", info.Mode().String())
+
+	// A new cipher reads the key back from the key file
+	decrypted, err := newBlobCipher(config).decrypt(blob)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+}
+
+func TestDecryptWithoutKeyFile(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	_, err := newBlobCipher(EncryptionConfig{}).generateKey("/a/key")
+	assert.NoError(t, err)
+	blob, err := newBlobCipher(EncryptionConfig{KeyFile: "/a/key"}).encrypt([]byte("secret"))
+	assert.NoError(t, err)
+	_, err = newBlobCipher(EncryptionConfig{KeyFile: "/b/key"}).decrypt(blob)
+	assert.ErrorIs(t, err, ErrMissingKey)
+}
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	cipher := newBlobCipher(EncryptionConfig{KeyFile: "/key"})
+	_, err := cipher.generateKey("/key")
+	assert.NoError(t, err)
+	blob, err := cipher.encrypt([]byte("secret"))
+	assert.NoError(t, err)
+	blob[len(blob)-1] ^= 1
+	_, err = cipher.decrypt(blob)
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestEncryptWithPassphrase(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	t.Setenv(PassphraseEnv, "correct horse battery staple")
+	config := EncryptionConfig{Passphrase: true}
+	blob, err := newBlobCipher(config).encrypt([]byte("secret"))
+	assert.NoError(t, err)
+
+	decrypted, err := newBlobCipher(config).decrypt(blob)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), decrypted)
+
+	t.Setenv(PassphraseEnv, "wrong")
+	_, err = newBlobCipher(config).decrypt(blob)
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestDecodeLeavesPlainBlobs(t *testing.T) {
+	plain := []byte("set number\n")
+	decoded, err := newBlobCipher(EncryptionConfig{}).decode(sha1Hash(plain), plain)
+	assert.NoError(t, err)
+	assert.Equal(t, plain, decoded)
+
+	// Not encrypted, even though it starts with the magic
+	plain = []byte("DSENC\x01\x01 is how encrypted files start\n")
+	decoded, err = newBlobCipher(EncryptionConfig{}).decode(sha1Hash(plain), plain)
+	assert.NoError(t, err)
+	assert.Equal(t, plain, decoded)
+}
+
+func TestCopyAndCleanupEncryptsMarkedFiles(t *testing.T) {
+	_, newFiles := initalise()
+	syncConfig := syncConfigWith(newFiles...)
+	syncConfig.Files[0].Encrypt = true
+	syncConfig.Encryption.KeyFile = "/key"
+	_, err := newBlobCipher(syncConfig.Encryption).generateKey("/key")
+	assert.NoError(t, err)
+	index := InitialiseIndex(syncConfig)
+	index.ParseIndexFile(dotsyncPath)
+	newIndex, err := index.CopyAndCleanup(syncConfig)
+	assert.NoError(t, err)
+
+	cipher := newBlobCipher(syncConfig.Encryption)
+	for hash, info := range newIndex {
+		blob, err := aferoFs.ReadFile(filepath.Join(dotsyncPath, hash))
+		assert.NoError(t, err)
+		assert.Equal(t, info.Path == newFiles[0], isEncrypted(blob))
+		// Encrypted files are named by a keyed hash of the plaintext
+		plaintext, err := readBlob(dotsyncPath, hash, cipher)
+		assert.NoError(t, err)
+		expected, err := cipher.contentHash(info.Encrypt, plaintext)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, hash)
+		assert.Equal(t, info.Path != newFiles[0], hash == sha1Hash(plaintext))
+	}
+}
+
+func TestContentHashIsKeyed(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	assert.NoError(t, aferoFs.WriteFile("/key", []byte(strings.Repeat("ab", keySize)), 0600))
+	assert.NoError(t, aferoFs.WriteFile("/other", []byte(strings.Repeat("cd", keySize)), 0600))
+	content := []byte("password = hunter2\n")
+
+	hash, err := newBlobCipher(EncryptionConfig{KeyFile: "/key"}).contentHash(true, content)
+	assert.NoError(t, err)
+	assert.NotEqual(t, sha1Hash(content), hash)
+	again, err := newBlobCipher(EncryptionConfig{KeyFile: "/key"}).contentHash(true, content)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, again)
+	other, err := newBlobCipher(EncryptionConfig{KeyFile: "/other"}).contentHash(true, content)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, other)
+
+	t.Setenv(PassphraseEnv, "correct horse")
+	passphrase := func(path string) (string, error) {
+		return newSyncCipher(SyncConfig{Path: path, Encryption: EncryptionConfig{Passphrase: true}}).
+			contentHash(true, content)
+	}
+	first, err := passphrase("/sync")
+	assert.NoError(t, err)
+	second, err := passphrase("/sync")
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+	exists, _ := aferoFs.Exists(filepath.Join("/sync", HashSaltFileName))
+	assert.True(t, exists)
+	// Every repository gets its own salt
+	other, err = passphrase("/other-sync")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, other)
+}
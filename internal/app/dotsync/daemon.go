@@ -0,0 +1,354 @@
+package dotsync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+# Daemon
+The daemon pulls incoming changes from the remote and pushes local changes on
+a fixed interval. Only one sync cycle runs at a time, every cycle is executed
+by the main loop of the daemon. Requests from the control socket are handed
+over to the main loop instead of running a sync themselves. Each cycle holds
+the lock on the sync directory, so one-shot syncs started while the daemon
+is running wait for the cycle to finish.
+
+The control socket speaks a line based protocol. The client writes a single
+command followed by a newline and the daemon answers with a single line of
+JSON holding its status, and an error if the command failed.
+
+One-shot pushes and pulls are handed to a running daemon with push-now and
+pull-now, which only push or only pull. They are only handed over when the
+daemon syncs the same profile, the daemon reports its profile in its status.
+*/
+
+const (
+	DefaultDaemonInterval = 5 * time.Minute
+	DaemonSocketName      = "daemon.sock"
+)
+
+// Commands understood by the daemon control socket
+const (
+	CmdStatus  = "status"
+	CmdSyncNow = "sync-now"
+	CmdPullNow = "pull-now"
+	CmdPushNow = "push-now"
+	CmdPause   = "pause"
+	CmdResume  = "resume"
+)
+
+var (
+	ErrDaemonNotRunning = errors.New("daemon is not running")
+	ErrDaemonRunning    = errors.New("daemon is already running")
+	ErrUnknownCommand   = errors.New("unknown daemon command")
+	ErrDaemonFailed     = errors.New("daemon command failed")
+	ErrDaemonProfile    = errors.New("daemon syncs another profile")
+)
+
+type DaemonConfig struct {
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Socket   string        `yaml:"socket,omitempty"`
+}
+
+type DaemonStatus struct {
+	// Active profile of the daemon, see profile.go
+	Profile   string    `json:"profile,omitempty"`
+	Paused    bool      `json:"paused"`
+	Syncing   bool      `json:"syncing"`
+	LastSync  time.Time `json:"lastSync"`
+	LastError string    `json:"lastError,omitempty"`
+	NextSync  time.Time `json:"nextSync"`
+}
+
+type daemonResponse struct {
+	Status DaemonStatus `json:"status"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// A command for the main loop and where to send the result
+type daemonRequest struct {
+	command string
+	reply   chan error
+}
+
+type daemon struct {
+	interval time.Duration
+	cycle    func() error
+	// Run by the main loop for their commands, pull-now and push-now
+	oneShot  map[string]func() error
+	requests chan daemonRequest
+
+	mu     sync.Mutex
+	status DaemonStatus
+}
+
+// The cycle pulls and pushes, the one-shot syncs run for one-shot pushes
+// and pulls delegated to the daemon
+func newDaemon(interval time.Duration, cycle func() error, oneShot map[string]func() error) *daemon {
+	return &daemon{
+		interval: interval,
+		cycle:    cycle,
+		oneShot:  oneShot,
+		requests: make(chan daemonRequest),
+	}
+}
+
+// Runs the daemon until it receives SIGINT or SIGTERM
+func RunDaemon(opts Options) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		log.WithField("path", getConfigPath()).Error("Failed to open config file. Error: ", err)
+		os.Exit(1)
+	}
+	SetupLogging(syncConfig.Path)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// A sync cycle in progress stops where that is safe
+	syncConfig.Context = ctx
+
+	locked := func(sync func(SyncConfig) error) func() error {
+		return func() error {
+			return withLock(syncConfig, opts.LockWait, func() error {
+				return sync(syncConfig)
+			})
+		}
+	}
+	d := newDaemon(syncConfig.Daemon.Interval, locked(daemonCycle), map[string]func() error{
+		CmdPullNow: locked(syncLocal),
+		CmdPushNow: locked(syncOrigin),
+	})
+	d.status.Profile = syncConfig.Profile
+	log.WithField("socket", syncConfig.Daemon.Socket).Info("Starting daemon")
+	if err = d.serve(ctx, syncConfig.Daemon.Socket); err != nil {
+		log.Error("Daemon stopped ", err)
+		os.Exit(1)
+	}
+	log.Info("Daemon stopped")
+}
+
+// Incoming changes are applied before local changes are pushed, otherwise
+// the push would revert changes made on other machines
+func daemonCycle(syncConfig SyncConfig) error {
+	if err := syncLocal(syncConfig); err != nil {
+		return err
+	}
+	return syncOrigin(syncConfig)
+}
+
+// Listens on the control socket and runs the sync loop until the context is
+// cancelled. A sync cycle in progress is allowed to stop before returning
+func (d *daemon) serve(ctx context.Context, socketPath string) error {
+	listener, err := listenSocket(socketPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go d.accept(ctx, listener)
+
+	d.loop(ctx)
+	return nil
+}
+
+func listenSocket(socketPath string) (net.Listener, error) {
+	if _, err := sendDaemonCommand(socketPath, CmdStatus); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDaemonRunning, socketPath)
+	}
+	// Nobody answers, the socket was left behind by a daemon that didn't exit cleanly
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (d *daemon) loop(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	// Sync once on startup to pick up changes made while we weren't running
+	d.runCycle()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if d.snapshot().Paused {
+				d.update(func(s *DaemonStatus) {
+					s.NextSync = time.Now().Add(d.interval)
+				})
+				continue
+			}
+			d.runCycle()
+		case request := <-d.requests:
+			if sync, ok := d.oneShot[request.command]; ok {
+				request.reply <- d.run(sync)
+			} else {
+				request.reply <- d.runCycle()
+			}
+		}
+	}
+}
+
+func (d *daemon) runCycle() error {
+	return d.run(d.cycle)
+}
+
+func (d *daemon) run(cycle func() error) error {
+	d.update(func(s *DaemonStatus) {
+		s.Syncing = true
+	})
+	err := cycle()
+	if err != nil {
+		log.Error("Sync cycle failed ", err)
+	}
+	d.update(func(s *DaemonStatus) {
+		s.Syncing = false
+		s.LastSync = time.Now()
+		s.NextSync = s.LastSync.Add(d.interval)
+		s.LastError = ""
+		if err != nil {
+			s.LastError = err.Error()
+		}
+	})
+	return err
+}
+
+func (d *daemon) update(f func(s *DaemonStatus)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f(&d.status)
+}
+
+func (d *daemon) snapshot() DaemonStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+func (d *daemon) accept(ctx context.Context, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error("Failed to accept connection ", err)
+			}
+			return
+		}
+		go d.handle(ctx, conn)
+	}
+}
+
+func (d *daemon) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		log.Error("Failed to read daemon command ", err)
+		return
+	}
+	command := strings.TrimSpace(line)
+	log.WithField("command", command).Debug("Received daemon command")
+
+	response := daemonResponse{}
+	switch command {
+	case CmdStatus:
+	case CmdSyncNow, CmdPullNow, CmdPushNow:
+		reply := make(chan error, 1)
+		select {
+		case d.requests <- daemonRequest{command: command, reply: reply}:
+			err = <-reply
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	case CmdPause:
+		d.update(func(s *DaemonStatus) {
+			s.Paused = true
+		})
+	case CmdResume:
+		d.update(func(s *DaemonStatus) {
+			s.Paused = false
+		})
+	default:
+		err = fmt.Errorf("%w: %s", ErrUnknownCommand, command)
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	response.Status = d.snapshot()
+	if err = json.NewEncoder(conn).Encode(response); err != nil {
+		log.Error("Failed to answer daemon command ", err)
+	}
+}
+
+// Sends a command to the running daemon and returns its status.
+// Returns ErrDaemonNotRunning if no daemon is listening
+func SendDaemonCommand(command string, opts Options) (DaemonStatus, error) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		return DaemonStatus{}, err
+	}
+	return sendDaemonCommand(syncConfig.Daemon.Socket, command)
+}
+
+// Hands a one-shot push or pull to the running daemon. Returns
+// ErrDaemonNotRunning if no daemon is listening and ErrDaemonProfile if the
+// daemon syncs another profile than the options select
+func DelegateToDaemon(command string, opts Options) (DaemonStatus, error) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		return DaemonStatus{}, err
+	}
+	status, err := sendDaemonCommand(syncConfig.Daemon.Socket, CmdStatus)
+	if err != nil {
+		return status, err
+	}
+	if status.Profile != syncConfig.Profile {
+		return status, fmt.Errorf("%w: %s", ErrDaemonProfile, status.Profile)
+	}
+	return sendDaemonCommand(syncConfig.Daemon.Socket, command)
+}
+
+func sendDaemonCommand(socketPath, command string) (DaemonStatus, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return DaemonStatus{}, fmt.Errorf("%w: %s", ErrDaemonNotRunning, err)
+	}
+	defer conn.Close()
+	if _, err = fmt.Fprintln(conn, command); err != nil {
+		return DaemonStatus{}, err
+	}
+	response := daemonResponse{}
+	if err = json.NewDecoder(conn).Decode(&response); err != nil {
+		return DaemonStatus{}, err
+	}
+	if response.Error != "" {
+		return response.Status, fmt.Errorf("%w: %s", ErrDaemonFailed, response.Error)
+	}
+	return response.Status, nil
+}
@@ -0,0 +1,122 @@
+package dotsync
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func startDaemon(t *testing.T, cycle, pull, push func() error) (string, context.CancelFunc, chan error) {
+	return serveDaemon(t, newDaemon(time.Hour, cycle, map[string]func() error{CmdPullNow: pull, CmdPushNow: push}))
+}
+
+func serveDaemon(t *testing.T, d *daemon) (string, context.CancelFunc, chan error) {
+	socketPath := filepath.Join(t.TempDir(), DaemonSocketName)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- d.serve(ctx, socketPath)
+	}()
+	assert.Eventually(t, func() bool {
+		_, err := sendDaemonCommand(socketPath, CmdStatus)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	return socketPath, cancel, done
+}
+
+func TestDaemonCommands(t *testing.T) {
+	var cycles, pulls, pushes int32
+	socketPath, cancel, done := startDaemon(t, func() error {
+		atomic.AddInt32(&cycles, 1)
+		return nil
+	}, func() error {
+		atomic.AddInt32(&pulls, 1)
+		return nil
+	}, func() error {
+		atomic.AddInt32(&pushes, 1)
+		return nil
+	})
+
+	status, err := sendDaemonCommand(socketPath, CmdPause)
+	assert.NoError(t, err)
+	assert.True(t, status.Paused)
+
+	status, err = sendDaemonCommand(socketPath, CmdSyncNow)
+	assert.NoError(t, err)
+	assert.False(t, status.LastSync.IsZero())
+	// One cycle on startup and one requested
+	assert.Equal(t, int32(2), atomic.LoadInt32(&cycles))
+
+	// Pulling doesn't push
+	_, err = sendDaemonCommand(socketPath, CmdPullNow)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&cycles))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pulls))
+
+	// Pushing doesn't pull
+	_, err = sendDaemonCommand(socketPath, CmdPushNow)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&cycles))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pulls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pushes))
+
+	status, err = sendDaemonCommand(socketPath, CmdResume)
+	assert.NoError(t, err)
+	assert.False(t, status.Paused)
+
+	_, err = sendDaemonCommand(socketPath, "reboot")
+	assert.Error(t, err)
+
+	cancel()
+	assert.NoError(t, <-done)
+	_, err = sendDaemonCommand(socketPath, CmdStatus)
+	assert.ErrorIs(t, err, ErrDaemonNotRunning)
+}
+
+func TestDaemonRefusesSecondInstance(t *testing.T) {
+	none := func() error { return nil }
+	socketPath, cancel, done := startDaemon(t, none, none, none)
+	defer func() {
+		cancel()
+		<-done
+	}()
+	err := newDaemon(time.Hour, none, nil).serve(context.Background(), socketPath)
+	assert.ErrorIs(t, err, ErrDaemonRunning)
+}
+
+func TestDelegateToDaemonOfAnotherProfile(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	var pushes int32
+	d := newDaemon(time.Hour, func() error { return nil }, map[string]func() error{
+		CmdPushNow: func() error {
+			atomic.AddInt32(&pushes, 1)
+			return nil
+		},
+	})
+	d.status.Profile = "work"
+	socketPath, cancel, done := serveDaemon(t, d)
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	config := SyncConfig{
+		GitConfig: GitConfig{URL: "git@example.com:user/dotfiles.git", KeyFile: "/home/user/.ssh/id"},
+		Path:      dotsyncPath,
+		Daemon:    DaemonConfig{Socket: socketPath},
+		Profiles:  map[string]Profile{"work": {}, "home": {}},
+	}
+	assert.NoError(t, aferoFs.WriteFile("/home/user/.ssh/id", []byte("key"), 0600))
+	_, err := DelegateToDaemon(CmdPushNow, Options{Config: &config, Profile: "home"})
+	assert.ErrorIs(t, err, ErrDaemonProfile)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&pushes))
+
+	_, err = DelegateToDaemon(CmdPushNow, Options{Config: &config, Profile: "work"})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pushes))
+}
@@ -0,0 +1,375 @@
+package dotsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+# Diff
+Line based diff using Myers' O(ND) algorithm. Lines keep their newline, so a
+missing newline at the end of a file shows up as a change like it does in git.
+Files with more changes than maxDiffEdits are diffed as replaced as a whole,
+so they conflict as a whole when merged.
+*/
+
+const diffContext = 3
+
+// Most changed lines diffed line by line. The trace of the diff grows with the
+// square of the changes, this keeps it at a few tens of MiB
+const maxDiffEdits = 2000
+
+type editOp int
+
+const (
+	opEqual editOp = iota
+	opDelete
+	opInsert
+)
+
+type lineEdit struct {
+	Op   editOp
+	Line string
+}
+
+// Splits content into lines, every line but possibly the last ends in a newline
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return []string{}
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Returns the shortest edit script turning a into b. Past maxDiffEdits
+// changes the script removes all of a and inserts all of b instead, merges
+// then see a single changed hunk
+func diffLines(a, b []string) []lineEdit {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return []lineEdit{}
+	}
+	// v[offset+k] is the furthest x reached on diagonal k
+	offset := max
+	v := make([]int, 2*max+2)
+	// Only diagonals -d to d are read back for step d
+	trace := [][]int{}
+	for d := 0; d <= max && d <= maxDiffEdits; d++ {
+		trace = append(trace, append([]int{}, v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrackEdits(trace, a, b)
+			}
+		}
+	}
+	return replaceLines(a, b)
+}
+
+// The trace holds v of step d as diagonals -d to d
+func backtrackEdits(trace [][]int, a, b []string) []lineEdit {
+	edits := []lineEdit{}
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = v[d+prevK]
+		}
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			edits = append(edits, lineEdit{Op: opEqual, Line: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				edits = append(edits, lineEdit{Op: opInsert, Line: b[y-1]})
+			} else {
+				edits = append(edits, lineEdit{Op: opDelete, Line: a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+func replaceLines(a, b []string) []lineEdit {
+	edits := make([]lineEdit, 0, len(a)+len(b))
+	for _, line := range a {
+		edits = append(edits, lineEdit{Op: opDelete, Line: line})
+	}
+	for _, line := range b {
+		edits = append(edits, lineEdit{Op: opInsert, Line: line})
+	}
+	return edits
+}
+
+// Formats the difference between a and b as a unified diff
+func unifiedDiff(fromName, toName string, a, b []byte) string {
+	edits := diffLines(splitLines(a), splitLines(b))
+	changes := []int{}
+	for i, e := range edits {
+		if e.Op != opEqual {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+	for i := 0; i < len(changes); {
+		// Changes closer than twice the context end up in the same hunk
+		j := i
+		for j+1 < len(changes) && changes[j+1]-changes[j] <= 2*diffContext {
+			j++
+		}
+		start := changes[i] - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := changes[j] + diffContext + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+		writeHunk(&out, edits, start, end)
+		i = j + 1
+	}
+	return out.String()
+}
+
+func writeHunk(out *strings.Builder, edits []lineEdit, start, end int) {
+	aStart, bStart := 1, 1
+	for _, e := range edits[:start] {
+		if e.Op != opInsert {
+			aStart++
+		}
+		if e.Op != opDelete {
+			bStart++
+		}
+	}
+	aLen, bLen := 0, 0
+	var body strings.Builder
+	for _, e := range edits[start:end] {
+		prefix := " "
+		switch e.Op {
+		case opDelete:
+			prefix = "-"
+			aLen++
+		case opInsert:
+			prefix = "+"
+			bLen++
+		default:
+			aLen++
+			bLen++
+		}
+		body.WriteString(prefix + e.Line)
+		if !strings.HasSuffix(e.Line, "\n") {
+			body.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+	// An empty range starts at the line before it, like in GNU diff
+	if aLen == 0 {
+		aStart--
+	}
+	if bLen == 0 {
+		bStart--
+	}
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+	out.WriteString(body.String())
+}
+
+// Difference between the last synced version of a tracked file and the local file
+type FileDiff struct {
+	Path string
+	// Nil when the file has never been synced
+	Synced []byte
+	// Nil when the file is missing locally. Filtered secrets are left out
+	Local []byte
+}
+
+func (d FileDiff) Unified() string {
+	return unifiedDiff("a/"+d.Path, "b/"+d.Path, d.Synced, d.Local)
+}
+
+// Number of lines added and removed locally
+type DiffStat struct {
+	Path    string `json:"path"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+}
+
+func (d FileDiff) Stat() DiffStat {
+	stat := DiffStat{Path: d.Path}
+	for _, e := range diffLines(splitLines(d.Synced), splitLines(d.Local)) {
+		switch e.Op {
+		case opInsert:
+			stat.Added++
+		case opDelete:
+			stat.Removed++
+		}
+	}
+	return stat
+}
+
+// Widest bar of + and - printed by diff --stat
+const statWidth = 40
+
+// Formats the stats like git diff --stat does
+func formatStats(stats []DiffStat) string {
+	width, added, removed := 0, 0, 0
+	for _, stat := range stats {
+		if len(stat.Path) > width {
+			width = len(stat.Path)
+		}
+	}
+	var out strings.Builder
+	for _, stat := range stats {
+		plus, minus := stat.Added, stat.Removed
+		if total := plus + minus; total > statWidth {
+			plus = plus * statWidth / total
+			minus = statWidth - plus
+		}
+		fmt.Fprintf(&out, " %-*s | %4d %s%s\n", width, stat.Path, stat.Added+stat.Removed,
+			strings.Repeat("+", plus), strings.Repeat("-", minus))
+		added += stat.Added
+		removed += stat.Removed
+	}
+	fmt.Fprintf(&out, " %d files changed, %d insertions(+), %d deletions(-)\n", len(stats), added, removed)
+	return out.String()
+}
+
+// Returns the tracked files that differ from their last synced version. All
+// tracked files are compared when no paths are given
+func diffTracked(syncConfig SyncConfig, paths []string) ([]FileDiff, error) {
+	synced := hashesByPath(readIndexFile(syncConfig.IndexDir()))
+	cipher := newSyncCipher(syncConfig)
+	diffs := []FileDiff{}
+	for _, entry := range syncConfig.Files {
+		if !matchesAny(entry.Path, paths) {
+			continue
+		}
+		d, err := compareTracked(syncConfig, entry, synced[entry.ID()], cipher)
+		if err != nil {
+			return nil, err
+		}
+		if d.changed() {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
+
+// Reads both sides of a tracked file, an empty hash means that the file was
+// never synced. Templates are compared as rendered, filtered secrets are left out
+func compareTracked(syncConfig SyncConfig, entry FileEntry, hash string, cipher *blobCipher) (FileDiff, error) {
+	d := FileDiff{Path: entry.Path}
+	local, err := readFiltered(expandHome(entry.Path), entry.Filters)
+	if err != nil && !os.IsNotExist(err) {
+		return d, err
+	}
+	if err == nil {
+		d.Local = local
+	}
+	if hash == "" {
+		return d, nil
+	}
+	d.Synced, err = readBlob(syncConfig.IndexDir(), hash, cipher)
+	if err == nil && entry.Template {
+		d.Synced, err = renderTemplate(entry.Path, d.Synced, newTemplateData(syncConfig.Variables))
+	}
+	if err != nil {
+		return d, fmt.Errorf("%s: %w", entry.Path, err)
+	}
+	return d, nil
+}
+
+func (d FileDiff) changed() bool {
+	if d.Synced == nil || d.Local == nil {
+		return d.Synced != nil || d.Local != nil
+	}
+	return !bytes.Equal(d.Synced, d.Local)
+}
+
+// Reports if the path is one of paths, an empty list matches everything
+func matchesAny(path string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		if samePath(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prints the difference between the last synced and the local version
+// of the tracked files, or only the number of changed lines with stat
+func Diff(paths []string, stat bool, opts Options) {
+	diffs, err := Diffs(context.Background(), paths, opts)
+	if err != nil {
+		log.Error("Failed to diff files ", err)
+		exitWith(opts, DiffStatResult{Files: []DiffStat{}, Error: resultError(CodeFailed, err)}, err)
+	}
+	if stat {
+		stats := []DiffStat{}
+		for _, d := range diffs {
+			stats = append(stats, d.Stat())
+		}
+		if opts.Output == OutputJSON {
+			printJSON(DiffStatResult{Files: stats}, nil)
+		} else if len(stats) > 0 {
+			fmt.Print(formatStats(stats))
+		}
+		return
+	}
+	for _, d := range diffs {
+		fmt.Print(d.Unified())
+	}
+}
+
+// Returns the tracked files that changed since the last sync, all of them
+// when no paths are given. Errors are an *Error
+func Diffs(ctx context.Context, paths []string, opts Options) ([]FileDiff, error) {
+	defer opts.useEnvironment()()
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		return nil, newError(CodeConfig, err)
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, newError(CodeFailed, err)
+	}
+	diffs, err := diffTracked(syncConfig, paths)
+	return diffs, newError(CodeFailed, err)
+}
@@ -0,0 +1,129 @@
+package dotsync
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Applies the edit script to a and returns the result
+func applyEdits(a []string, edits []lineEdit) ([]string, []string) {
+	from, to := []string{}, []string{}
+	for _, e := range edits {
+		if e.Op != opInsert {
+			from = append(from, e.Line)
+		}
+		if e.Op != opDelete {
+			to = append(to, e.Line)
+		}
+	}
+	return from, to
+}
+
+func TestDiffLinesProducesShortestScript(t *testing.T) {
+	a := splitLines([]byte("a\nb\nc\na\nb\nb\na\n"))
+	b := splitLines([]byte("c\nb\na\nb\na\nc\n"))
+	edits := diffLines(a, b)
+	from, to := applyEdits(a, edits)
+	assert.Equal(t, a, from)
+	assert.Equal(t, b, to)
+	changes := 0
+	for _, e := range edits {
+		if e.Op != opEqual {
+			changes++
+		}
+	}
+	assert.Equal(t, 5, changes)
+}
+
+func TestDiffLinesEmpty(t *testing.T) {
+	assert.Empty(t, diffLines([]string{}, []string{}))
+	edits := diffLines([]string{}, []string{"a\n"})
+	assert.Equal(t, []lineEdit{{Op: opInsert, Line: "a\n"}}, edits)
+}
+
+// Every other line of the base changed
+func numberedLines(lines int, changed bool) []string {
+	out := []string{}
+	for i := 0; i < lines; i++ {
+		if changed && i%2 == 0 {
+			out = append(out, fmt.Sprintf("changed %d\n", i))
+			continue
+		}
+		out = append(out, fmt.Sprintf("%d\n", i))
+	}
+	return out
+}
+
+func TestDiffLinesReplacesPastMaxEdits(t *testing.T) {
+	a, b := numberedLines(2*maxDiffEdits, false), numberedLines(2*maxDiffEdits, true)
+	edits := diffLines(a, b)
+	from, to := applyEdits(a, edits)
+	assert.Equal(t, a, from)
+	assert.Equal(t, b, to)
+	assert.Len(t, edits, len(a)+len(b))
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	b := "1\n2\n3\nfour\n5\n6\n7\n8\n9\n10\n11\n12\n13"
+	expected := `--- a/file
++++ b/file
+@@ -1,7 +1,7 @@
+ 1
+ 2
+ 3
+-4
++four
+ 5
+ 6
+ 7
+@@ -10,3 +10,4 @@
+ 10
+ 11
+ 12
++13
+\ No newline at end of file
+`
+	assert.Equal(t, expected, unifiedDiff("a/file", "b/file", []byte(a), []byte(b)))
+	assert.Equal(t, "", unifiedDiff("a/file", "b/file", []byte(a), []byte(a)))
+}
+
+func TestDiffTrackedDecryptsBlobs(t *testing.T) {
+	_, newFiles := initalise()
+	syncConfig := syncConfigWith(newFiles...)
+	syncConfig.Files[0].Encrypt = true
+	syncConfig.Encryption.KeyFile = "/key"
+	_, err := newBlobCipher(syncConfig.Encryption).generateKey("/key")
+	assert.NoError(t, err)
+	index := InitialiseIndex(syncConfig)
+	index.ParseIndexFile(dotsyncPath)
+	_, err = index.CopyAndCleanup(syncConfig)
+	assert.NoError(t, err)
+
+	diffs, err := diffTracked(syncConfig, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	assert.NoError(t, aferoFs.WriteFile(newFiles[0], []byte("changed\n"), 0644))
+	diffs, err = diffTracked(syncConfig, nil)
+	assert.NoError(t, err)
+	assert.Len(t, diffs, 1)
+	assert.Equal(t, newFiles[0], diffs[0].Path)
+	assert.True(t, strings.HasSuffix(diffs[0].Unified(), "+changed\n"))
+}
+
+func TestDiffStat(t *testing.T) {
+	d := FileDiff{Path: "/home/user/.vimrc", Synced: []byte("a\nb\nc\n"), Local: []byte("a\nB\nc\nd\n")}
+	stat := d.Stat()
+	assert.Equal(t, DiffStat{Path: d.Path, Added: 2, Removed: 1}, stat)
+	assert.Equal(t, DiffStat{Path: "new", Added: 1}, FileDiff{Path: "new", Local: []byte("x\n")}.Stat())
+
+	assert.Equal(t, " /home/user/.vimrc |    3 ++-\n"+
+		" 1 files changed, 2 insertions(+), 1 deletions(-)\n", formatStats([]DiffStat{stat}))
+	// Long bars are scaled down
+	wide := formatStats([]DiffStat{{Path: "a", Added: 300, Removed: 100}})
+	assert.Contains(t, wide, " a |  400 "+strings.Repeat("+", 30)+strings.Repeat("-", 10)+"\n")
+}
@@ -1,10 +1,16 @@
 package dotsync
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/rifflock/lfshook"
 	"github.com/sirupsen/logrus"
@@ -16,19 +22,122 @@ type GitConfig struct {
 	URL     string `yaml:"url"`
 	KeyFile string `yaml:"sshKey"`
 	Branch  string `yaml:"branch,omitempty"`
-	Remote  string `yaml:"remote,omitempty`
+	Remote  string `yaml:"remote,omitempty"`
 }
 
 type SyncConfig struct {
-	GitConfig GitConfig `yaml:"gitconfig"`
-	Path      string    `yaml:"path"`
-	Files     []string  `yaml:"files"`
+	GitConfig  GitConfig        `yaml:"gitconfig"`
+	Path       string           `yaml:"path"`
+	Pull       PullPolicy       `yaml:"pull,omitempty"`
+	Missing    MissingPolicy    `yaml:"missing,omitempty"`
+	Conflict   ConflictStyle    `yaml:"conflict,omitempty"`
+	Encryption EncryptionConfig `yaml:"encryption,omitempty"`
+	Daemon     DaemonConfig     `yaml:"daemon,omitempty"`
+	Hooks      HooksConfig      `yaml:"hooks,omitempty"`
+	Backups    BackupConfig     `yaml:"backups,omitempty"`
+	Tools      ToolsConfig      `yaml:"tools,omitempty"`
+	Timeouts   TimeoutsConfig   `yaml:"timeouts,omitempty"`
+	// Available to templates as .Vars
+	Variables map[string]interface{} `yaml:"variables,omitempty"`
+	// Directory of the index and the blobs inside the repository
+	Subdir string `yaml:"subdir,omitempty"`
+	// The active profile, see profile.go
+	Profile  string             `yaml:"profile,omitempty"`
+	Profiles map[string]Profile `yaml:"profiles,omitempty"`
+	// Only files with one of these tags are synced, set from the command line
+	Tags  []string    `yaml:"-"`
+	Files []FileEntry `yaml:"files"`
+	// Follows the progress of the sync, set from the options
+	Progress Progress `yaml:"-"`
+	// Opens and clones the repository, set from the options
+	Git GitBackend `yaml:"-"`
+	// Cancels the sync, set by the caller
+	Context context.Context `yaml:"-"`
 }
 
+// A tracked file. In the config it is either just the path of the file
+// or a mapping with the path and per file settings
+type FileEntry struct {
+	// Identifies the file across machines where it lives at different paths
+	Name    string        `yaml:"name,omitempty"`
+	Path    string        `yaml:"path"`
+	Pull    PullPolicy    `yaml:"pull,omitempty"`
+	Missing MissingPolicy `yaml:"missing,omitempty"`
+	Encrypt bool          `yaml:"encrypt,omitempty"`
+	// Skip the secret scan for this file, see scan.go
+	AllowSecrets bool `yaml:"allowSecrets,omitempty"`
+	// Secrets replaced with placeholders when pushing, see filter.go
+	Filters []FilterRule `yaml:"filters,omitempty"`
+	// Run after a restore changed the file, see hooks.go
+	OnChange string `yaml:"onchange,omitempty"`
+	// How conflicting changes are written when merging
+	Conflict ConflictStyle `yaml:"conflict,omitempty"`
+	// Run the file as a script after a restore, see scripts.go
+	Run RunPolicy `yaml:"run,omitempty"`
+	// Groups the file belongs to, for syncing only some of the files
+	Tags []string `yaml:"tags,omitempty"`
+	// Sync the template source and render it on restore, see template.go
+	Template bool   `yaml:"template,omitempty"`
+	Source   string `yaml:"source,omitempty"`
+}
+
+// Decides what happens to a local file when an incoming change from
+// the remote touches it
+type PullPolicy string
+
+const (
+	// Only apply incoming changes if the local file hasn't changed since the last sync
+	PullIfUnchanged PullPolicy = "ifunchanged"
+	// Like ifunchanged, but merge files changed on both sides, see merge.go
+	PullMerge PullPolicy = "merge"
+	// Always apply incoming changes, local changes are lost
+	PullOverwrite PullPolicy = "overwrite"
+	// Never apply incoming changes
+	PullSkip PullPolicy = "skip"
+)
+
+// Decides what happens to a tracked file that can't be read when syncing,
+// for example because it lives on a disk that isn't mounted
+type MissingPolicy string
+
+const (
+	// Keep the last synced version in the repository
+	MissingKeep MissingPolicy = "keep"
+	// Remove the file from the repository
+	MissingDelete MissingPolicy = "delete"
+	// Abort the sync
+	MissingFail MissingPolicy = "fail"
+)
+
 const (
 	DotSyncPath = ".dotsync"
 )
 
+// Options for a single invocation of dotsync, set from the command line
+type Options struct {
+	// How long to wait for another process to release the lock on the sync directory
+	LockWait time.Duration
+	// Name of the profile to apply to the config, see profile.go
+	Profile string
+	// Only sync files with one of these tags
+	Tags []string
+	// Follows the progress of syncs, see progress.go
+	Progress Progress
+	// Format of the output, text or json, see output.go
+	Output string
+
+	// Used instead of reading the config file when set
+	Config *SyncConfig
+	// Path of the config file, ~/.dotsync/config when empty
+	ConfigPath string
+	// Opens and clones the repository, see git.go
+	Git GitBackend
+	// Replace the filesystem, log and clock for the call, see env.go
+	Fs     afero.Fs
+	Logger *logrus.Logger
+	Clock  func() time.Time
+}
+
 // Errors
 var (
 	ErrMissingConfig     = errors.New("missing config")
@@ -36,6 +145,10 @@ var (
 	ErrMissingGitURL     = errors.New("missing git url")
 	ErrMissingSSHKeyFile = errors.New("missing sshkey file")
 	ErrInvalidSSHKey     = errors.New("sshkey invalid")
+	ErrInvalidPullPolicy = errors.New("invalid pull policy")
+	ErrInvalidMissing    = errors.New("invalid missing policy")
+	ErrDuplicateFile     = errors.New("file is tracked twice")
+	ErrNoTaggedFiles     = errors.New("no files with the given tags")
 )
 
 var aferoFs = afero.Afero{
@@ -62,6 +175,90 @@ func SetupLogging(logDir string) *logrus.Logger {
 	return log
 }
 
+// Sends the log to w instead of stderr, like while a dashboard is shown
+func SetLogOutput(w io.Writer) {
+	log.SetOutput(w)
+}
+
+// Colors the log or not, instead of only when it goes to a terminal
+func SetLogColors(enabled bool) {
+	log.SetFormatter(&logrus.TextFormatter{ForceColors: enabled, DisableColors: !enabled})
+}
+
+func (f *FileEntry) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&f.Path)
+	}
+	// Avoid recursing back into this function
+	type plainEntry FileEntry
+	return value.Decode((*plainEntry)(f))
+}
+
+func (p PullPolicy) Validate() error {
+	switch p {
+	case "", PullIfUnchanged, PullMerge, PullOverwrite, PullSkip:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidPullPolicy, p)
+}
+
+func (p MissingPolicy) Validate() error {
+	switch p {
+	case "", MissingKeep, MissingDelete, MissingFail:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidMissing, p)
+}
+
+// Returns the paths of all tracked files
+func (s *SyncConfig) FilePaths() []string {
+	paths := make([]string, 0, len(s.Files))
+	for _, f := range s.Files {
+		paths = append(paths, f.Path)
+	}
+	return paths
+}
+
+// Identity of the file in the index, its name or else its path
+func (f FileEntry) ID() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	return f.Path
+}
+
+// Returns the tracked file with the given identity, see FileEntry.ID
+func (s *SyncConfig) Entry(id string) (FileEntry, bool) {
+	for _, f := range s.Files {
+		if f.ID() == id {
+			return f, true
+		}
+	}
+	return FileEntry{}, false
+}
+
+// Returns the pull policy of a file, falling back on the global policy
+func (s *SyncConfig) PullPolicy(f FileEntry) PullPolicy {
+	if f.Pull != "" {
+		return f.Pull
+	}
+	if s.Pull != "" {
+		return s.Pull
+	}
+	return PullMerge
+}
+
+// Returns the missing policy of a file, falling back on the global policy
+func (s *SyncConfig) MissingPolicy(f FileEntry) MissingPolicy {
+	if f.Missing != "" {
+		return f.Missing
+	}
+	if s.Missing != "" {
+		return s.Missing
+	}
+	return MissingKeep
+}
+
 // 1. Files are synced from local to git repository
 // 2. Files are synced from git to local
 
@@ -95,6 +292,55 @@ func (s *SyncConfig) Validate() error {
 	if s.Path == "" {
 		s.Path = DotSyncPath
 	}
+	s.Timeouts.setDefaults()
+
+	if err := s.Pull.Validate(); err != nil {
+		return err
+	}
+	if err := s.Missing.Validate(); err != nil {
+		return err
+	}
+	if err := s.Conflict.Validate(); err != nil {
+		return err
+	}
+	if err := s.Hooks.OnFailure.Validate(); err != nil {
+		return err
+	}
+	if !validSubdir(s.Subdir) {
+		return fmt.Errorf("%w: %s", ErrInvalidSubdir, s.Subdir)
+	}
+	ids := make(map[string]bool)
+	for _, f := range s.Files {
+		if ids[f.ID()] {
+			return fmt.Errorf("%w: %s", ErrDuplicateFile, f.ID())
+		}
+		ids[f.ID()] = true
+		if err := f.Pull.Validate(); err != nil {
+			return fmt.Errorf("%w for %s", err, f.Path)
+		}
+		if err := f.Missing.Validate(); err != nil {
+			return fmt.Errorf("%w for %s", err, f.Path)
+		}
+		if err := f.Conflict.Validate(); err != nil {
+			return fmt.Errorf("%w for %s", err, f.Path)
+		}
+		if err := f.Run.Validate(); err != nil {
+			return fmt.Errorf("%w for %s", err, f.Path)
+		}
+		for _, filter := range f.Filters {
+			if err := filter.Validate(); err != nil {
+				return fmt.Errorf("%w for %s", err, f.Path)
+			}
+		}
+	}
+
+	if s.Daemon.Interval == 0 {
+		s.Daemon.Interval = DefaultDaemonInterval
+	}
+
+	if s.Daemon.Socket == "" {
+		s.Daemon.Socket = filepath.Join(filepath.Dir(getConfigPath()), DaemonSocketName)
+	}
 
 	return nil
 }
@@ -108,92 +354,387 @@ func getConfigPath() string {
 	return filepath.Join(homePath, DotSyncPath, "config")
 }
 
+// The config file of the options, the one in the home directory by default
+func (o Options) configPath() string {
+	if o.ConfigPath != "" {
+		return o.ConfigPath
+	}
+	return getConfigPath()
+}
+
 // Utility function if config does not exists
 // creates dotsync directory in user home and an empty config
 func createConfig(configPath string) {
 }
 
-func OpenSyncConfig() (SyncConfig, error) {
+// Reads the config and applies the active profile
+func OpenSyncConfig(opts Options) (SyncConfig, error) {
+	config, err := readSyncConfig(opts)
+	if err != nil {
+		return config, err
+	}
+	hostname, _ := os.Hostname()
+	profile, err := selectProfile(config.Profiles, opts.Profile, os.Getenv(ProfileEnv), config.Profile, hostname)
+	if err != nil {
+		return config, err
+	}
+	if profile != "" {
+		if err = config.applyProfile(profile); err != nil {
+			return config, err
+		}
+	}
+	if err = config.Validate(); err != nil {
+		return config, err
+	}
+	config.Progress = opts.Progress
+	config.Git = opts.Git
+	if len(opts.Tags) > 0 {
+		if err = config.selectTags(opts.Tags); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+// Cancelled on SIGINT or SIGTERM. Syncs then stop at the next point where the
+// sync directory is left consistent, a second signal kills the process
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+func (s SyncConfig) context() context.Context {
+	if s.Context == nil {
+		return context.Background()
+	}
+	return s.Context
+}
+
+// Opens the config like OpenSyncConfig, in the environment of the options.
+// Errors are an *Error
+func ReadConfig(opts Options) (SyncConfig, error) {
+	defer opts.useEnvironment()()
+	config, err := OpenSyncConfig(opts)
+	return config, newError(CodeConfig, err)
+}
+
+func readSyncConfig(opts Options) (SyncConfig, error) {
 	config := SyncConfig{}
-	configPath := getConfigPath()
+	if opts.Config != nil {
+		config = *opts.Config
+		// Profiles change the variables in place
+		config.Variables = make(map[string]interface{}, len(opts.Config.Variables))
+		for k, v := range opts.Config.Variables {
+			config.Variables[k] = v
+		}
+		return config, nil
+	}
+	configPath := opts.configPath()
 	if configPath == "" {
 		return config, ErrMissingConfig
 	}
 	bytes, err := aferoFs.ReadFile(configPath)
-	if err != nil  {
+	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			createConfig(configPath)	
+			createConfig(configPath)
 		} else {
 			return config, err
 		}
 	}
 	err = yaml.Unmarshal(bytes, &config)
-	if err != nil {
-		return config, err
-	}
-	if err = config.Validate(); err != nil {
-		return config, err
-	}
-	return config, nil
+	return config, err
 }
 
 // Syncs the specified local files to a git repository
-func SyncOrigin() {
-	syncConfig, err := OpenSyncConfig()
+func SyncOrigin(opts Options) {
+	ctx, stop := interruptContext()
+	defer stop()
+	result, err := Push(ctx, opts)
 	if err != nil {
-		log.WithField("path", getConfigPath()).Panic("Failed to open config file. Error: ", err)
-		os.Exit(1)
+		log.Error("Failed to sync origin ", err)
+	}
+	if opts.Output == OutputJSON {
+		printJSON(result, err)
 	}
-	err = syncConfig.Validate()
 	if err != nil {
-		log.Error("Failed to validate config", err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
-	// This feels weird and clunky, think of something better
-	SetupLogging(syncConfig.Path)
-	index := InitialiseIndex(syncConfig.Files)
-	index.ParseIndexFile(syncConfig.Path)
-	newIndex, err := index.CopyAndCleanup(syncConfig.Path)
-	// TODO: Git operations
+}
+
+// Syncs the tracked files to the git repository and reports what happened to
+// them. Errors are an *Error
+func Push(ctx context.Context, opts Options) (PushResult, error) {
+	defer opts.useEnvironment()()
+	results := opts.collectResults()
+	syncConfig, err := OpenSyncConfig(opts)
 	if err != nil {
-		log.Error("File indexing ran into an issue", err)
+		err = newError(CodeConfig, err)
+		opts.done(err)
+		return results.push(syncConfig, err), err
+	}
+	opts.setupLogging(syncConfig)
+	syncConfig.Context = ctx
+	err = ctx.Err()
+	if err == nil {
+		err = withLock(syncConfig, opts.LockWait, func() error {
+			return syncOrigin(syncConfig)
+		})
 	}
+	err = newError(CodeFailed, err)
+	opts.done(err)
+	return results.push(syncConfig, err), err
+}
 
+// Runs the index, copy, commit and push pipeline once. The repository is
+// updated before anything is copied into it so that a reset of the worktree
+// can't throw away the files we are about to commit
+func syncOrigin(syncConfig SyncConfig) error {
+	if err := runHook(syncConfig.Hooks, HookPrePush); err != nil {
+		return err
+	}
 	repository, err := NewRepository(syncConfig)
 	if err != nil {
-		log.Error("Failed to open repository", err)
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	if err = RecoverSync(syncConfig.IndexDir()); err != nil {
+		return fmt.Errorf("failed to recover interrupted sync: %w", err)
 	}
 
-	err = repository.tryAndUpdate()
+	before := readIndexFile(syncConfig.IndexDir())
+	err = repository.tryAndUpdate(syncConfig.context())
 	if err != nil {
-		log.Info("Failed to update repository")
-		os.Exit(1)
+		return fmt.Errorf("failed to update repository: %w", err)
 	}
-	// cleanup old files
-	for k := range index.Current {
-		fileToSync := filepath.Join(syncConfig.Path, k)
-		repository.removeFile(fileToSync)
+	state, err := readState(statePath())
+	if err != nil {
+		return err
 	}
-	// Add new files
-	for k := range newIndex {
-		fileToSync := filepath.Join(syncConfig.Path, k)
-		repository.addFile(fileToSync)
-	}
-	if (len(index.Current) > 0 || len(newIndex) > 0) {
-		commitMessage := fmt.Sprintf("synced %d, removed %d files", len(newIndex), len(index.Current))
-		repository.commit(commitMessage)
-		repository.push()
-		log.Info(commitMessage)
-	} else {
+	synced, err := pushFiles(repository, syncConfig, state, nil)
+	if err != nil {
+		return err
+	}
+	state.keepUnselected(syncConfig, before)
+	if err = recordSynced(syncConfig, newSyncCipher(syncConfig), state, synced, nil); err != nil {
+		return err
+	}
+	return runHook(syncConfig.Hooks, HookPostPush)
+}
+
+// Indexes the tracked files, then commits and pushes the changes. The held
+// files keep their synced version, as do the files with a conflict in the
+// state. Returns the new index
+func pushFiles(repository *repository, syncConfig SyncConfig, state *localState, held []string) (map[string]FileInfo, error) {
+	progress := syncConfig.progress()
+	// Encrypted files can't be indexed without their hash key
+	cipher := newSyncCipher(syncConfig)
+	if syncConfig.encrypts() {
+		if _, err := cipher.loadHashKey(); err != nil {
+			return nil, err
+		}
+	}
+	progress.Phase(PhaseIndexing, len(syncConfig.Files))
+	warnEditedRenders(syncConfig)
+	index := indexFiles(syncConfig, cipher)
+	if err := syncConfig.context().Err(); err != nil {
+		return nil, err
+	}
+	index.ParseIndexFile(syncConfig.IndexDir())
+	synced := make(map[string]FileInfo, len(index.Current))
+	for k, v := range index.Current {
+		synced[k] = v
+	}
+	index.carryOver(syncConfig)
+	for _, id := range held {
+		index.keepSynced(id)
+	}
+	err := index.holdConflicts(state)
+	if err != nil {
+		return nil, err
+	}
+	if err = index.ResolveMissing(syncConfig); err != nil {
+		return nil, err
+	}
+	added := index.added()
+	newIndex, err := index.CopyAndCleanup(syncConfig)
+	if err != nil {
+		return nil, fmt.Errorf("file indexing ran into an issue: %w", err)
+	}
+	if err = scanSync(repository, syncConfig, added, index.Current); err != nil {
+		return nil, err
+	}
+
+	if sameIndex(synced, newIndex) {
 		// To spammy?
 		log.Info("No changes")
+		return newIndex, nil
+	}
+
+	// Worktree paths are relative to the root of the repository
+	// cleanup old files
+	progress.Phase(PhaseStaging, len(index.Current)+len(newIndex))
+	for k, v := range index.Current {
+		if err = repository.removeFile(syncConfig.repoPath(k)); err != nil {
+			return nil, err
+		}
+		progress.File(v.Path, ResultRemoved)
+	}
+	// Add new files
+	for k, v := range newIndex {
+		if err = repository.addFile(syncConfig.repoPath(k)); err != nil {
+			return nil, err
+		}
+		progress.File(v.Path, ResultAdded)
+	}
+	if err = repository.addFile(syncConfig.repoPath(IndexFileName)); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{HashKeyFileName, HashSaltFileName} {
+		if exists, _ := aferoFs.Exists(filepath.Join(syncConfig.Path, name)); exists {
+			if err = repository.addFile(name); err != nil {
+				return nil, err
+			}
+		}
 	}
+	commitMessage := fmt.Sprintf("synced %d, removed %d files", len(newIndex), len(index.Current))
+	progress.Phase(PhaseCommitting, 0)
+	if err = repository.commit(commitMessage); err != nil {
+		return nil, err
+	}
+	reportCommit(progress, repository.headCommit().String())
+	progress.Phase(PhasePushing, 0)
+	if err = repository.push(syncConfig.context()); err != nil {
+		return nil, err
+	}
+	reportPushed(progress)
+	log.Info(commitMessage)
+	return readIndexFile(syncConfig.IndexDir()), nil
+}
+
+// Reports if two indexes have the same lines, the same files with the same
+// hashes and modes
+func sameIndex(a, b map[string]FileInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w.Path != v.Path || w.Perm != v.Perm {
+			return false
+		}
+	}
+	return true
+}
+
+// Stops tracking the files and removes them from the repository. A tracked
+// file that is missing locally is only removed from the repository this way
+func RemoveFiles(paths []string, opts Options) {
+	removed, err := removeConfigFiles(opts.configPath(), paths)
+	if err != nil {
+		log.WithField("path", opts.configPath()).Error("Failed to update config file ", err)
+		os.Exit(1)
+	}
+	for _, path := range paths {
+		found := false
+		for _, r := range removed {
+			found = found || samePath(path, r)
+		}
+		if !found {
+			log.WithField("file", path).Warning("File is not tracked")
+		}
+	}
+	if len(removed) == 0 {
+		os.Exit(1)
+	}
+	SyncOrigin(opts)
+}
+
+// Syncs the origin to the local files. Incoming changes are written to the
+// tracked files in the config, following the pull policy of each file
+func SyncLocal(opts Options) {
+	ctx, stop := interruptContext()
+	defer stop()
+	result, err := Pull(ctx, opts)
+	if err != nil {
+		log.Error("Failed to sync local files ", err)
+	}
+	if opts.Output == OutputJSON {
+		printJSON(result, err)
+	}
+	if err != nil {
+		os.Exit(exitCode(err))
+	}
+}
+
+// Syncs the git repository to the tracked files and reports what happened to
+// them. Errors are an *Error
+func Pull(ctx context.Context, opts Options) (PullResult, error) {
+	defer opts.useEnvironment()()
+	results := opts.collectResults()
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		err = newError(CodeConfig, err)
+		opts.done(err)
+		return results.pull(syncConfig, err), err
+	}
+	opts.setupLogging(syncConfig)
+	syncConfig.Context = ctx
+	err = ctx.Err()
+	if err == nil {
+		err = withLock(syncConfig, opts.LockWait, func() error {
+			return syncLocal(syncConfig)
+		})
+	}
+	err = newError(CodeFailed, err)
+	opts.done(err)
+	return results.pull(syncConfig, err), err
 }
 
-// TODO later.
-// Syncs the origin to local files. The files are kept in the default path
-// specified /tmp/dotsync. Files can be either be specified to be kept in a certain
-// folder such as /home/<username> or each file can be moved out to a specified
-// path. If path is omitted from file, the files are kept in folder specified by user
-// or if omitted in the default path /tmp/dotsync
-func SyncLocal() {}
+func syncLocal(syncConfig SyncConfig) error {
+	if err := runHook(syncConfig.Hooks, HookPreRestore); err != nil {
+		return err
+	}
+	repository, err := NewRepository(syncConfig)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+	if err = RecoverSync(syncConfig.IndexDir()); err != nil {
+		return fmt.Errorf("failed to recover interrupted sync: %w", err)
+	}
+	// The index from the last sync tells us if a local file has been changed
+	before := readIndexFile(syncConfig.IndexDir())
+	// Blobs of the base the pull removes are read from this commit
+	history := commitBlobs{repository: repository, commit: repository.headCommit(), syncConfig: syncConfig}
+	err = repository.tryAndUpdate(syncConfig.context())
+	if err != nil {
+		return fmt.Errorf("failed to update repository: %w", err)
+	}
+	remote := readIndexFile(syncConfig.IndexDir())
+	restorer, err := newRestorer(syncConfig, history)
+	if err != nil {
+		return err
+	}
+	// Files last synced before a pull of other tags have their base in the state
+	restored, err := restorer.restore(restorer.state.baseIndex(before), remote)
+	if err != nil {
+		return err
+	}
+	restorer.state.keepUnselected(syncConfig, before)
+	if err = recordSynced(syncConfig, restorer.cipher, restorer.state, remote, nil); err != nil {
+		return err
+	}
+	if len(restored) > 0 {
+		log.WithField("files", restored).Info(fmt.Sprintf("restored %d files", len(restored)))
+	}
+	ran, err := runScripts(syncConfig, remote, statePath())
+	if err != nil {
+		return err
+	}
+	if len(ran) > 0 {
+		log.WithField("scripts", ran).Info(fmt.Sprintf("ran %d scripts", len(ran)))
+	}
+	return runHook(syncConfig.Hooks, HookPostRestore, "DOTSYNC_FILES="+strings.Join(restored, "\n"))
+}
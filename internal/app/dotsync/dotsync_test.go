@@ -1,7 +1,18 @@
 package dotsync
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 	//"github.com/spf13/afero"
 )
 
@@ -12,4 +23,280 @@ func createTempConfig() {
 
 func TestOpenSyncConfig(t *testing.T) {
 
-}
\ No newline at end of file
+}
+func TestFileEntriesAcceptPathsAndMappings(t *testing.T) {
+	config := SyncConfig{}
+	err := yaml.Unmarshal([]byte(`
+pull: overwrite
+files:
+  - ~/.vimrc
+  - path: ~/.tmux.conf
+    pull: skip
+`), &config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"~/.vimrc", "~/.tmux.conf"}, config.FilePaths())
+	entry, ok := config.Entry("~/.tmux.conf")
+	assert.True(t, ok)
+	assert.Equal(t, PullSkip, config.PullPolicy(entry))
+	entry, _ = config.Entry("~/.vimrc")
+	assert.Equal(t, PullOverwrite, config.PullPolicy(entry))
+}
+
+func TestInvalidPullPolicy(t *testing.T) {
+	assert.ErrorIs(t, PullPolicy("sometimes").Validate(), ErrInvalidPullPolicy)
+}
+
+// A bare repository with a commit on main, like a new repository on a forge
+func newRemote(t *testing.T) string {
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	bare, err := git.PlainInit(remote, true)
+	assert.NoError(t, err)
+	branch := plumbing.NewBranchReferenceName("main")
+	assert.NoError(t, bare.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch)))
+
+	seedDir := t.TempDir()
+	seed, err := git.PlainInit(seedDir, false)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(seedDir, "README"), []byte("dotfiles\n"), 0644))
+	worktree, err := seed.Worktree()
+	assert.NoError(t, err)
+	_, err = worktree.Add("README")
+	assert.NoError(t, err)
+	_, err = worktree.Commit("initial", &git.CommitOptions{
+		Author: &object.Signature{Name: "dotsync", When: time.Now()},
+	})
+	assert.NoError(t, err)
+	_, err = seed.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remote}})
+	assert.NoError(t, err)
+	assert.NoError(t, seed.Push(&git.PushOptions{
+		RefSpecs: []config.RefSpec{config.RefSpec("refs/heads/master:" + branch)},
+	}))
+	return remote
+}
+
+// A machine syncing its home with the remote. Syncs run with the home and
+// working directory of the machine
+type machine struct {
+	t          *testing.T
+	home       string
+	syncConfig SyncConfig
+}
+
+func newMachine(t *testing.T, remote string, files ...string) *machine {
+	aferoFs.Fs = afero.NewOsFs()
+	home := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(home, ".dotsync"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(home, "work"), 0755))
+	privateKey, _ := generateSSHKeys()
+	keyFile := filepath.Join(home, "id_rsa")
+	assert.NoError(t, os.WriteFile(keyFile, privateKey, 0600))
+	m := &machine{t: t, home: home}
+	m.syncConfig = SyncConfig{
+		GitConfig: GitConfig{URL: remote, KeyFile: keyFile},
+		Path:      filepath.Join(home, "work", DotSyncPath),
+	}
+	for _, file := range files {
+		m.syncConfig.Files = append(m.syncConfig.Files, FileEntry{Path: filepath.Join("~", file)})
+	}
+	assert.NoError(t, m.syncConfig.Validate())
+	return m
+}
+
+func (m *machine) path(file string) string {
+	return filepath.Join(m.home, file)
+}
+
+func (m *machine) write(file, content string) {
+	assert.NoError(m.t, os.WriteFile(m.path(file), []byte(content), 0644))
+}
+
+func (m *machine) read(file string) string {
+	content, err := os.ReadFile(m.path(file))
+	assert.NoError(m.t, err)
+	return string(content)
+}
+
+func (m *machine) run(sync func(SyncConfig) error) error {
+	m.t.Setenv("HOME", m.home)
+	wd, err := os.Getwd()
+	assert.NoError(m.t, err)
+	assert.NoError(m.t, os.Chdir(filepath.Join(m.home, "work")))
+	defer os.Chdir(wd)
+	return sync(m.syncConfig)
+}
+
+// The commits on main of the remote, newest first
+func remoteHistory(t *testing.T, remote string) []LogEntry {
+	repo, err := git.PlainOpen(remote)
+	assert.NoError(t, err)
+	entries, err := (&repository{Repo: repo}).history(0)
+	assert.NoError(t, err)
+	return entries
+}
+
+func TestPushWithoutChangesDoesNotCommit(t *testing.T) {
+	remote := newRemote(t)
+	m := newMachine(t, remote, ".vimrc")
+	m.write(".vimrc", "set nu\n")
+
+	assert.NoError(t, m.run(syncOrigin))
+	assert.Len(t, remoteHistory(t, remote), 2)
+	assert.NoError(t, m.run(syncOrigin))
+	assert.Len(t, remoteHistory(t, remote), 2)
+
+	m.write(".vimrc", "set nonu\n")
+	assert.NoError(t, m.run(syncOrigin))
+	assert.Len(t, remoteHistory(t, remote), 3)
+}
+
+func TestPushWithoutKeyFileFails(t *testing.T) {
+	remote := newRemote(t)
+	m := newMachine(t, remote, ".netrc")
+	m.syncConfig.Files[0].Encrypt = true
+	m.syncConfig.Encryption.KeyFile = m.path("key")
+	m.write(".netrc", "password secret\n")
+
+	assert.ErrorIs(t, m.run(syncOrigin), ErrMissingKey)
+	assert.Len(t, remoteHistory(t, remote), 1)
+	exists, _ := aferoFs.Exists(m.path("key"))
+	assert.False(t, exists)
+}
+
+func TestFullPullAfterTaggedPull(t *testing.T) {
+	remote := newRemote(t)
+	first := newMachine(t, remote, ".vimrc", ".bashrc")
+	first.syncConfig.Files[0].Tags = []string{"vim"}
+	first.write(".vimrc", "set nu\n")
+	first.write(".bashrc", "alias ll='ls -l'\n")
+	assert.NoError(t, first.run(syncOrigin))
+
+	second := newMachine(t, remote, ".vimrc", ".bashrc")
+	second.syncConfig.Files[0].Tags = []string{"vim"}
+	assert.NoError(t, second.run(syncLocal))
+	assert.Equal(t, "alias ll='ls -l'\n", second.read(".bashrc"))
+
+	first.write(".vimrc", "set nonu\n")
+	first.write(".bashrc", "alias la='ls -a'\n")
+	assert.NoError(t, first.run(syncOrigin))
+
+	// Only the tagged file is restored
+	tagged := second.syncConfig
+	assert.NoError(t, tagged.selectTags([]string{"vim"}))
+	assert.NoError(t, second.run(func(SyncConfig) error { return syncLocal(tagged) }))
+	assert.Equal(t, "set nonu\n", second.read(".vimrc"))
+	assert.Equal(t, "alias ll='ls -l'\n", second.read(".bashrc"))
+
+	// The untagged file is still behind, not changed locally
+	assert.NoError(t, second.run(syncLocal))
+	assert.Equal(t, "alias la='ls -a'\n", second.read(".bashrc"))
+	commits := len(remoteHistory(t, remote))
+	assert.NoError(t, second.run(syncOrigin))
+	assert.Len(t, remoteHistory(t, remote), commits)
+}
+
+func TestFullSyncAfterTaggedSync(t *testing.T) {
+	remote := newRemote(t)
+	first := newMachine(t, remote, ".vimrc", ".bashrc")
+	first.write(".vimrc", "set nu\n")
+	first.write(".bashrc", "alias ll='ls -l'\n")
+	assert.NoError(t, first.run(syncOrigin))
+	second := newMachine(t, remote, ".vimrc", ".bashrc")
+	second.syncConfig.Files[0].Tags = []string{"vim"}
+	assert.NoError(t, second.run(syncLocal))
+
+	first.write(".bashrc", "alias la='ls -a'\n")
+	assert.NoError(t, first.run(syncOrigin))
+	tagged := second.syncConfig
+	assert.NoError(t, tagged.selectTags([]string{"vim"}))
+	assert.NoError(t, second.run(func(SyncConfig) error {
+		_, err := syncBoth(tagged)
+		return err
+	}))
+	assert.Equal(t, "alias ll='ls -l'\n", second.read(".bashrc"))
+
+	var changes []FileSync
+	assert.NoError(t, second.run(func(syncConfig SyncConfig) (err error) {
+		changes, err = syncBoth(syncConfig)
+		return err
+	}))
+	assert.Contains(t, changes, FileSync{Path: "~/.bashrc", Change: ChangeRemote})
+	assert.Equal(t, "alias la='ls -a'\n", second.read(".bashrc"))
+}
+
+func TestResolvedConflictStaysResolvedAfterSync(t *testing.T) {
+	remote := newRemote(t)
+	first := newMachine(t, remote, ".vimrc")
+	first.write(".vimrc", "one\ntwo\nthree\n")
+	assert.NoError(t, first.run(syncOrigin))
+	second := newMachine(t, remote, ".vimrc")
+	assert.NoError(t, second.run(syncLocal))
+
+	first.write(".vimrc", "one\nTWO\nthree\n")
+	assert.NoError(t, first.run(syncOrigin))
+	second.write(".vimrc", "one\nzwei\nthree\n")
+	sync := func(syncConfig SyncConfig) error {
+		_, err := syncBoth(syncConfig)
+		return err
+	}
+	assert.NoError(t, second.run(sync))
+	assert.True(t, hasConflictMarkers([]byte(second.read(".vimrc"))))
+
+	second.write(".vimrc", "one\nTWO zwei\nthree\n")
+	assert.NoError(t, second.run(sync))
+	assert.NoError(t, second.run(func(SyncConfig) error {
+		state, err := readState(statePath())
+		assert.Empty(t, state.Conflicts)
+		return err
+	}))
+	assert.NoError(t, first.run(syncLocal))
+	assert.Equal(t, "one\nTWO zwei\nthree\n", first.read(".vimrc"))
+}
+
+func TestSkippedFileDeletedOnRemoteIsKept(t *testing.T) {
+	remote := newRemote(t)
+	first := newMachine(t, remote, ".vimrc")
+	first.syncConfig.Missing = MissingDelete
+	first.write(".vimrc", "set nu\n")
+	assert.NoError(t, first.run(syncOrigin))
+	second := newMachine(t, remote, ".vimrc")
+	second.syncConfig.Pull = PullSkip
+	second.write(".vimrc", "set nu\n")
+	assert.NoError(t, second.run(syncLocal))
+
+	assert.NoError(t, os.Remove(first.path(".vimrc")))
+	assert.NoError(t, first.run(syncOrigin))
+	var changes []FileSync
+	assert.NoError(t, second.run(func(syncConfig SyncConfig) (err error) {
+		changes, err = syncBoth(syncConfig)
+		return err
+	}))
+	assert.Contains(t, changes, FileSync{Path: "~/.vimrc", Change: ChangeRemoteDeleted})
+	assert.Equal(t, "set nu\n", second.read(".vimrc"))
+}
+
+func TestUndoneFileIsBehindTheRemote(t *testing.T) {
+	remote := newRemote(t)
+	first := newMachine(t, remote, ".vimrc")
+	first.write(".vimrc", "set nu\n")
+	assert.NoError(t, first.run(syncOrigin))
+	second := newMachine(t, remote, ".vimrc")
+	assert.NoError(t, second.run(syncLocal))
+
+	first.write(".vimrc", "set nonu\n")
+	assert.NoError(t, first.run(syncOrigin))
+	assert.NoError(t, second.run(syncLocal))
+	assert.NoError(t, second.run(func(syncConfig SyncConfig) error {
+		_, err := undoBackup(syncConfig, false)
+		return err
+	}))
+	assert.Equal(t, "set nu\n", second.read(".vimrc"))
+
+	// The reverted file is not a local change that would undo the remote one
+	var changes []FileSync
+	assert.NoError(t, second.run(func(syncConfig SyncConfig) (err error) {
+		changes, err = syncBoth(syncConfig)
+		return err
+	}))
+	assert.Equal(t, []FileSync{{Path: "~/.vimrc", Change: ChangeRemote}}, changes)
+	assert.Equal(t, "set nonu\n", second.read(".vimrc"))
+}
@@ -0,0 +1,49 @@
+package dotsync
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+# Environment
+The filesystem, the log and the clock are package variables, set up for the
+command line. Options can replace them for a single call, which is how
+pkg/dotsync embeds dotsync. As they are shared by the whole process, calls
+that replace them run one at a time.
+
+Go-git, the lock, hooks, scripts and the daemon socket don't go through the
+filesystem, they always use the disk.
+*/
+
+var (
+	now   = time.Now
+	envMu sync.Mutex
+)
+
+// Switches to the filesystem, log and clock of the options. Calling the
+// returned function switches back
+func (o Options) useEnvironment() func() {
+	envMu.Lock()
+	fs, logger, clock := aferoFs.Fs, log, now
+	if o.Fs != nil {
+		aferoFs.Fs = o.Fs
+	}
+	if o.Logger != nil {
+		log = o.Logger
+	}
+	if o.Clock != nil {
+		now = o.Clock
+	}
+	return func() {
+		aferoFs.Fs, log, now = fs, logger, clock
+		envMu.Unlock()
+	}
+}
+
+// Log files are only written for the log of dotsync itself
+func (o Options) setupLogging(syncConfig SyncConfig) {
+	if o.Logger == nil {
+		SetupLogging(syncConfig.Path)
+	}
+}
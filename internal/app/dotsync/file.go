@@ -2,12 +2,16 @@ package dotsync
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
@@ -35,12 +39,11 @@ else
 // Each file index contains
 // Path of original file
 // Original filemode
-// Any errors while trying to index it
-// TODO: Remove this failed construct and replace it with a channel
-// that signal the state of all failed files
+// If the file is encrypted in the sync directory, only known for new files
 type FileInfo struct {
-	Path string
-	Perm os.FileMode
+	Path    string
+	Perm    os.FileMode
+	Encrypt bool
 }
 
 // Contains needed fileinfo for new files inexes as well
@@ -49,134 +52,237 @@ type FileInfo struct {
 type Indexes struct {
 	Current map[string]FileInfo
 	New     map[string]FileInfo
+	// Tracked files that couldn't be indexed
+	Missing []string
+	// Content of the new files as it was hashed, keyed by hash
+	content map[string][]byte
+	// Secrets filtered out of the new files, see filter.go
+	secrets secretStore
+	// Hashes and encrypts the files marked for encryption
+	cipher *blobCipher
 }
 
 const (
 	IndexFileName = ".idx"
 )
 
+var (
+	ErrMalformedIndex = errors.New("malformed index line")
+	ErrMissingFile    = errors.New("tracked file is missing")
+)
+
 // Returns an Indexes struct with the current index of tracked files
 // as well as the previous tracked parsed from the index file
-func InitialiseIndex(files []string) (index *Indexes) {
+func InitialiseIndex(syncConfig SyncConfig) *Indexes {
+	return indexFiles(syncConfig, newSyncCipher(syncConfig))
+}
+
+// Like InitialiseIndex, hashing encrypted files with the cipher
+func indexFiles(syncConfig SyncConfig, cipher *blobCipher) (index *Indexes) {
 	index = &Indexes{
 		Current: make(map[string]FileInfo),
 		New:     make(map[string]FileInfo),
+		content: make(map[string][]byte),
+		secrets: make(secretStore),
+		cipher:  cipher,
 	}
-	for _, filePath := range files {
-		if filePath == "" {
+	progress := syncConfig.progress()
+	for _, entry := range syncConfig.Files {
+		// Stop hashing, the caller checks the context
+		if syncConfig.context().Err() != nil {
+			return
+		}
+		// Files are indexed by their identity, see profile.go
+		filePath := entry.ID()
+		if entry.Path == "" {
 			continue
 		}
-		file, err := aferoFs.Open(filePath)
+		sourcePath := entry.sourcePath()
+		fileInfo, err := aferoFs.Stat(sourcePath)
 		if err != nil {
 			log.WithField("file", filePath).
-				Error("Failed to open file", err)
+				Error("Failed to stat", err)
+			index.Missing = append(index.Missing, filePath)
+			progress.File(filePath, ResultMissing)
 			continue
 		}
-		defer file.Close()
-		fileInfo, err := file.Stat()
+		// Read the content once, what is hashed is also what gets copied
+		content, err := aferoFs.ReadFile(sourcePath)
 		if err != nil {
 			log.WithField("file", filePath).
-				Error("Failed to stat", err)
+				Error("Failed to read file", err)
+			index.Missing = append(index.Missing, filePath)
+			progress.File(filePath, ResultMissing)
 			continue
 		}
-		hash, err := sha1FileHash(file)
+		if len(entry.Filters) > 0 {
+			filtered, secrets, err := cleanContent(content, entry.Filters)
+			if err != nil {
+				log.WithField("file", filePath).
+					Error("Failed to filter file", err)
+				index.Missing = append(index.Missing, filePath)
+				progress.File(filePath, ResultMissing)
+				continue
+			}
+			content = filtered
+			index.secrets[filePath] = secrets
+		}
+		hash, err := cipher.contentHash(entry.Encrypt, content)
 		if err != nil {
 			log.WithField("file", filePath).
-				Error("Failed to create hash", err)
+				Error("Failed to hash file", err)
+			index.Missing = append(index.Missing, filePath)
+			progress.File(filePath, ResultMissing)
 			continue
 		}
 
 		index.New[hash] = FileInfo{
-			Path: filePath,
-			Perm: fileInfo.Mode(),
+			Path:    filePath,
+			Perm:    fileInfo.Mode(),
+			Encrypt: entry.Encrypt,
 		}
-
+		index.content[hash] = content
+		progress.File(filePath, ResultIndexed)
 	}
 	return
 }
 
+// Decides what happens to tracked files that couldn't be indexed, following
+// their missing policy. Kept files are carried over from the current index,
+// so they are neither copied nor cleaned up. Must be called after the index
+// file has been parsed
+func (index *Indexes) ResolveMissing(syncConfig SyncConfig) error {
+	currentHashes := hashesByPath(index.Current)
+	for _, filePath := range index.Missing {
+		entry, _ := syncConfig.Entry(filePath)
+		switch syncConfig.MissingPolicy(entry) {
+		case MissingFail:
+			return fmt.Errorf("%w: %s", ErrMissingFile, filePath)
+		case MissingDelete:
+			log.WithField("file", filePath).Info("Removing missing file")
+		default:
+			hash, ok := currentHashes[filePath]
+			if !ok {
+				log.WithField("file", filePath).Warning("Missing file has never been synced")
+				continue
+			}
+			log.WithField("file", filePath).Info("Keeping last synced version of missing file")
+			index.New[hash] = index.Current[hash]
+		}
+	}
+	return nil
+}
+
 func (index *Indexes) ParseIndexFile(configPath string) {
 	file, err := aferoFs.OpenFile(filepath.Join(configPath, IndexFileName), os.O_RDONLY|os.O_CREATE, 0666)
 	if err != nil {
 		log.Debug("Failed to open index file. Creating new")
+		return
 	}
+	defer file.Close()
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		var path, hash string
-		var fileMode uint32
-		n, err := fmt.Sscanf(scanner.Text(), "%s:%s:%d", &path, &hash, &fileMode)
+		hash, info, err := parseIndexLine(scanner.Text())
 		if err != nil {
-			log.Error("Problem when scanning indexfile ", err)
-		}
-		// TODO: Nil check values
-		if n == 3 {
-			index.Current[hash] = FileInfo{
-				Path: path,
-				Perm: os.FileMode(fileMode),
-			}
-		} else {
-			if hash != "" {
-				index.Current[hash] = FileInfo{
-					Path: path,
-					Perm: os.FileMode(fileMode),
-				}
-			}
-			log.WithFields(logrus.Fields{
-				"Number": n,
-				"Path":   path,
-				"Perm":   os.FileMode(fileMode),
-			}).Warning("Missing one or more fields in indexfile")
+			log.WithField("line", scanner.Text()).
+				Warning("Missing one or more fields in indexfile ", err)
+			continue
 		}
+		index.Current[hash] = info
 	}
 }
 
-// Creates indexfile if not exist otherwise truncates and
-// writes the new index
-func writeIndexFile(configPath string, files map[string]FileInfo) error {
-	filePath := filepath.Join(configPath, IndexFileName)
-	file, err := aferoFs.OpenFile(filePath, os.O_CREATE|os.O_TRUNC, 0666)
+// Returns the index currently written in the sync directory
+func readIndexFile(configPath string) map[string]FileInfo {
+	index := &Indexes{Current: make(map[string]FileInfo)}
+	index.ParseIndexFile(configPath)
+	return index.Current
+}
+
+// Index lines are formatted as hash:path:perm. The path is allowed
+// to contain colons, the hash and the permissions never do
+func parseIndexLine(line string) (string, FileInfo, error) {
+	first := strings.Index(line, ":")
+	last := strings.LastIndex(line, ":")
+	if first <= 0 || first == last {
+		return "", FileInfo{}, ErrMalformedIndex
+	}
+	perm, err := strconv.ParseUint(line[last+1:], 10, 32)
 	if err != nil {
-		return err
+		return "", FileInfo{}, fmt.Errorf("%w: %s", ErrMalformedIndex, err)
 	}
+	return line[:first], FileInfo{
+		Path: line[first+1 : last],
+		Perm: os.FileMode(perm),
+	}, nil
+}
+
+// Writes the index atomically, replacing the index file if it exists
+func writeIndexFile(configPath string, files map[string]FileInfo) error {
+	var builder strings.Builder
 	for k, v := range files {
-		line := fmt.Sprintf("%s:%s:%d", k, v.Path, v.Perm)
-		_, err := file.WriteString(line + "\n")
-		if err != nil {
-			return err
+		builder.WriteString(fmt.Sprintf("%s:%s:%d\n", k, v.Path, v.Perm))
+	}
+	return writeFileAtomic(filepath.Join(configPath, IndexFileName), []byte(builder.String()), 0666)
+}
+
+// Returns the new files that aren't in the current index, the files a sync
+// adds to the sync directory. Must be called before CopyAndCleanup
+func (index *Indexes) added() map[string]FileInfo {
+	added := make(map[string]FileInfo)
+	for k, v := range index.New {
+		if _, ok := index.Current[k]; !ok {
+			added[k] = v
 		}
 	}
-	return nil
+	return added
 }
 
-func copyFiles(configPath string, files map[string]FileInfo) error {
+// Writes the content of the files to the sync directory. Files marked
+// for encryption are encrypted with the cipher
+func (index *Indexes) copyFiles(ctx context.Context, configPath string, files map[string]FileInfo, cipher *blobCipher, progress Progress) error {
 	for k, v := range files {
-		copyPath := v.Path
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		originPath := filepath.Join(configPath, k)
 
-		bytesRead, err := aferoFs.ReadFile(copyPath)
-		if err != nil {
-			return err
+		content, ok := index.content[k]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrMissingFile, v.Path)
 		}
-		err = aferoFs.WriteFile(originPath, bytesRead, 0666)
+		if v.Encrypt {
+			encrypted, err := cipher.encrypt(content)
+			if err != nil {
+				return err
+			}
+			content = encrypted
+		}
+		err := writeFileAtomic(originPath, content, 0666)
 		if err != nil {
 			return err
 		}
+		progress.File(v.Path, ResultCopied)
 	}
 	return nil
 }
 
+// Removes files from the sync directory, files that are already gone are ignored
 func cleanupOldFiles(configPath string, files map[string]FileInfo) error {
-	for k, _ := range files {
+	for k := range files {
 		deletePath := filepath.Join(configPath, k)
 		err := aferoFs.Remove(deletePath)
-		if err != nil {
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
 			return err
 		}
 	}
 	return nil
 }
 
-func (index *Indexes) CopyAndCleanup(configPath string) (map[string]FileInfo, error) {
+// Stages the new files and index and records the changes in the journal
+// before touching the sync directory. See journal.go
+func (index *Indexes) CopyAndCleanup(syncConfig SyncConfig) (map[string]FileInfo, error) {
+	configPath := syncConfig.IndexDir()
 	// Current all the files we want to keep
 	// Old all the files that we want to get rid of
 	// Diff these and create a list over what we need to copy
@@ -192,19 +298,319 @@ func (index *Indexes) CopyAndCleanup(configPath string) (map[string]FileInfo, er
 		newIndex[k] = v
 	}
 	cleanup := index.Current
-	err := cleanupOldFiles(configPath, cleanup)
-	if err != nil {
+
+	stagingPath := filepath.Join(configPath, StagingDirName)
+	if err := aferoFs.RemoveAll(stagingPath); err != nil {
+		return nil, err
+	}
+	if err := aferoFs.MkdirAll(stagingPath, 0755); err != nil {
+		return nil, err
+	}
+	if err := updateSecretStore(secretStorePath(), index.secrets); err != nil {
+		return nil, err
+	}
+	syncConfig.progress().Phase(PhaseCopying, len(copy))
+	ctx := syncConfig.context()
+	if err := index.copyFiles(ctx, stagingPath, copy, index.cipher, syncConfig.progress()); err != nil {
+		return nil, err
+	}
+	if err := writeIndexFile(stagingPath, newIndex); err != nil {
+		return nil, err
+	}
+	// Last chance to stop, once the journal is written the sync is rolled forward
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	err = copyFiles(configPath, copy)
+
+	j := newJournal(copy, cleanup)
+	if err := j.write(configPath); err != nil {
+		return nil, err
+	}
+	if err := j.apply(configPath); err != nil {
+		return nil, err
+	}
+	return newIndex, nil
+}
+
+// Maps the path of every file in the index to its hash
+func hashesByPath(files map[string]FileInfo) map[string]string {
+	hashes := make(map[string]string, len(files))
+	for k, v := range files {
+		hashes[v.Path] = k
+	}
+	return hashes
+}
+
+// Returns the hash of a local file or an empty string if it doesn't exist.
+// Like when indexing, the hash is of the filtered content
+func localFileHash(entry FileEntry, cipher *blobCipher) (string, error) {
+	content, err := readFiltered(entry.sourcePath(), entry.Filters)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return cipher.contentHash(entry.Encrypt, content)
+}
+
+// Decides if an incoming change should be written to the local file.
+// An empty local hash means that the file doesn't exist locally
+func shouldApply(policy PullPolicy, local, base, remote string) bool {
+	if local == remote {
+		return false
+	}
+	switch policy {
+	case PullOverwrite:
+		return true
+	case PullSkip:
+		return false
+	}
+	// Only overwrite files that haven't been touched since the last sync
+	return local == "" || local == base
+}
+
+// Reads a file from the sync directory, decrypting it if needed
+func readBlob(configPath, hash string, cipher *blobCipher) ([]byte, error) {
+	bytesRead, err := aferoFs.ReadFile(filepath.Join(configPath, hash))
 	if err != nil {
 		return nil, err
 	}
-	err = writeIndexFile(configPath, newIndex)
+	return cipher.decode(hash, bytesRead)
+}
+
+// Copies a file in the sync directory out to its tracked location. Placeholders
+// are replaced with the secrets if the file is filtered. Templates are written
+// to their source and rendered to the tracked location
+func restoreFile(syncConfig SyncConfig, hash string, info FileInfo, entry FileEntry,
+	cipher *blobCipher, secrets map[string]string) error {
+	bytesRead, err := readBlob(syncConfig.IndexDir(), hash, cipher)
+	if err != nil {
+		return err
+	}
+	return writeContent(syncConfig, info, entry, bytesRead, secrets)
+}
+
+// Writes the synced content of a file to its tracked location
+func writeContent(syncConfig SyncConfig, info FileInfo, entry FileEntry,
+	bytesRead []byte, secrets map[string]string) error {
+	var err error
+	if secrets != nil {
+		var missing []string
+		bytesRead, missing = smudgeContent(bytesRead, secrets)
+		if len(missing) > 0 {
+			log.WithFields(logrus.Fields{
+				"file":    info.Path,
+				"secrets": missing,
+				"store":   secretStorePath(),
+			}).Warning("Missing secrets, placeholders are left in the file")
+		}
+	}
+	perm := info.Perm.Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	if entry.Template {
+		if err = writeRestored(entry.sourcePath(), bytesRead, perm); err != nil {
+			return err
+		}
+		data := newTemplateData(syncConfig.Variables)
+		if bytesRead, err = renderTemplate(info.Path, bytesRead, data); err != nil {
+			return err
+		}
+	}
+	return writeRestored(expandHome(entry.Path), bytesRead, perm)
+}
+
+func writeRestored(restorePath string, content []byte, perm os.FileMode) error {
+	if err := aferoFs.MkdirAll(filepath.Dir(restorePath), 0755); err != nil {
+		return err
+	}
+	return aferoFs.WriteFile(restorePath, content, perm)
+}
+
+// Writes synced files to their local paths. All files written by one
+// restorer share a backup
+type restorer struct {
+	syncConfig SyncConfig
+	cipher     *blobCipher
+	backup     *backup
+	history    blobHistory
+	state      *localState
+	store      secretStore
+}
+
+func newRestorer(syncConfig SyncConfig, history blobHistory) (*restorer, error) {
+	state, err := readState(statePath())
 	if err != nil {
 		return nil, err
 	}
-	return newIndex, nil
+	backup := newBackup(syncConfig.Backups)
+	backup.manifest.Synced = make(map[string]string, len(state.Synced))
+	for id, hash := range state.Synced {
+		backup.manifest.Synced[id] = hash
+	}
+	return &restorer{
+		syncConfig: syncConfig,
+		cipher:     newSyncCipher(syncConfig),
+		backup:     backup,
+		history:    history,
+		state:      state,
+	}, nil
+}
+
+// Applies the changes between the base index and the remote index to the
+// local files that are tracked in the config, following their pull policies.
+// Files changed on both sides are merged, see merge.go. Local files are
+// backed up before they are overwritten. Returns the paths of all restored
+// files
+func restoreFiles(syncConfig SyncConfig, base, remote map[string]FileInfo, history blobHistory) ([]string, error) {
+	r, err := newRestorer(syncConfig, history)
+	if err != nil {
+		return []string{}, err
+	}
+	return r.restore(base, remote)
+}
+
+func (r *restorer) restore(base, remote map[string]FileInfo) ([]string, error) {
+	restored := []string{}
+	baseHashes := hashesByPath(base)
+	progress := r.syncConfig.progress()
+	total := 0
+	for _, info := range remote {
+		if _, ok := r.syncConfig.Entry(info.Path); ok {
+			total++
+		}
+	}
+	progress.Phase(PhaseRestoring, total)
+	for hash, info := range remote {
+		entry, ok := r.syncConfig.Entry(info.Path)
+		if !ok {
+			continue
+		}
+		if held, err := r.state.holdConflict(info.Path); held || err != nil {
+			if held {
+				log.WithField("file", info.Path).Warning("File has an unresolved conflict, not restoring")
+				progress.File(info.Path, ResultConflict)
+			}
+			if err != nil {
+				return restored, err
+			}
+			continue
+		}
+		local, err := localFileHash(entry, r.cipher)
+		if err != nil {
+			return restored, err
+		}
+		secrets, err := r.secrets(entry)
+		if err != nil {
+			return restored, err
+		}
+		policy := r.syncConfig.PullPolicy(entry)
+		baseHash := baseHashes[info.Path]
+		if policy != PullOverwrite && local != hash {
+			edited, err := renderEdited(r.syncConfig, entry)
+			if err != nil {
+				return restored, err
+			}
+			if edited {
+				log.WithField("file", info.Path).
+					Warning("Rendered file was edited, not overwriting. Make the change in the template")
+				progress.File(info.Path, ResultKept)
+				continue
+			}
+		}
+		if !shouldApply(policy, local, baseHash, hash) {
+			if shouldMerge(policy, local, baseHash, hash) {
+				merge := fileMerge{
+					syncConfig: r.syncConfig,
+					info:       info,
+					entry:      entry,
+					base:       baseHash,
+					remote:     hash,
+					cipher:     r.cipher,
+					history:    r.history,
+					secrets:    secrets,
+				}
+				merged, err := merge.apply(r.backup, r.state)
+				if err != nil {
+					return restored, err
+				}
+				if merged == "" {
+					progress.File(info.Path, ResultConflict)
+					continue
+				}
+				progress.File(info.Path, ResultMerged)
+				restored = append(restored, info.Path)
+				if err = runOnChange(r.syncConfig.Hooks, entry, local, merged); err != nil {
+					return restored, err
+				}
+				continue
+			}
+			result := ResultUnchanged
+			if local != hash {
+				result = ResultKept
+			}
+			if local != hash && policy != PullSkip {
+				log.WithField("file", info.Path).
+					Warning("Local file has changed since last sync, not overwriting")
+			}
+			progress.File(info.Path, result)
+			continue
+		}
+		err = r.backup.write(restoredPaths(entry), func() error {
+			return restoreFile(r.syncConfig, hash, info, entry, r.cipher, secrets)
+		})
+		if err != nil {
+			return restored, err
+		}
+		restored = append(restored, info.Path)
+		progress.File(info.Path, ResultRestored)
+		if err = runOnChange(r.syncConfig.Hooks, entry, local, hash); err != nil {
+			return restored, err
+		}
+	}
+	return restored, nil
+}
+
+// Returns the stored secrets of a filtered file, nil if it isn't filtered
+func (r *restorer) secrets(entry FileEntry) (map[string]string, error) {
+	if len(entry.Filters) == 0 {
+		return nil, nil
+	}
+	if r.store == nil {
+		store, err := readSecretStore(secretStorePath())
+		if err != nil {
+			return nil, err
+		}
+		r.store = store
+	}
+	secrets := r.store[entry.ID()]
+	if secrets == nil {
+		secrets = map[string]string{}
+	}
+	return secrets, nil
+}
+
+// Removes the local files of the entry, they can be brought back with undo
+func (r *restorer) remove(entry FileEntry) error {
+	return r.backup.write(restoredPaths(entry), func() error {
+		for _, filePath := range restoredPaths(entry) {
+			if err := aferoFs.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Returns the local paths a restore of the file writes to
+func restoredPaths(entry FileEntry) []string {
+	written := []string{expandHome(entry.Path)}
+	if entry.Template {
+		written = append(written, entry.sourcePath())
+	}
+	return written
 }
 
 func DiffFiles(file1 afero.File, file2 afero.File) (bool, error) {
@@ -220,6 +626,73 @@ func DiffFiles(file1 afero.File, file2 afero.File) (bool, error) {
 	return fileHash1 != fileHash2, nil
 }
 
+// Expands a leading ~ to the home directory of the current user.
+// Paths are returned untouched if the home directory can't be resolved
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	homePath, err := os.UserHomeDir()
+	if err != nil {
+		log.Error("Failed to get user home", err)
+		return path
+	}
+	return filepath.Join(homePath, path[1:])
+}
+
+// Writes the data to a temporary file next to the destination, syncs it to disk
+// and renames it over the destination. Readers see either the old or the new
+// content, never a partially written file
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filePath)
+	tmp, err := afero.TempFile(aferoFs.Fs, dir, "."+filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer aferoFs.Remove(tmpPath)
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = aferoFs.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+	if err = aferoFs.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// Makes a rename in the directory durable. Not every platform supports syncing
+// a directory, failures are only logged
+func syncDir(dir string) {
+	d, err := aferoFs.Open(dir)
+	if err != nil {
+		log.WithField("dir", dir).Debug("Failed to open directory for sync ", err)
+		return
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		log.WithField("dir", dir).Debug("Failed to sync directory ", err)
+	}
+}
+
+// Generates a SHA1 hash of the content
+func sha1Hash(content []byte) string {
+	sum := sha1.Sum(content)
+	return hex.EncodeToString(sum[:])
+}
+
 // Generates a SHA1 hash of the file
 func sha1FileHash(file afero.File) (string, error) {
 	shaHasher := sha1.New()
@@ -61,21 +61,29 @@ func initalise() ([]string, []string) {
 	return currentFiles, newFiles
 }
 
+func syncConfigWith(paths ...string) SyncConfig {
+	syncConfig := SyncConfig{Path: dotsyncPath}
+	for _, path := range paths {
+		syncConfig.Files = append(syncConfig.Files, FileEntry{Path: path})
+	}
+	return syncConfig
+}
+
 func TestInitialiseIndex(t *testing.T) {
 	_, newFiles := initalise()
-	index := InitialiseIndex(newFiles)
+	index := InitialiseIndex(syncConfigWith(newFiles...))
 	assert.Equal(t, len(index.New), 3)
-	i := 0
+	paths := []string{}
 	for _, v := range index.New {
-		assert.Equal(t, v.Path, newFiles[i])
+		paths = append(paths, v.Path)
 		assert.Equal(t, v.Perm, os.FileMode(0666))
-		i += 1
 	}
+	assert.ElementsMatch(t, newFiles, paths)
 }
 
 func TestParseNonExistingIndexFile(t *testing.T) {
 	_, newFiles := initalise()
-	index := InitialiseIndex(newFiles)
+	index := InitialiseIndex(syncConfigWith(newFiles...))
 	index.ParseIndexFile(dotsyncPath)
 	ok, err := aferoFs.Exists(filepath.Join(dotsyncPath, IndexFileName))
 	if err != nil {
@@ -85,5 +93,91 @@ func TestParseNonExistingIndexFile(t *testing.T) {
 }
 
 func TestParseIndexFile(t *testing.T) {
+	_, newFiles := initalise()
+	index := InitialiseIndex(syncConfigWith(append(newFiles, "/tmp/with:colon")...))
+	err := writeIndexFile(dotsyncPath, index.New)
+	assert.NoError(t, err)
+	index.ParseIndexFile(dotsyncPath)
+	assert.Equal(t, index.New, index.Current)
+}
 
+func TestShouldApply(t *testing.T) {
+	// Local file is unchanged since the last sync
+	assert.True(t, shouldApply(PullIfUnchanged, "base", "base", "remote"))
+	// Local file doesn't exist
+	assert.True(t, shouldApply(PullIfUnchanged, "", "base", "remote"))
+	// Local file has changed since the last sync
+	assert.False(t, shouldApply(PullIfUnchanged, "local", "base", "remote"))
+	assert.True(t, shouldApply(PullOverwrite, "local", "base", "remote"))
+	assert.False(t, shouldApply(PullSkip, "base", "base", "remote"))
+	// Nothing to do when already equal
+	assert.False(t, shouldApply(PullOverwrite, "remote", "base", "remote"))
+}
+
+func TestRestoreFilesFollowsPolicy(t *testing.T) {
+	currentFiles, newFiles := initalise()
+	base := InitialiseIndex(syncConfigWith(newFiles...)).New
+	// Pretend the remote replaced the content of every file with
+	// the content of the files in the sync directory
+	remote := make(map[string]FileInfo)
+	for i, hash := range hashesOf(currentFiles) {
+		remote[hash] = FileInfo{Path: newFiles[i], Perm: 0644}
+		err := aferoFs.Rename(currentFiles[i], filepath.Join(dotsyncPath, hash))
+		assert.NoError(t, err)
+		currentFiles[i] = filepath.Join(dotsyncPath, hash)
+	}
+	// Change the last file locally
+	fillFileWithData(newFiles[2])
+	syncConfig := SyncConfig{
+		Path: dotsyncPath,
+		Files: []FileEntry{
+			{Path: newFiles[0]},
+			{Path: newFiles[1], Pull: PullSkip},
+			{Path: newFiles[2]},
+		},
+	}
+	restored, err := restoreFiles(syncConfig, base, remote, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{newFiles[0]}, restored)
+	restoredBytes, _ := aferoFs.ReadFile(newFiles[0])
+	remoteBytes, _ := aferoFs.ReadFile(currentFiles[0])
+	assert.Equal(t, remoteBytes, restoredBytes)
+}
+
+func hashesOf(paths []string) []string {
+	hashes := []string{}
+	for _, path := range paths {
+		hash, err := localFileHash(FileEntry{Path: path}, nil)
+		if err != nil {
+			panic(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+func TestResolveMissingFollowsPolicy(t *testing.T) {
+	for _, policy := range []MissingPolicy{MissingKeep, MissingDelete, MissingFail} {
+		_, newFiles := initalise()
+		synced := InitialiseIndex(syncConfigWith(newFiles...)).New
+		assert.NoError(t, writeIndexFile(dotsyncPath, synced))
+		missingHash := hashesOf(newFiles[:1])[0]
+		assert.NoError(t, aferoFs.Remove(newFiles[0]))
+
+		index := InitialiseIndex(syncConfigWith(newFiles...))
+		assert.Equal(t, []string{newFiles[0]}, index.Missing)
+		index.ParseIndexFile(dotsyncPath)
+		err := index.ResolveMissing(SyncConfig{Missing: policy})
+		_, kept := index.New[missingHash]
+		switch policy {
+		case MissingKeep:
+			assert.NoError(t, err)
+			assert.True(t, kept)
+		case MissingDelete:
+			assert.NoError(t, err)
+			assert.False(t, kept)
+		case MissingFail:
+			assert.ErrorIs(t, err, ErrMissingFile)
+		}
+	}
 }
@@ -0,0 +1,239 @@
+package dotsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+# Filters
+Filters keep single secrets out of files that are otherwise fine to share.
+When pushing, the secret values are replaced with placeholders
+
+	@@DOTSYNC_SECRET:name@@
+
+and the values are stored in a local secrets file, which never leaves the
+machine. When restoring, the placeholders are replaced with the stored values
+again. A value is found either by a regular expression, where the first group
+or else the whole match is the secret, or by a marker on the line, where the
+secret is the value after the first = or : on that line.
+
+Hashes are computed on the filtered content, so a changed secret doesn't
+change the file as far as syncing is concerned.
+*/
+
+const (
+	DefaultSecretsFileName = "secrets.yaml"
+
+	placeholderPrefix = "@@DOTSYNC_SECRET:"
+	placeholderSuffix = "@@"
+)
+
+var (
+	ErrInvalidFilter = errors.New("invalid filter")
+
+	placeholderPattern = regexp.MustCompile(`@@DOTSYNC_SECRET:([A-Za-z0-9._-]+)@@`)
+	filterNamePattern  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	// Key and value of a line, the value ends at the first whitespace
+	markedValuePattern = regexp.MustCompile(`^[^=:]*[=:]\s*(\S+)`)
+)
+
+// Replaces a secret in a tracked file with a placeholder
+type FilterRule struct {
+	// Name of the placeholder, numbered from the second match on
+	Name string `yaml:"name"`
+	// The first group or else the whole match is the secret
+	Regex string `yaml:"regex,omitempty"`
+	// Lines containing the marker have their value replaced
+	Marker string `yaml:"marker,omitempty"`
+}
+
+func (f FilterRule) Validate() error {
+	if !filterNamePattern.MatchString(f.Name) {
+		return fmt.Errorf("%w: name %q", ErrInvalidFilter, f.Name)
+	}
+	if (f.Regex == "") == (f.Marker == "") {
+		return fmt.Errorf("%w: %s needs either a regex or a marker", ErrInvalidFilter, f.Name)
+	}
+	if f.Regex != "" {
+		if _, err := regexp.Compile(f.Regex); err != nil {
+			return fmt.Errorf("%w: %s: %s", ErrInvalidFilter, f.Name, err)
+		}
+	}
+	return nil
+}
+
+func placeholder(key string) string {
+	return placeholderPrefix + key + placeholderSuffix
+}
+
+// Replaces the secrets in content with placeholders. Returns the filtered
+// content and the secrets keyed by placeholder name
+func cleanContent(content []byte, filters []FilterRule) ([]byte, map[string]string, error) {
+	secrets := make(map[string]string)
+	for _, f := range filters {
+		var err error
+		count := 0
+		key := func() string {
+			count++
+			if count == 1 {
+				return f.Name
+			}
+			return fmt.Sprintf("%s.%d", f.Name, count)
+		}
+		if f.Regex != "" {
+			content, err = cleanRegex(content, f.Regex, key, secrets)
+		} else {
+			content = cleanMarked(content, f.Marker, key, secrets)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return content, secrets, nil
+}
+
+func cleanRegex(content []byte, expr string, key func() string, secrets map[string]string) ([]byte, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidFilter, err)
+	}
+	var out bytes.Buffer
+	last := 0
+	for _, match := range re.FindAllSubmatchIndex(content, -1) {
+		start, end := match[0], match[1]
+		if len(match) > 2 && match[2] >= 0 {
+			start, end = match[2], match[3]
+		}
+		value := string(content[start:end])
+		// Already a placeholder, or an empty value that there's no point in hiding
+		if value == "" || placeholderPattern.MatchString(value) {
+			continue
+		}
+		k := key()
+		secrets[k] = value
+		out.Write(content[last:start])
+		out.WriteString(placeholder(k))
+		last = end
+	}
+	out.Write(content[last:])
+	return out.Bytes(), nil
+}
+
+func cleanMarked(content []byte, marker string, key func() string, secrets map[string]string) []byte {
+	lines := splitLines(content)
+	for i, line := range lines {
+		if !strings.Contains(line, marker) {
+			continue
+		}
+		match := markedValuePattern.FindStringSubmatchIndex(line)
+		if match == nil {
+			continue
+		}
+		// A value running into the marker is part of the comment, the line has no value
+		value := line[match[2]:match[3]]
+		if match[3] > strings.Index(line, marker) || placeholderPattern.MatchString(value) {
+			continue
+		}
+		k := key()
+		secrets[k] = value
+		lines[i] = line[:match[2]] + placeholder(k) + line[match[3]:]
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// Replaces the placeholders in content with the secrets. Returns the names
+// of the placeholders without a secret, they are left in place
+func smudgeContent(content []byte, secrets map[string]string) ([]byte, []string) {
+	missing := []string{}
+	smudged := placeholderPattern.ReplaceAllFunc(content, func(p []byte) []byte {
+		k := string(placeholderPattern.FindSubmatch(p)[1])
+		value, ok := secrets[k]
+		if !ok {
+			missing = append(missing, k)
+			return p
+		}
+		return []byte(value)
+	})
+	return smudged, missing
+}
+
+// Reads a file with its secrets filtered out
+func readFiltered(filePath string, filters []FilterRule) ([]byte, error) {
+	content, err := aferoFs.ReadFile(filePath)
+	if err != nil || len(filters) == 0 {
+		return content, err
+	}
+	content, _, err = cleanContent(content, filters)
+	return content, err
+}
+
+// Secrets of the filtered files, keyed by path of the file then by placeholder name
+type secretStore map[string]map[string]string
+
+func secretStorePath() string {
+	return filepath.Join(filepath.Dir(getConfigPath()), DefaultSecretsFileName)
+}
+
+// A missing store is an empty store
+func readSecretStore(storePath string) (secretStore, error) {
+	store := make(secretStore)
+	bytesRead, err := aferoFs.ReadFile(storePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(bytesRead, &store); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Merges the secrets into the store, the store is only written if it changed
+func updateSecretStore(storePath string, secrets secretStore) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+	store, err := readSecretStore(storePath)
+	if err != nil {
+		return err
+	}
+	changed := false
+	for path, values := range secrets {
+		if store[path] == nil {
+			store[path] = make(map[string]string)
+		}
+		for k, v := range values {
+			if store[path][k] != v {
+				store[path][k] = v
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("# Secrets filtered out of the synced files, keep this file private\n")
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err = encoder.Encode(store); err != nil {
+		return err
+	}
+	if err = encoder.Close(); err != nil {
+		return err
+	}
+	if err = aferoFs.MkdirAll(filepath.Dir(storePath), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(storePath, buffer.Bytes(), 0600)
+}
@@ -0,0 +1,111 @@
+package dotsync
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const npmrc = `registry=https://registry.npmjs.org/
+//registry.npmjs.org/:_authToken=npm_abc123
+//npm.example.com/:_authToken=npm_def456
+email = user@example.com
+password = hunter2 # dotsync:secret
+`
+
+var npmrcFilters = []FilterRule{
+	{Name: "npm-token", Regex: `_authToken=(\S+)`},
+	{Name: "password", Marker: "dotsync:secret"},
+}
+
+func TestCleanAndSmudgeContent(t *testing.T) {
+	cleaned, secrets, err := cleanContent([]byte(npmrc), npmrcFilters)
+	assert.NoError(t, err)
+	assert.Equal(t, `registry=https://registry.npmjs.org/
+//registry.npmjs.org/:_authToken=@@DOTSYNC_SECRET:npm-token@@
+//npm.example.com/:_authToken=@@DOTSYNC_SECRET:npm-token.2@@
+email = user@example.com
+password = @@DOTSYNC_SECRET:password@@ # dotsync:secret
+`, string(cleaned))
+	assert.Equal(t, map[string]string{
+		"npm-token":   "npm_abc123",
+		"npm-token.2": "npm_def456",
+		"password":    "hunter2",
+	}, secrets)
+
+	// Cleaning again changes nothing
+	again, _, err := cleanContent(cleaned, npmrcFilters)
+	assert.NoError(t, err)
+	assert.Equal(t, cleaned, again)
+
+	smudged, missing := smudgeContent(cleaned, secrets)
+	assert.Empty(t, missing)
+	assert.Equal(t, npmrc, string(smudged))
+
+	delete(secrets, "password")
+	smudged, missing = smudgeContent(cleaned, secrets)
+	assert.Equal(t, []string{"password"}, missing)
+	assert.Contains(t, string(smudged), "@@DOTSYNC_SECRET:password@@")
+}
+
+func TestMarkerWithoutValue(t *testing.T) {
+	content := []byte("# dotsync:secret\n")
+	cleaned, secrets, err := cleanContent(content, npmrcFilters[1:])
+	assert.NoError(t, err)
+	assert.Equal(t, content, cleaned)
+	assert.Empty(t, secrets)
+}
+
+func TestFilterRuleValidate(t *testing.T) {
+	assert.NoError(t, FilterRule{Name: "token", Regex: "token=(.*)"}.Validate())
+	assert.NoError(t, FilterRule{Name: "token", Marker: "dotsync:secret"}.Validate())
+	assert.ErrorIs(t, FilterRule{Name: "token"}.Validate(), ErrInvalidFilter)
+	assert.ErrorIs(t, FilterRule{Name: "token", Regex: "(", Marker: "x"}.Validate(), ErrInvalidFilter)
+	assert.ErrorIs(t, FilterRule{Name: "token", Regex: "("}.Validate(), ErrInvalidFilter)
+	assert.ErrorIs(t, FilterRule{Name: "a b", Regex: "x"}.Validate(), ErrInvalidFilter)
+}
+
+func TestChangedSecretKeepsHash(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	path := "/home/user/.npmrc"
+	syncConfig := SyncConfig{Files: []FileEntry{{Path: path, Filters: npmrcFilters}}}
+	assert.NoError(t, aferoFs.WriteFile(path, []byte(npmrc), 0600))
+	before := InitialiseIndex(syncConfig)
+
+	assert.NoError(t, aferoFs.WriteFile(path, []byte(strings.Replace(npmrc, "hunter2", "hunter3", 1)), 0600))
+	after := InitialiseIndex(syncConfig)
+	assert.Equal(t, hashesByPath(before.New), hashesByPath(after.New))
+	assert.Equal(t, "hunter3", after.secrets[path]["password"])
+	hash, err := localFileHash(syncConfig.Files[0], nil)
+	assert.NoError(t, err)
+	assert.Equal(t, hashesByPath(after.New)[path], hash)
+}
+
+func TestRestoreFilteredFile(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	path := "/home/user/.npmrc"
+	syncConfig := SyncConfig{
+		Path:  dotsyncPath,
+		Files: []FileEntry{{Path: path, Filters: npmrcFilters}},
+	}
+	cleaned, secrets, err := cleanContent([]byte(npmrc), npmrcFilters)
+	assert.NoError(t, err)
+	assert.NoError(t, updateSecretStore(secretStorePath(), secretStore{path: secrets}))
+	info, err := aferoFs.Stat(secretStorePath())
+	assert.NoError(t, err)
+	assert.Equal(t, "-rw-------", info.Mode().String())
+
+	hash := sha1Hash(cleaned)
+	assert.NoError(t, aferoFs.MkdirAll(dotsyncPath, 0755))
+	assert.NoError(t, aferoFs.WriteFile(filepath.Join(dotsyncPath, hash), cleaned, 0666))
+	restored, err := restoreFiles(syncConfig, map[string]FileInfo{},
+		map[string]FileInfo{hash: {Path: path, Perm: 0600}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path}, restored)
+	content, err := aferoFs.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, npmrc, string(content))
+}
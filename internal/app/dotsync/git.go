@@ -1,7 +1,10 @@
 package dotsync
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"time"
@@ -15,10 +18,60 @@ import (
 )
 
 type repository struct {
-	Repo   *git.Repository
-	Auth   *ssh.PublicKeys
-	Remote string
-	Branch string
+	Repo *git.Repository
+	// Worktree of the repository, the path of the config
+	Path     string
+	Auth     *ssh.PublicKeys
+	Remote   string
+	Branch   string
+	Timeouts TimeoutsConfig
+	progress Progress
+}
+
+// How long network operations may take before they are given up, so that a
+// hung connection doesn't block a sync forever
+type TimeoutsConfig struct {
+	Clone time.Duration `yaml:"clone,omitempty"`
+	// Also used for pulling
+	Fetch time.Duration `yaml:"fetch,omitempty"`
+	Push  time.Duration `yaml:"push,omitempty"`
+}
+
+const (
+	DefaultCloneTimeout = 10 * time.Minute
+	DefaultFetchTimeout = 2 * time.Minute
+	DefaultPushTimeout  = 2 * time.Minute
+)
+
+var ErrTimeout = errors.New("timed out")
+
+func (t *TimeoutsConfig) setDefaults() {
+	if t.Clone == 0 {
+		t.Clone = DefaultCloneTimeout
+	}
+	if t.Fetch == 0 {
+		t.Fetch = DefaultFetchTimeout
+	}
+	if t.Push == 0 {
+		t.Push = DefaultPushTimeout
+	}
+}
+
+// Runs a network operation, giving up after the timeout or when ctx is done
+func withTimeout(ctx context.Context, operation string, timeout time.Duration, f func(ctx context.Context) error) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := f(timeoutCtx)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s: %w", operation, ctx.Err())
+	}
+	if timeoutCtx.Err() != nil {
+		return fmt.Errorf("%w: %s after %s", ErrTimeout, operation, timeout)
+	}
+	return err
 }
 
 type gitOperations interface {
@@ -29,14 +82,33 @@ type gitOperations interface {
 }
 
 type plainGitOperations interface {
-	plainClone(path string, isBare bool, o *git.CloneOptions) (*git.Repository, error)
+	plainClone(ctx context.Context, path string, isBare bool, o *git.CloneOptions) (*git.Repository, error)
 	plainOpen(path string) (*git.Repository, error)
 }
 
+// Opens and clones the repository, for syncing with something else than
+// plain git directories
+type GitBackend interface {
+	PlainCloneContext(ctx context.Context, path string, isBare bool, o *git.CloneOptions) (*git.Repository, error)
+	PlainOpen(path string) (*git.Repository, error)
+}
+
+type gitBackend struct {
+	backend GitBackend
+}
+
+func (g gitBackend) plainClone(ctx context.Context, path string, isBare bool, o *git.CloneOptions) (*git.Repository, error) {
+	return g.backend.PlainCloneContext(ctx, path, isBare, o)
+}
+
+func (g gitBackend) plainOpen(path string) (*git.Repository, error) {
+	return g.backend.PlainOpen(path)
+}
+
 type gitExtension struct{}
 
-func (g *gitExtension) plainClone(path string, isBare bool, o *git.CloneOptions) (*git.Repository, error) {
-	return git.PlainClone(path, isBare, o)
+func (g *gitExtension) plainClone(ctx context.Context, path string, isBare bool, o *git.CloneOptions) (*git.Repository, error) {
+	return git.PlainCloneContext(ctx, path, isBare, o)
 }
 
 func (g *gitExtension) plainOpen(path string) (*git.Repository, error) {
@@ -47,6 +119,9 @@ func (g *gitExtension) plainOpen(path string) (*git.Repository, error) {
 // a clone operation will be performed
 // Returns the repository and a nil error if sucessful
 func NewRepository(s SyncConfig) (*repository, error) {
+	if s.Git != nil {
+		return newRepository(s, gitBackend{s.Git})
+	}
 	return newRepository(s, nil)
 }
 
@@ -69,30 +144,37 @@ func newRepository(s SyncConfig, g plainGitOperations) (*repository, error) {
 	if err != nil {
 		return nil, err
 	}
-	if _, err := fs.Stat(filepath.Join(DotSyncPath, ".git")); errors.Is(err, os.ErrNotExist) {
-		repo, err = cloneSSH(remoteURL, branch, auth, g)
+	if _, err := fs.Stat(filepath.Join(s.Path, ".git")); errors.Is(err, os.ErrNotExist) {
+		s.progress().Phase(PhaseFetching, 0)
+		err = withTimeout(s.context(), "clone", s.Timeouts.Clone, func(ctx context.Context) error {
+			repo, err = cloneSSH(ctx, s.Path, remoteURL, branch, auth, g, &progressWriter{progress: s.progress()})
+			return err
+		})
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		repo, err = g.plainOpen(DotSyncPath)
+		repo, err = g.plainOpen(s.Path)
 		if err != nil {
 			return nil, err
 		}
 	}
 	r.Repo = repo
+	r.Path = s.Path
 	r.Auth = auth
 	r.Branch = s.GitConfig.Branch
 	r.Remote = s.GitConfig.Remote
+	r.Timeouts = s.Timeouts
+	r.progress = s.progress()
 	return r, nil
 }
 
 // Clones a repository using ssh url formatting and a valid sshKey read as byte slice
 // Returns error if unable to clone the specified repository url
-func cloneSSH(remoteURL, branch string, auth *ssh.PublicKeys, g plainGitOperations) (*git.Repository, error) {
-	r, err := g.plainClone(DotSyncPath, false, &git.CloneOptions{
+func cloneSSH(ctx context.Context, path, remoteURL, branch string, auth *ssh.PublicKeys, g plainGitOperations, progress io.Writer) (*git.Repository, error) {
+	r, err := g.plainClone(ctx, path, false, &git.CloneOptions{
 		URL:           remoteURL,
-		Progress:      os.Stdout,
+		Progress:      progress,
 		ReferenceName: plumbing.NewBranchReferenceName(branch),
 		Auth:          auth,
 	})
@@ -111,7 +193,7 @@ func (r *repository) commit(commitMessage string) error {
 	commit, err := worktree.Commit(commitMessage, &git.CommitOptions{
 		Author: &object.Signature{
 			Name: "dotsync",
-			When: time.Now(),
+			When: now(),
 		},
 	})
 	if err != nil {
@@ -121,10 +203,25 @@ func (r *repository) commit(commitMessage string) error {
 	return err
 }
 
-func (r *repository) fetch() error {
-	err := r.Repo.Fetch(&git.FetchOptions{
-		RemoteName: r.Remote,
-		Auth:       r.Auth,
+func (r *repository) report() Progress {
+	if r.progress == nil {
+		return noProgress{}
+	}
+	return r.progress
+}
+
+// Passes the progress messages of the server on
+func (r *repository) sideband() io.Writer {
+	return &progressWriter{progress: r.report()}
+}
+
+func (r *repository) fetch(ctx context.Context) error {
+	err := withTimeout(ctx, "fetch", r.Timeouts.Fetch, func(ctx context.Context) error {
+		return r.Repo.FetchContext(ctx, &git.FetchOptions{
+			RemoteName: r.Remote,
+			Auth:       r.Auth,
+			Progress:   r.sideband(),
+		})
 	})
 
 	if err == git.NoErrAlreadyUpToDate {
@@ -134,14 +231,18 @@ func (r *repository) fetch() error {
 	return err
 }
 
-func (r *repository) pull() error {
+func (r *repository) pull(ctx context.Context) error {
 	w, err := r.Repo.Worktree()
 	if err != nil {
 		return err
 	}
-	err = w.Pull(&git.PullOptions{
-		RemoteName: r.Remote,
-		Auth:       r.Auth,
+	r.report().Phase(PhaseFetching, 0)
+	err = withTimeout(ctx, "pull", r.Timeouts.Fetch, func(ctx context.Context) error {
+		return w.PullContext(ctx, &git.PullOptions{
+			RemoteName: r.Remote,
+			Auth:       r.Auth,
+			Progress:   r.sideband(),
+		})
 	})
 
 	if err == git.NoErrAlreadyUpToDate {
@@ -153,10 +254,13 @@ func (r *repository) pull() error {
 
 // Pushes current commited files to remote. Assumes HTTPs or SSH depending on auth method
 // that is supplied to the function
-func (r *repository) push() error {
-	return r.Repo.Push(&git.PushOptions{
-		RemoteName: r.Remote,
-		Auth:       r.Auth,
+func (r *repository) push(ctx context.Context) error {
+	return withTimeout(ctx, "push", r.Timeouts.Push, func(ctx context.Context) error {
+		return r.Repo.PushContext(ctx, &git.PushOptions{
+			RemoteName: r.Remote,
+			Auth:       r.Auth,
+			Progress:   r.sideband(),
+		})
 	})
 }
 
@@ -200,11 +304,15 @@ func (r *repository) add(filePaths []string) error {
 
 // Tries and update the repository with a git pull. Tries and reset the repository to the the HEAD of origin
 // returns an error if that fails
-func (r *repository) tryAndUpdate() error {
-	err := r.pull()
+func (r *repository) tryAndUpdate(ctx context.Context) error {
+	err := r.pull(ctx)
 	if err == nil {
 		return nil
 	}
+	// Resetting wouldn't help
+	if ctx.Err() != nil || errors.Is(err, ErrTimeout) {
+		return err
+	}
 	// Repo can't be updated, reset and retry
 
 	remoteRef, err := r.Repo.Reference(
@@ -242,9 +350,90 @@ func (r *repository) tryAndUpdate() error {
 		return err
 	}
 
-	if localRef != remoteRef {
+	if localRef.Hash() != remoteRef.Hash() {
 		return errors.New("Failed to update")
 	}
 
 	return nil
 }
+
+// Writes the files as they are in HEAD back to the worktree. Unlike a hard
+// reset this leaves untracked files, such as the lock, alone
+func (r *repository) restoreFromHead(filePaths []string) error {
+	head, err := r.Repo.Head()
+	if err != nil {
+		return err
+	}
+	commit, err := r.Repo.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	for _, filePath := range filePaths {
+		file, err := tree.File(filePath)
+		if errors.Is(err, object.ErrFileNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		content, err := file.Contents()
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(filepath.Join(r.Path, filePath), []byte(content), 0666)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the commit HEAD points to, the zero hash if there is none yet
+func (r *repository) headCommit() plumbing.Hash {
+	head, err := r.Repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+	return head.Hash()
+}
+
+// Blobs of the sync directory as they were in an earlier commit, or in the
+// commits before it
+type commitBlobs struct {
+	repository *repository
+	commit     plumbing.Hash
+	syncConfig SyncConfig
+}
+
+func (c commitBlobs) blobAt(hash string) ([]byte, error) {
+	if c.commit.IsZero() {
+		return nil, object.ErrFileNotFound
+	}
+	commits, err := c.repository.Repo.Log(&git.LogOptions{From: c.commit})
+	if err != nil {
+		return nil, err
+	}
+	defer commits.Close()
+	for {
+		commit, err := commits.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, object.ErrFileNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		file, err := commit.File(c.syncConfig.repoPath(hash))
+		if errors.Is(err, object.ErrFileNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		content, err := file.Contents()
+		return []byte(content), err
+	}
+}
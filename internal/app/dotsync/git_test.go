@@ -1,16 +1,19 @@
 package dotsync
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"github.com/go-git/go-git/v5"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/ssh"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 var workingConfig = SyncConfig{
@@ -19,7 +22,7 @@ var workingConfig = SyncConfig{
 		KeyFile: ".ssh/id_rsa",
 		Branch:  "main",
 	},
-	Files:   []string{},
+	Files:   []FileEntry{},
 	Path: "/tmp/dotsync",
 }
 
@@ -61,7 +64,7 @@ type mockGitExtension struct {
 	plainOpenCalled  int
 }
 
-func (m *mockGitExtension) plainClone(path string, isBare bool, o *git.CloneOptions) (*git.Repository, error) {
+func (m *mockGitExtension) plainClone(ctx context.Context, path string, isBare bool, o *git.CloneOptions) (*git.Repository, error) {
 	m.plainCloneCalled += 1
 	return &git.Repository{}, nil
 }
@@ -77,7 +80,7 @@ func TestNewRepositoryOpens(t *testing.T) {
 		plainOpenCalled:  0,
 	}
 	sshFs := createTempSSSHDir()
-	sshFs.MkdirAll(filepath.Join(DotSyncPath, ".git"), 0755)
+	sshFs.MkdirAll(filepath.Join(workingConfig.Path, ".git"), 0755)
 	r, err := newRepository(workingConfig, m)
 	assert.NoError(t, err)
 	assert.NotNil(t, r)
@@ -106,3 +109,24 @@ func TestNewRepositoryClonesWhenEmpty(t *testing.T) {
 	assert.NotNil(t, r)
 	assert.Equal(t, 1, m.plainCloneCalled)
 }
+
+func TestWithTimeout(t *testing.T) {
+	err := withTimeout(context.Background(), "fetch", time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.EqualError(t, err, "timed out: fetch after 1ms")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = withTimeout(ctx, "push", time.Minute, func(ctx context.Context) error {
+		return errors.New("transport closed")
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	err = withTimeout(context.Background(), "pull", time.Minute, func(ctx context.Context) error {
+		return git.NoErrAlreadyUpToDate
+	})
+	assert.Equal(t, git.NoErrAlreadyUpToDate, err)
+}
@@ -0,0 +1,178 @@
+package dotsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+# Hooks
+Hooks are shell commands run around a sync. Pre hooks run before anything is
+synced, post hooks after the sync succeeded. A tracked file can have an
+onchange command, run whenever a restore changed the file. Every command runs
+in the home directory with a timeout and with
+
+	DOTSYNC_HOOK      name of the hook, or onchange
+	DOTSYNC_FILES     restored files, one per line, post-restore only
+	DOTSYNC_FILE      the changed file, onchange only
+	DOTSYNC_OLD_HASH  hash of the file before the restore, empty if it didn't exist
+	DOTSYNC_NEW_HASH  hash of the file after the restore
+
+A failing hook aborts the sync, or is only logged with onFailure: warn.
+*/
+
+const (
+	HookPrePush     = "pre-push"
+	HookPostPush    = "post-push"
+	HookPreRestore  = "pre-restore"
+	HookPostRestore = "post-restore"
+	HookOnChange    = "onchange"
+
+	DefaultHookTimeout   = time.Minute
+	DefaultScriptTimeout = 30 * time.Minute
+)
+
+var (
+	ErrHookFailed        = errors.New("hook failed")
+	ErrInvalidHookPolicy = errors.New("invalid hook failure policy")
+)
+
+// Decides what happens when a hook fails
+type HookFailurePolicy string
+
+const (
+	// Stop the sync and fail
+	HookAbort HookFailurePolicy = "abort"
+	// Log the failure and carry on
+	HookWarn HookFailurePolicy = "warn"
+)
+
+type HooksConfig struct {
+	PrePush     []string      `yaml:"prePush,omitempty"`
+	PostPush    []string      `yaml:"postPush,omitempty"`
+	PreRestore  []string      `yaml:"preRestore,omitempty"`
+	PostRestore []string      `yaml:"postRestore,omitempty"`
+	Timeout     time.Duration `yaml:"timeout,omitempty"`
+	// Timeout of the scripts, see scripts.go
+	ScriptTimeout time.Duration     `yaml:"scriptTimeout,omitempty"`
+	OnFailure     HookFailurePolicy `yaml:"onFailure,omitempty"`
+}
+
+func (p HookFailurePolicy) Validate() error {
+	switch p {
+	case "", HookAbort, HookWarn:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidHookPolicy, p)
+}
+
+func (h HooksConfig) commands(hook string) []string {
+	switch hook {
+	case HookPrePush:
+		return h.PrePush
+	case HookPostPush:
+		return h.PostPush
+	case HookPreRestore:
+		return h.PreRestore
+	case HookPostRestore:
+		return h.PostRestore
+	}
+	return nil
+}
+
+// Runs the commands of a hook in order. Returns an error if one fails and
+// the failure policy is abort
+func runHook(hooks HooksConfig, hook string, env ...string) error {
+	for _, command := range hooks.commands(hook) {
+		err := runHookCommand(hooks, command, append([]string{"DOTSYNC_HOOK=" + hook}, env...))
+		if err = hookFailure(hooks, hook, command, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs the onchange command of a restored file
+func runOnChange(hooks HooksConfig, entry FileEntry, oldHash, newHash string) error {
+	if entry.OnChange == "" {
+		return nil
+	}
+	err := runHookCommand(hooks, entry.OnChange, []string{
+		"DOTSYNC_HOOK=" + HookOnChange,
+		"DOTSYNC_FILE=" + expandHome(entry.Path),
+		"DOTSYNC_OLD_HASH=" + oldHash,
+		"DOTSYNC_NEW_HASH=" + newHash,
+	})
+	return hookFailure(hooks, HookOnChange, entry.OnChange, err)
+}
+
+func hookFailure(hooks HooksConfig, hook, command string, err error) error {
+	if err == nil {
+		return nil
+	}
+	fields := logrus.Fields{"hook": hook, "command": command}
+	if hooks.OnFailure == HookWarn {
+		log.WithFields(fields).Warning("Hook failed, continuing ", err)
+		return nil
+	}
+	log.WithFields(fields).Error("Hook failed ", err)
+	return fmt.Errorf("%w: %s: %s", ErrHookFailed, hook, err)
+}
+
+func runHookCommand(hooks HooksConfig, command string, env []string) error {
+	timeout := hooks.Timeout
+	if timeout == 0 {
+		timeout = DefaultHookTimeout
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	return runCommand(cmd, command, timeout, env)
+}
+
+// Runs the command in the home directory and logs its output. Commands
+// started by it are killed along with it on timeout
+func runCommand(cmd *exec.Cmd, name string, timeout time.Duration, env []string) error {
+	cmd.Env = append(os.Environ(), env...)
+	if home, err := os.UserHomeDir(); err == nil {
+		cmd.Dir = home
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	setProcessGroup(cmd)
+
+	log.WithField("command", name).Info("Running command")
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var err error
+	timer := time.NewTimer(timeout)
+	select {
+	case err = <-done:
+		timer.Stop()
+	case <-timer.C:
+		killProcessGroup(cmd)
+		<-done
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	if output.Len() > 0 {
+		log.WithField("command", name).Info(strings.TrimRight(output.String(), "\n"))
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package dotsync
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func requireShell(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell to run hooks with")
+	}
+}
+
+func TestRunHookPassesEnvironment(t *testing.T) {
+	requireShell(t)
+	out := filepath.Join(t.TempDir(), "out")
+	hooks := HooksConfig{PostRestore: []string{
+		`echo "$DOTSYNC_HOOK" > ` + out,
+		`echo "$DOTSYNC_FILES" >> ` + out,
+	}}
+	assert.NoError(t, runHook(hooks, HookPostRestore, "DOTSYNC_FILES=~/.vimrc"))
+	content, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "post-restore\n~/.vimrc\n", string(content))
+	// Other hooks have no commands
+	assert.NoError(t, runHook(hooks, HookPrePush))
+}
+
+func TestRunOnChange(t *testing.T) {
+	requireShell(t)
+	out := filepath.Join(t.TempDir(), "out")
+	entry := FileEntry{
+		Path:     "/home/user/.tmux.conf",
+		OnChange: `echo "$DOTSYNC_FILE $DOTSYNC_OLD_HASH $DOTSYNC_NEW_HASH" > ` + out,
+	}
+	assert.NoError(t, runOnChange(HooksConfig{}, entry, "", "abc"))
+	content, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "/home/user/.tmux.conf  abc\n", string(content))
+	assert.NoError(t, runOnChange(HooksConfig{}, FileEntry{Path: "/home/user/.vimrc"}, "", "abc"))
+}
+
+func TestHookFailurePolicy(t *testing.T) {
+	requireShell(t)
+	hooks := HooksConfig{PrePush: []string{"exit 3"}}
+	assert.ErrorIs(t, runHook(hooks, HookPrePush), ErrHookFailed)
+	hooks.OnFailure = HookWarn
+	assert.NoError(t, runHook(hooks, HookPrePush))
+
+	assert.NoError(t, HookWarn.Validate())
+	assert.ErrorIs(t, HookFailurePolicy("ignore").Validate(), ErrInvalidHookPolicy)
+}
+
+func TestHookTimeout(t *testing.T) {
+	requireShell(t)
+	hooks := HooksConfig{PrePush: []string{"sleep 5"}, Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	err := runHook(hooks, HookPrePush)
+	assert.ErrorIs(t, err, ErrHookFailed)
+	assert.True(t, strings.Contains(err.Error(), "timed out"))
+	assert.Less(t, time.Since(start), 4*time.Second)
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package dotsync
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	// A negative pid signals the whole group
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,160 @@
+package dotsync
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+# Journal
+A sync replaces blobs and the index in the sync directory. To survive a crash
+halfway through, the changes are made in three steps
+
+1. New blobs and the new index are written to a staging directory
+2. The journal, listing the staged blobs and the blobs to remove, is written
+   atomically. This is the commit point of the sync
+3. Staged blobs and the index are renamed into place, old blobs are removed,
+   then the journal and the staging directory are removed
+
+Changing the recipients, see recipients.go, also replaces files in the root of
+the repository, which is above the sync directory with a subdir. They are
+staged in the root directory of the staging directory.
+
+Every step of applying a journal can be repeated. On startup an existing
+journal means that a sync was interrupted after its commit point, the journal
+is applied again to roll it forward. A staging directory without a journal
+means that the sync was interrupted before its commit point, the staged files
+are removed to roll it back.
+*/
+
+const (
+	JournalFileName = ".journal"
+	StagingDirName  = ".staging"
+	stagingRootName = ".root"
+)
+
+type journal struct {
+	Started time.Time `json:"started"`
+	// Hashes of the staged blobs to move into the sync directory
+	Copy []string `json:"copy"`
+	// Hashes of the blobs to remove from the sync directory
+	Remove []string `json:"remove"`
+	// Names of the staged files to move into the root of the repository
+	Root []string `json:"root,omitempty"`
+	// Names of the files to remove from the root of the repository
+	RemoveRoot []string `json:"removeRoot,omitempty"`
+	// The root of the repository relative to the sync directory
+	RootDir string `json:"rootDir,omitempty"`
+}
+
+func newJournal(copy, cleanup map[string]FileInfo) *journal {
+	j := &journal{
+		Started: now(),
+		Copy:    []string{},
+		Remove:  []string{},
+	}
+	for k := range copy {
+		j.Copy = append(j.Copy, k)
+	}
+	for k := range cleanup {
+		j.Remove = append(j.Remove, k)
+	}
+	sort.Strings(j.Copy)
+	sort.Strings(j.Remove)
+	return j
+}
+
+func (j *journal) write(configPath string) error {
+	bytes, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(configPath, JournalFileName), bytes, 0644)
+}
+
+// Moves the staged files into place and removes the old blobs. The index is
+// moved after the blobs it refers to and before the blobs it no longer refers to
+func (j *journal) apply(configPath string) error {
+	stagingPath := filepath.Join(configPath, StagingDirName)
+	for _, k := range j.Copy {
+		err := renameIfExists(filepath.Join(stagingPath, k), filepath.Join(configPath, k))
+		if err != nil {
+			return err
+		}
+	}
+	err := renameIfExists(filepath.Join(stagingPath, IndexFileName), filepath.Join(configPath, IndexFileName))
+	if err != nil {
+		return err
+	}
+	for _, name := range j.Root {
+		err := renameIfExists(filepath.Join(stagingPath, stagingRootName, name), filepath.Join(configPath, j.RootDir, name))
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range j.RemoveRoot {
+		err := aferoFs.Remove(filepath.Join(configPath, j.RootDir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	syncDir(configPath)
+	for _, k := range j.Remove {
+		err := aferoFs.Remove(filepath.Join(configPath, k))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err = aferoFs.Remove(filepath.Join(configPath, JournalFileName)); err != nil {
+		return err
+	}
+	return aferoFs.RemoveAll(stagingPath)
+}
+
+// A missing source means that the file was already moved by an earlier attempt
+func renameIfExists(source, destination string) error {
+	err := aferoFs.Rename(source, destination)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Brings the sync directory back to a consistent state after an interrupted
+// sync. The sync is rolled forward if it got past its commit point and rolled
+// back otherwise. Does nothing if the last sync finished
+func RecoverSync(configPath string) error {
+	journalPath := filepath.Join(configPath, JournalFileName)
+	stagingPath := filepath.Join(configPath, StagingDirName)
+
+	bytes, err := aferoFs.ReadFile(journalPath)
+	if errors.Is(err, os.ErrNotExist) {
+		exists, err := aferoFs.DirExists(stagingPath)
+		if err != nil || !exists {
+			return err
+		}
+		log.WithField("path", stagingPath).Warning("Rolling back interrupted sync")
+		return aferoFs.RemoveAll(stagingPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	j := &journal{}
+	if err = json.Unmarshal(bytes, j); err != nil {
+		// The journal is written atomically, this is not one of ours
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		"started": j.Started,
+		"copy":    len(j.Copy),
+		"remove":  len(j.Remove),
+	}).Warning("Rolling forward interrupted sync")
+	return j.apply(configPath)
+}
@@ -0,0 +1,113 @@
+package dotsync
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertExists(t *testing.T, path string, expected bool) {
+	exists, err := aferoFs.Exists(path)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, exists, path)
+}
+
+func TestCopyAndCleanupLeavesNoJournal(t *testing.T) {
+	_, newFiles := initalise()
+	index := InitialiseIndex(syncConfigWith(newFiles...))
+	index.ParseIndexFile(dotsyncPath)
+	newIndex, err := index.CopyAndCleanup(syncConfigWith(newFiles...))
+	assert.NoError(t, err)
+	for k := range newIndex {
+		assertExists(t, filepath.Join(dotsyncPath, k), true)
+	}
+	assert.Equal(t, newIndex, readIndexFile(dotsyncPath))
+	assertExists(t, filepath.Join(dotsyncPath, JournalFileName), false)
+	assertExists(t, filepath.Join(dotsyncPath, StagingDirName), false)
+}
+
+func TestCancelledCopyLeavesIndex(t *testing.T) {
+	_, newFiles := initalise()
+	syncConfig := syncConfigWith(newFiles...)
+	index := InitialiseIndex(syncConfig)
+	index.ParseIndexFile(dotsyncPath)
+	before := readIndexFile(dotsyncPath)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	syncConfig.Context = ctx
+	_, err := index.CopyAndCleanup(syncConfig)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, before, readIndexFile(dotsyncPath))
+	for k := range index.New {
+		_, synced := before[k]
+		assertExists(t, filepath.Join(dotsyncPath, k), synced)
+	}
+	assertExists(t, filepath.Join(dotsyncPath, JournalFileName), false)
+
+	// The next sync cleans up after it
+	assert.NoError(t, RecoverSync(dotsyncPath))
+	assertExists(t, filepath.Join(dotsyncPath, StagingDirName), false)
+}
+
+// Simulates a crash right after the journal was written
+func stageInterruptedSync(t *testing.T, newFiles []string, withJournal bool) (map[string]FileInfo, map[string]FileInfo) {
+	oldIndex := InitialiseIndex(syncConfigWith(newFiles[:1]...))
+	old := oldIndex.New
+	assert.NoError(t, oldIndex.copyFiles(context.Background(), dotsyncPath, old, nil, noProgress{}))
+	assert.NoError(t, writeIndexFile(dotsyncPath, old))
+
+	stagedIndex := InitialiseIndex(syncConfigWith(newFiles[1:]...))
+	staged := stagedIndex.New
+	stagingPath := filepath.Join(dotsyncPath, StagingDirName)
+	assert.NoError(t, aferoFs.MkdirAll(stagingPath, 0755))
+	assert.NoError(t, stagedIndex.copyFiles(context.Background(), stagingPath, staged, nil, noProgress{}))
+	assert.NoError(t, writeIndexFile(stagingPath, staged))
+	if withJournal {
+		assert.NoError(t, newJournal(staged, old).write(dotsyncPath))
+	}
+	return old, staged
+}
+
+func TestRecoverRollsForward(t *testing.T) {
+	_, newFiles := initalise()
+	old, staged := stageInterruptedSync(t, newFiles, true)
+	// Pretend one blob was already moved before the crash
+	for k := range staged {
+		err := aferoFs.Rename(filepath.Join(dotsyncPath, StagingDirName, k), filepath.Join(dotsyncPath, k))
+		assert.NoError(t, err)
+		break
+	}
+
+	assert.NoError(t, RecoverSync(dotsyncPath))
+	for k := range staged {
+		assertExists(t, filepath.Join(dotsyncPath, k), true)
+	}
+	for k := range old {
+		assertExists(t, filepath.Join(dotsyncPath, k), false)
+	}
+	assert.Equal(t, staged, readIndexFile(dotsyncPath))
+	assertExists(t, filepath.Join(dotsyncPath, JournalFileName), false)
+	assertExists(t, filepath.Join(dotsyncPath, StagingDirName), false)
+}
+
+func TestRecoverRollsBack(t *testing.T) {
+	_, newFiles := initalise()
+	old, staged := stageInterruptedSync(t, newFiles, false)
+
+	assert.NoError(t, RecoverSync(dotsyncPath))
+	for k := range staged {
+		assertExists(t, filepath.Join(dotsyncPath, k), false)
+	}
+	for k := range old {
+		assertExists(t, filepath.Join(dotsyncPath, k), true)
+	}
+	assert.Equal(t, old, readIndexFile(dotsyncPath))
+	assertExists(t, filepath.Join(dotsyncPath, StagingDirName), false)
+}
+
+func TestRecoverWithoutInterruptedSync(t *testing.T) {
+	initalise()
+	assert.NoError(t, RecoverSync(dotsyncPath))
+}
@@ -0,0 +1,160 @@
+package dotsync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+# Locking
+Every operation that mutates the sync directory holds an advisory lock on a
+lock file next to it, the path of the sync directory with .lock appended.
+Syncs of different sync directories don't block each other. The file is kept
+out of the sync directory, where resetting the git worktree would delete it.
+The lock is taken with flock, so the kernel releases it when the owning
+process dies. The owner writes its PID, hostname and the time
+it took the lock into the file so that other invocations can tell the user who
+is holding it. A lock file with an owner recorded but without anyone holding
+the lock was left behind by a process that didn't exit cleanly, it is stale and
+simply taken over.
+
+The lock file is never removed, removing it while another process waits on it
+would let two processes believe they hold the lock.
+*/
+
+const (
+	LockFileSuffix   = ".lock"
+	lockPollInterval = 100 * time.Millisecond
+)
+
+var ErrLocked = errors.New("sync directory is locked")
+
+// Process holding the lock
+type LockOwner struct {
+	PID      int
+	Hostname string
+	Acquired time.Time
+}
+
+type Lock struct {
+	file *os.File
+}
+
+// Takes the lock file at lockPath. Waits up to wait for another process to
+// release it, returns ErrLocked describing the owner if it doesn't
+func AcquireLock(lockPath string, wait time.Duration) (*Lock, error) {
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err = tryLockFile(file)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errWouldBlock) {
+			file.Close()
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			owner := readLockOwner(file)
+			file.Close()
+			return nil, fmt.Errorf("%w by pid %d on %s since %s (%s)", ErrLocked,
+				owner.PID, owner.Hostname, owner.Acquired.Format(time.RFC3339), lockPath)
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	if owner := readLockOwner(file); owner.PID != 0 {
+		log.WithFields(logrus.Fields{
+			"pid":      owner.PID,
+			"hostname": owner.Hostname,
+			"acquired": owner.Acquired,
+		}).Warning("Taking over stale lock")
+	}
+	lock := &Lock{file: file}
+	if err = lock.writeOwner(); err != nil {
+		lock.Release()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Clears the owner and releases the lock
+func (l *Lock) Release() error {
+	defer l.file.Close()
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	return unlockFile(l.file)
+}
+
+func (l *Lock) writeOwner() error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	if err = l.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = l.file.Seek(0, 0); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(l.file, "%d\n%s\n%s\n", os.Getpid(), hostname, now().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Reads the owner recorded in the lock file. Missing or malformed fields are
+// left empty, the owner is only used for reporting
+func readLockOwner(file *os.File) LockOwner {
+	owner := LockOwner{}
+	if _, err := file.Seek(0, 0); err != nil {
+		return owner
+	}
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) < 3 {
+		return owner
+	}
+	owner.PID, _ = strconv.Atoi(lines[0])
+	owner.Hostname = lines[1]
+	owner.Acquired, _ = time.Parse(time.RFC3339, lines[2])
+	return owner
+}
+
+// Lock file of the sync directory, next to it
+func (s *SyncConfig) lockPath() string {
+	return filepath.Clean(s.Path) + LockFileSuffix
+}
+
+// Runs f while holding the lock on the sync directory
+func withLock(syncConfig SyncConfig, wait time.Duration, f func() error) error {
+	lock, err := AcquireLock(syncConfig.lockPath(), wait)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Release(); err != nil {
+			log.Error("Failed to release lock ", err)
+		}
+	}()
+	return f()
+}
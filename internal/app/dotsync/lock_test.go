@@ -0,0 +1,70 @@
+package dotsync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockIsExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sync.lock")
+	lock, err := AcquireLock(path, 0)
+	assert.NoError(t, err)
+
+	_, err = AcquireLock(path, 200*time.Millisecond)
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.Contains(t, err.Error(), fmt.Sprintf("pid %d", os.Getpid()))
+
+	assert.NoError(t, lock.Release())
+	lock, err = AcquireLock(path, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Release())
+}
+
+func TestLockWaitsForRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sync.lock")
+	lock, err := AcquireLock(path, 0)
+	assert.NoError(t, err)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		lock.Release()
+	}()
+	second, err := AcquireLock(path, 5*time.Second)
+	assert.NoError(t, err)
+	assert.NoError(t, second.Release())
+}
+
+func TestLockTakesOverStaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sync.lock")
+	// Owner recorded by a process that died without releasing the lock
+	stale := fmt.Sprintf("99999999\nelsewhere\n%s\n", time.Now().Format(time.RFC3339))
+	err := os.WriteFile(path, []byte(stale), 0644)
+	assert.NoError(t, err)
+
+	lock, err := AcquireLock(path, 0)
+	assert.NoError(t, err)
+	owner := readLockOwner(lock.file)
+	assert.Equal(t, os.Getpid(), owner.PID)
+	assert.NoError(t, lock.Release())
+}
+
+func TestLockIsKeptNextToSyncDirectory(t *testing.T) {
+	dir := t.TempDir()
+	syncConfig := SyncConfig{Path: filepath.Join(dir, DotSyncPath)}
+	other := SyncConfig{Path: filepath.Join(dir, "other")}
+	err := withLock(syncConfig, 0, func() error {
+		if _, err := os.Stat(filepath.Join(dir, DotSyncPath+LockFileSuffix)); err != nil {
+			return err
+		}
+		// Another sync directory has its own lock
+		return withLock(other, 0, func() error { return nil })
+	})
+	assert.NoError(t, err)
+	// Resetting the worktree can't delete it
+	_, err = os.Stat(filepath.Join(syncConfig.Path, DotSyncPath+LockFileSuffix))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,77 @@
+package dotsync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// A commit of the sync repository
+type LogEntry struct {
+	Hash    string    `json:"hash"`
+	Author  string    `json:"author"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Returns the last n commits from HEAD, newest first. All of them when n is 0
+func (r *repository) history(n int) ([]LogEntry, error) {
+	entries := []LogEntry{}
+	if r.headCommit().IsZero() {
+		return entries, nil
+	}
+	commits, err := r.Repo.Log(&git.LogOptions{})
+	if err != nil {
+		return nil, err
+	}
+	err = commits.ForEach(func(c *object.Commit) error {
+		if n > 0 && len(entries) == n {
+			return storer.ErrStop
+		}
+		entries = append(entries, LogEntry{
+			Hash:    c.Hash.String(),
+			Author:  c.Author.Name,
+			Time:    c.Author.When,
+			Message: strings.TrimSpace(c.Message),
+		})
+		return nil
+	})
+	if err != nil && !errors.Is(err, storer.ErrStop) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Prints the last n syncs recorded in the repository
+func Log(n int, opts Options) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		log.WithField("path", getConfigPath()).Error("Failed to open config file. Error: ", err)
+		exitWith(opts, LogResult{Commits: []LogEntry{}, Error: resultError(CodeConfig, err)}, err)
+	}
+	entries, err := readHistory(syncConfig, n)
+	if err != nil {
+		log.Error("Failed to read history ", err)
+		exitWith(opts, LogResult{Commits: []LogEntry{}, Error: resultError(CodeFailed, err)}, err)
+	}
+	if opts.Output == OutputJSON {
+		printJSON(LogResult{Commits: entries}, nil)
+		return
+	}
+	for _, e := range entries {
+		fmt.Printf("%s %s %s\n", e.Hash[:7], e.Time.Format("2006-01-02 15:04"), e.Message)
+	}
+}
+
+func readHistory(syncConfig SyncConfig, n int) ([]LogEntry, error) {
+	repository, err := NewRepository(syncConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+	return repository.history(n)
+}
@@ -0,0 +1,41 @@
+package dotsync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	repo, err := git.PlainInit(t.TempDir(), false)
+	assert.NoError(t, err)
+	r := &repository{Repo: repo}
+	entries, err := r.history(0)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	worktree, err := repo.Worktree()
+	assert.NoError(t, err)
+	when := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, message := range []string{"synced 1, removed 0 files", "synced 2, removed 1 files"} {
+		_, err = worktree.Commit(message+"\n", &git.CommitOptions{
+			Author: &object.Signature{Name: "dotsync", When: when},
+		})
+		assert.NoError(t, err)
+	}
+
+	entries, err = r.history(0)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "synced 2, removed 1 files", entries[0].Message)
+	assert.Equal(t, "dotsync", entries[0].Author)
+	assert.Equal(t, r.headCommit().String(), entries[0].Hash)
+	assert.True(t, when.Equal(entries[0].Time))
+
+	entries, err = r.history(1)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
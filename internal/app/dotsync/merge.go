@@ -0,0 +1,457 @@
+package dotsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+# Merge
+A file changed both locally and on the remote since the last sync is merged
+line by line, with the version of the last sync as the base. The base is read
+from the sync directory, or from the commit the sync directory was at before
+the pull when the pull already removed it.
+
+Changes to different parts of the file are merged and written like any other
+restore. Changes to the same lines conflict. Conflicts are either written to
+the file between markers like git does, or the file is left alone and the
+remote version is written next to it with the .dotsync-conflict suffix.
+Templates always get a copy, markers would break the rendering. So do binary
+files and files without a base version.
+
+Conflicts are recorded in the local state. A conflict is resolved once the
+markers are gone from the file, or the copy has been removed. Until then the
+file is neither restored nor pushed.
+*/
+
+type ConflictStyle string
+
+const (
+	// Write conflicting hunks between markers to the file
+	ConflictMarkers ConflictStyle = "markers"
+	// Leave the file alone and write the remote version next to it
+	ConflictCopy ConflictStyle = "copy"
+
+	ConflictSuffix = ".dotsync-conflict"
+)
+
+const (
+	markerLocal  = "<<<<<<< local\n"
+	markerSep    = "=======\n"
+	markerRemote = ">>>>>>> remote\n"
+)
+
+var ErrInvalidConflictStyle = errors.New("invalid conflict style")
+
+func (c ConflictStyle) Validate() error {
+	switch c {
+	case "", ConflictMarkers, ConflictCopy:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidConflictStyle, c)
+}
+
+// Returns the conflict style of a file, falling back on the global style
+func (s *SyncConfig) ConflictStyle(f FileEntry) ConflictStyle {
+	if f.Conflict != "" {
+		return f.Conflict
+	}
+	if s.Conflict != "" {
+		return s.Conflict
+	}
+	return ConflictMarkers
+}
+
+// A file waiting for its conflicting changes to be resolved
+type conflictState struct {
+	// The local file with the markers, or the file next to the copy
+	File string `json:"file"`
+	Copy string `json:"copy,omitempty"`
+	// Hashes of the three versions that were merged
+	Base   string    `json:"base"`
+	Local  string    `json:"local"`
+	Remote string    `json:"remote"`
+	Time   time.Time `json:"time"`
+}
+
+func (c conflictState) resolved() bool {
+	if c.Copy != "" {
+		exists, _ := aferoFs.Exists(c.Copy)
+		return !exists
+	}
+	content, err := aferoFs.ReadFile(c.File)
+	return err != nil || !hasConflictMarkers(content)
+}
+
+func hasConflictMarkers(content []byte) bool {
+	for _, line := range splitLines(content) {
+		if strings.HasPrefix(line, markerLocal[:8]) || strings.HasPrefix(line, markerRemote[:8]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports if the file has an unresolved conflict. Resolved conflicts are
+// removed from the state
+func (s *localState) holdConflict(id string) (bool, error) {
+	conflict, ok := s.Conflicts[id]
+	if !ok {
+		return false, nil
+	}
+	if !conflict.resolved() {
+		return true, nil
+	}
+	log.WithField("file", conflict.File).Info("Conflict resolved")
+	s.clearConflict(id)
+	return false, s.write(statePath())
+}
+
+// Keeps the synced version of files with unresolved conflicts, so the
+// markers are never pushed. Resolved conflicts are cleared from the state
+func (index *Indexes) holdConflicts(state *localState) error {
+	for id := range state.Conflicts {
+		held, err := state.holdConflict(id)
+		if err != nil {
+			return err
+		}
+		if !held {
+			continue
+		}
+		log.WithField("file", id).Warning("File has an unresolved conflict, not pushing")
+		index.keepSynced(id)
+	}
+	return nil
+}
+
+// Replaces the local version of the file with its synced version
+func (index *Indexes) keepSynced(id string) {
+	for hash, info := range index.New {
+		if info.Path == id {
+			delete(index.New, hash)
+		}
+	}
+	for hash, info := range index.Current {
+		if info.Path == id {
+			index.New[hash] = info
+		}
+	}
+}
+
+// Earlier versions of the sync directory
+type blobHistory interface {
+	blobAt(hash string) ([]byte, error)
+}
+
+// Only files changed on both sides since the last sync need a merge. Files
+// added on both sides have no base, they always conflict
+func shouldMerge(policy PullPolicy, local, base, remote string) bool {
+	return policy == PullMerge && local != "" &&
+		local != base && remote != base && local != remote
+}
+
+type fileMerge struct {
+	syncConfig SyncConfig
+	info       FileInfo
+	entry      FileEntry
+	base       string
+	remote     string
+	cipher     *blobCipher
+	history    blobHistory
+	secrets    map[string]string
+}
+
+func (m fileMerge) readBase() ([]byte, error) {
+	if m.base == "" {
+		return nil, errors.New("file was added on both sides")
+	}
+	return readSyncedBlob(m.syncConfig, m.cipher, m.history, m.base)
+}
+
+// Reads a blob from the sync directory, or from the history if it has been
+// removed since
+func readSyncedBlob(syncConfig SyncConfig, cipher *blobCipher, history blobHistory, hash string) ([]byte, error) {
+	blob, err := aferoFs.ReadFile(filepath.Join(syncConfig.IndexDir(), hash))
+	if errors.Is(err, os.ErrNotExist) && history != nil {
+		blob, err = history.blobAt(hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cipher.decode(hash, blob)
+}
+
+// Merges the local and remote changes and writes the result. Returns the
+// hash of the merged content, empty if it couldn't be merged cleanly
+func (m fileMerge) apply(backup *backup, state *localState) (string, error) {
+	fields := logrus.Fields{"file": m.info.Path}
+	remote, err := readBlob(m.syncConfig.IndexDir(), m.remote, m.cipher)
+	if err != nil {
+		return "", err
+	}
+	local, err := aferoFs.ReadFile(m.entry.sourcePath())
+	if err != nil {
+		return "", err
+	}
+	secrets := m.secrets
+	if len(m.entry.Filters) > 0 {
+		var localSecrets map[string]string
+		if local, localSecrets, err = cleanContent(local, m.entry.Filters); err != nil {
+			return "", err
+		}
+		// The local file has the latest secrets
+		secrets = map[string]string{}
+		for k, v := range m.secrets {
+			secrets[k] = v
+		}
+		for k, v := range localSecrets {
+			secrets[k] = v
+		}
+	}
+	localHash, err := m.cipher.contentHash(m.entry.Encrypt, local)
+	if err != nil {
+		return "", err
+	}
+	conflict := conflictState{
+		File:   m.entry.sourcePath(),
+		Base:   m.base,
+		Local:  localHash,
+		Remote: m.remote,
+		Time:   now(),
+	}
+	// Without a base or with binary content both versions are kept
+	base, err := m.readBase()
+	if err != nil || isBinary(base) || isBinary(local) || isBinary(remote) {
+		if err != nil {
+			log.WithFields(fields).Warning("No base version to merge with ", err)
+		}
+		return "", m.conflict(backup, state, conflict, local, remote, nil, secrets, 1)
+	}
+
+	merged, hunks := merge3(base, local, remote)
+	if hunks == 0 {
+		err = backup.write(restoredPaths(m.entry), func() error {
+			return writeContent(m.syncConfig, m.info, m.entry, merged, secrets)
+		})
+		if err != nil {
+			return "", err
+		}
+		log.WithFields(fields).Info("Merged local and remote changes")
+		return m.cipher.contentHash(m.entry.Encrypt, merged)
+	}
+	return "", m.conflict(backup, state, conflict, local, remote, merged, secrets, hunks)
+}
+
+// Writes the conflicting changes and records the conflict. Without merged
+// content, or for templates, the remote version is written as a copy
+func (m fileMerge) conflict(backup *backup, state *localState, conflict conflictState,
+	local, remote, merged []byte, secrets map[string]string, hunks int) error {
+	var err error
+	if merged == nil || m.entry.Template || m.syncConfig.ConflictStyle(m.entry) == ConflictCopy {
+		conflict.Copy = m.entry.sourcePath() + ConflictSuffix
+		if secrets != nil {
+			remote, _ = smudgeContent(remote, secrets)
+		}
+		err = backup.write([]string{conflict.Copy}, func() error {
+			return writeRestored(conflict.Copy, remote, 0600)
+		})
+	} else {
+		err = backup.write(restoredPaths(m.entry), func() error {
+			return writeContent(m.syncConfig, m.info, m.entry, merged, secrets)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	// Markers replace the local version, keep it for resolving the conflict
+	if err = storeConflictVersion(conflict.Local, local); err != nil {
+		return err
+	}
+	state.Conflicts[m.info.Path] = conflict
+	if err = state.write(statePath()); err != nil {
+		return err
+	}
+	fields := logrus.Fields{"file": m.info.Path, "hunks": hunks}
+	if conflict.Copy != "" {
+		fields["copy"] = conflict.Copy
+	}
+	log.WithFields(fields).Warning("Local and remote changes conflict, resolve them and push")
+	return nil
+}
+
+func isBinary(content []byte) bool {
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// Maps every line of a to the line of b it is kept as, -1 for removed lines
+func matchLines(a, b []string) []int {
+	matches := make([]int, len(a))
+	i, j := 0, 0
+	for _, edit := range diffLines(a, b) {
+		switch edit.Op {
+		case opEqual:
+			matches[i] = j
+			i++
+			j++
+		case opDelete:
+			matches[i] = -1
+			i++
+		case opInsert:
+			j++
+		}
+	}
+	return matches
+}
+
+// A stretch of merged lines. Hunks without a conflict hold the merged lines,
+// conflicting hunks the lines of every version
+type Hunk struct {
+	Lines    []string
+	Conflict bool
+	Base     []string
+	Local    []string
+	Remote   []string
+}
+
+// How a conflicting hunk is resolved
+type HunkChoice int
+
+const (
+	HunkUnresolved HunkChoice = iota
+	HunkLocal
+	HunkRemote
+	// The local lines followed by the remote lines
+	HunkBoth
+)
+
+// Three way merge of the lines of local and remote. Stretches of the base
+// kept by both sides are stable, between them a side that changed wins over
+// a side that didn't. When both changed the same stretch differently the
+// hunk conflicts
+func mergeHunks(base, local, remote []byte) []Hunk {
+	o, a, b := splitLines(base), splitLines(local), splitLines(remote)
+	ma, mb := matchLines(o, a), matchLines(o, b)
+	hunks := []Hunk{}
+	merged := func(lines []string) {
+		if len(lines) == 0 {
+			return
+		}
+		if n := len(hunks); n > 0 && !hunks[n-1].Conflict {
+			hunks[n-1].Lines = append(hunks[n-1].Lines, lines...)
+			return
+		}
+		hunks = append(hunks, Hunk{Lines: append([]string{}, lines...)})
+	}
+	i, x, y := 0, 0, 0
+	for i < len(o) || x < len(a) || y < len(b) {
+		k := 0
+		for i+k < len(o) && ma[i+k] == x+k && mb[i+k] == y+k {
+			k++
+		}
+		if k > 0 {
+			merged(o[i : i+k])
+			i, x, y = i+k, x+k, y+k
+			continue
+		}
+		// Find the next base line both sides kept
+		j := i
+		for j < len(o) && (ma[j] < 0 || mb[j] < 0) {
+			j++
+		}
+		xEnd, yEnd := len(a), len(b)
+		if j < len(o) {
+			xEnd, yEnd = ma[j], mb[j]
+		}
+		oHunk, aHunk, bHunk := o[i:j], a[x:xEnd], b[y:yEnd]
+		switch {
+		case equalLines(aHunk, oHunk):
+			merged(bHunk)
+		case equalLines(bHunk, oHunk), equalLines(aHunk, bHunk):
+			merged(aHunk)
+		default:
+			hunks = append(hunks, Hunk{Conflict: true, Base: oHunk, Local: aHunk, Remote: bHunk})
+		}
+		i, x, y = j, xEnd, yEnd
+	}
+	return hunks
+}
+
+// Returns the merged content and the number of conflicts, conflicts are
+// written between markers
+func merge3(base, local, remote []byte) ([]byte, int) {
+	hunks := mergeHunks(base, local, remote)
+	conflicts := 0
+	for _, hunk := range hunks {
+		if hunk.Conflict {
+			conflicts++
+		}
+	}
+	return ResolveHunks(hunks, nil), conflicts
+}
+
+// Joins the hunks, resolving the conflicting hunks in order with the
+// choices. Conflicts without a choice are written between markers
+func ResolveHunks(hunks []Hunk, choices []HunkChoice) []byte {
+	var out bytes.Buffer
+	conflict := 0
+	for _, hunk := range hunks {
+		if !hunk.Conflict {
+			writeLines(&out, hunk.Lines)
+			continue
+		}
+		choice := HunkUnresolved
+		if conflict < len(choices) {
+			choice = choices[conflict]
+		}
+		conflict++
+		switch choice {
+		case HunkLocal:
+			writeLines(&out, hunk.Local)
+		case HunkRemote:
+			writeLines(&out, hunk.Remote)
+		case HunkBoth:
+			writeHunkLines(&out, hunk.Local)
+			writeLines(&out, hunk.Remote)
+		default:
+			out.WriteString(markerLocal)
+			writeHunkLines(&out, hunk.Local)
+			out.WriteString(markerSep)
+			writeHunkLines(&out, hunk.Remote)
+			out.WriteString(markerRemote)
+		}
+	}
+	return out.Bytes()
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLines(out *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		out.WriteString(line)
+	}
+}
+
+// Markers have to start on a line of their own
+func writeHunkLines(out *bytes.Buffer, lines []string) {
+	writeLines(out, lines)
+	if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+		out.WriteByte('\n')
+	}
+}
@@ -0,0 +1,143 @@
+package dotsync
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const mergeBase = "one\ntwo\nthree\nfour\nfive\n"
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name, local, remote, merged string
+		conflicts                   int
+	}{
+		{"separate lines", "ONE\ntwo\nthree\nfour\nfive\n", "one\ntwo\nthree\nfour\nFIVE\n",
+			"ONE\ntwo\nthree\nfour\nFIVE\n", 0},
+		{"insert and delete", "one\ntwo\nthree\nthree and a half\nfour\nfive\n", "two\nthree\nfour\nfive\n",
+			"two\nthree\nthree and a half\nfour\nfive\n", 0},
+		{"same change", "one\n2\nthree\nfour\nfive\n", "one\n2\nthree\nfour\nfive\n",
+			"one\n2\nthree\nfour\nfive\n", 0},
+		{"append on both sides", mergeBase + "local", mergeBase + "remote\n",
+			mergeBase + "<<<<<<< local\nlocal\n=======\nremote\n>>>>>>> remote\n", 1},
+		{"same line", "one\nTWO\nthree\nfour\nfive\n", "one\nzwei\nthree\nfour\nfive\n",
+			"one\n<<<<<<< local\nTWO\n=======\nzwei\n>>>>>>> remote\nthree\nfour\nfive\n", 1},
+	}
+	for _, test := range tests {
+		merged, conflicts := merge3([]byte(mergeBase), []byte(test.local), []byte(test.remote))
+		assert.Equal(t, test.merged, string(merged), test.name)
+		assert.Equal(t, test.conflicts, conflicts, test.name)
+	}
+}
+
+func TestMerge3ConflictsPastMaxEdits(t *testing.T) {
+	base := strings.Join(numberedLines(2*maxDiffEdits, false), "")
+	local := strings.Join(numberedLines(2*maxDiffEdits, true), "")
+	remote := "first\n" + base
+	_, conflicts := merge3([]byte(base), []byte(local), []byte(remote))
+	assert.Equal(t, 1, conflicts)
+}
+
+type mapHistory map[string][]byte
+
+func (h mapHistory) blobAt(hash string) ([]byte, error) {
+	if blob, ok := h[hash]; ok {
+		return blob, nil
+	}
+	return nil, errors.New("not found")
+}
+
+// Sets up a file changed locally and on the remote. The base blob is only in
+// the history, like after a pull removed it
+func setupMerge(t *testing.T, local, remote string) (string, map[string]FileInfo, map[string]FileInfo, mapHistory) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	path := filepath.Join(otherPath, "rc")
+	assert.NoError(t, aferoFs.MkdirAll(dotsyncPath, 0755))
+	assert.NoError(t, aferoFs.WriteFile(path, []byte(local), 0644))
+	baseHash, remoteHash := sha1Hash([]byte(mergeBase)), sha1Hash([]byte(remote))
+	assert.NoError(t, aferoFs.WriteFile(filepath.Join(dotsyncPath, remoteHash), []byte(remote), 0666))
+	base := map[string]FileInfo{baseHash: {Path: path, Perm: 0644}}
+	synced := map[string]FileInfo{remoteHash: {Path: path, Perm: 0644}}
+	return path, base, synced, mapHistory{baseHash: []byte(mergeBase)}
+}
+
+func TestRestoreMergesChanges(t *testing.T) {
+	path, base, remote, history := setupMerge(t, "ONE\ntwo\nthree\nfour\nfive\n", "one\ntwo\nthree\nfour\nFIVE\n")
+	restored, err := restoreFiles(syncConfigWith(path), base, remote, history)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path}, restored)
+	content, _ := aferoFs.ReadFile(path)
+	assert.Equal(t, "ONE\ntwo\nthree\nfour\nFIVE\n", string(content))
+
+	// Without a base the remote version is written next to the file
+	path, base, remote, _ = setupMerge(t, "ONE\ntwo\nthree\nfour\nfive\n", "one\ntwo\nthree\nfour\nFIVE\n")
+	restored, err = restoreFiles(syncConfigWith(path), base, remote, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, restored)
+	content, _ = aferoFs.ReadFile(path + ConflictSuffix)
+	assert.Equal(t, "one\ntwo\nthree\nfour\nFIVE\n", string(content))
+}
+
+func TestRestoreConflictMarkers(t *testing.T) {
+	path, base, remote, history := setupMerge(t, "one\nTWO\nthree\nfour\nfive\n", "one\nzwei\nthree\nfour\nfive\n")
+	syncConfig := syncConfigWith(path)
+	restored, err := restoreFiles(syncConfig, base, remote, history)
+	assert.NoError(t, err)
+	assert.Empty(t, restored)
+	content, _ := aferoFs.ReadFile(path)
+	assert.True(t, hasConflictMarkers(content))
+
+	statuses, err := statusTracked(syncConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, StateConflict, statuses[0].State)
+
+	// Unresolved files are not pushed
+	assert.NoError(t, writeIndexFile(dotsyncPath, remote))
+	index := InitialiseIndex(syncConfig)
+	index.ParseIndexFile(dotsyncPath)
+	state, err := readState(statePath())
+	assert.NoError(t, err)
+	assert.NoError(t, index.holdConflicts(state))
+	assert.Equal(t, remote, index.New)
+
+	// Resolving the conflict releases the file
+	assert.NoError(t, aferoFs.WriteFile(path, []byte("one\nTWO zwei\nthree\nfour\nfive\n"), 0644))
+	index = InitialiseIndex(syncConfig)
+	index.ParseIndexFile(dotsyncPath)
+	assert.NoError(t, index.holdConflicts(state))
+	assert.NotEqual(t, remote, index.New)
+	assert.Empty(t, state.Conflicts)
+	state, err = readState(statePath())
+	assert.NoError(t, err)
+	assert.Empty(t, state.Conflicts)
+}
+
+func TestRestoreConflictCopy(t *testing.T) {
+	local, theirs := "one\nTWO\nthree\nfour\nfive\n", "one\nzwei\nthree\nfour\nfive\n"
+	path, base, remote, history := setupMerge(t, local, theirs)
+	syncConfig := syncConfigWith(path)
+	syncConfig.Conflict = ConflictCopy
+	_, err := restoreFiles(syncConfig, base, remote, history)
+	assert.NoError(t, err)
+	content, _ := aferoFs.ReadFile(path)
+	assert.Equal(t, local, string(content))
+	content, _ = aferoFs.ReadFile(path + ConflictSuffix)
+	assert.Equal(t, theirs, string(content))
+
+	// The file is left alone until the copy is removed
+	restored, err := restoreFiles(syncConfig, remote, remote, history)
+	assert.NoError(t, err)
+	assert.Empty(t, restored)
+	assert.NoError(t, aferoFs.Remove(path+ConflictSuffix))
+	state, _ := readState(statePath())
+	held, err := state.holdConflict(path)
+	assert.NoError(t, err)
+	assert.False(t, held)
+
+	assert.ErrorIs(t, ConflictStyle("theirs").Validate(), ErrInvalidConflictStyle)
+}
@@ -0,0 +1,329 @@
+package dotsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+# JSON output
+With --output json status, push, pull, sync, diff --stat, log and config show
+print a single JSON document to stdout instead of text, for scripts and
+prompts. Logs still go to stderr. Every document has an error, null when the
+command succeeded, and the command fails exactly when it isn't null, with 130
+when interrupted and 1 otherwise. The schemas are documented in the README,
+fields are only ever added to them. Fields are named in camel case.
+
+The file lists of push, pull and sync are collected from the progress of the
+sync, the hashes are read from the index the sync left behind. The commit and
+whether it was pushed are reported by the push itself once they succeeded,
+a push without changes creates no commit.
+*/
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+var ErrInvalidOutput = errors.New("invalid output format")
+
+// Codes of ResultError
+const (
+	CodeConfig   = "config"
+	CodeLocked   = "locked"
+	CodeHook     = "hook"
+	CodeSecrets  = "secrets"
+	CodeTimeout  = "timeout"
+	CodeCanceled = "canceled"
+	CodeFailed   = "failed"
+)
+
+func ValidateOutput(output string) error {
+	switch output {
+	case "", OutputText, OutputJSON:
+		return nil
+	}
+	return fmt.Errorf("%w: %s, use text or json", ErrInvalidOutput, output)
+}
+
+// Error of a command, with the code it has in JSON output
+type Error struct {
+	Code string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Gives err a code, code is used when there is no more specific one
+func newError(code string, err error) error {
+	var e *Error
+	if err == nil || errors.As(err, &e) {
+		return err
+	}
+	switch {
+	case errors.Is(err, ErrLocked):
+		code = CodeLocked
+	case errors.Is(err, ErrHookFailed):
+		code = CodeHook
+	case errors.Is(err, ErrSecretsFound):
+		code = CodeSecrets
+	case errors.Is(err, ErrTimeout):
+		code = CodeTimeout
+	case errors.Is(err, context.Canceled):
+		code = CodeCanceled
+	}
+	return &Error{Code: code, Err: err}
+}
+
+type ResultError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func resultError(code string, err error) *ResultError {
+	var e *Error
+	if !errors.As(newError(code, err), &e) {
+		return nil
+	}
+	return &ResultError{Code: e.Code, Message: e.Error()}
+}
+
+type StatusResult struct {
+	Files []FileStatus `json:"files"`
+	Error *ResultError `json:"error"`
+}
+
+// A file handled by a push or pull
+type SyncedFile struct {
+	// Identity of the file in the index, see profile.go
+	Path   string     `json:"path"`
+	Result FileResult `json:"result"`
+	// Hash of the file in the index after the sync, empty if it isn't there
+	Hash string `json:"hash"`
+}
+
+type PushResult struct {
+	Files []SyncedFile `json:"files"`
+	// The commit created, empty if nothing changed
+	Commit string       `json:"commit"`
+	Pushed bool         `json:"pushed"`
+	Error  *ResultError `json:"error"`
+}
+
+type PullResult struct {
+	Files []SyncedFile `json:"files"`
+	// The commit the repository is at after the pull
+	Commit string       `json:"commit"`
+	Error  *ResultError `json:"error"`
+}
+
+type SyncResult struct {
+	// The side that changed of every tracked file
+	Changes []FileSync   `json:"changes"`
+	Files   []SyncedFile `json:"files"`
+	// The commit created, empty if nothing changed
+	Commit string       `json:"commit"`
+	Pushed bool         `json:"pushed"`
+	Error  *ResultError `json:"error"`
+}
+
+type DiffStatResult struct {
+	Files []DiffStat   `json:"files"`
+	Error *ResultError `json:"error"`
+}
+
+type LogResult struct {
+	Commits []LogEntry   `json:"commits"`
+	Error   *ResultError `json:"error"`
+}
+
+type ConfigResult struct {
+	// The config as in the config file, with the active profile applied
+	Config map[string]interface{} `json:"config"`
+	Error  *ResultError           `json:"error"`
+}
+
+// Prints the result and exits with 1 if the command failed
+func printJSON(result interface{}, err error) {
+	out, merr := json.MarshalIndent(result, "", "  ")
+	if merr != nil {
+		log.Error("Failed to print result ", merr)
+		os.Exit(1)
+	}
+	fmt.Println(string(out))
+	if err != nil {
+		os.Exit(exitCode(err))
+	}
+}
+
+// Like a shell, 130 when interrupted
+func exitCode(err error) int {
+	if errors.Is(err, context.Canceled) {
+		return 130
+	}
+	return 1
+}
+
+// Prints the result of a failed command as JSON, if that is the output, and exits
+func exitWith(opts Options, result interface{}, err error) {
+	if opts.Output == OutputJSON {
+		printJSON(result, err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// Collects what a push or pull did to every file, passing the progress on
+type resultCollector struct {
+	next    Progress
+	paths   []string
+	results map[string]FileResult
+	// The commit created and if it reached the remote
+	commit string
+	pushed bool
+}
+
+// Told about the commit a push created and its push once they succeeded,
+// which the phases alone don't tell
+type commitReporter interface {
+	committed(hash string)
+	pushedCommit()
+}
+
+func reportCommit(progress Progress, hash string) {
+	if r, ok := progress.(commitReporter); ok {
+		r.committed(hash)
+	}
+}
+
+func reportPushed(progress Progress) {
+	if r, ok := progress.(commitReporter); ok {
+		r.pushedCommit()
+	}
+}
+
+func newResultCollector(next Progress) *resultCollector {
+	if next == nil {
+		next = noProgress{}
+	}
+	return &resultCollector{next: next, results: map[string]FileResult{}}
+}
+
+// Collects the results of the sync on their way to the progress of the options
+func (o *Options) collectResults() *resultCollector {
+	results := newResultCollector(o.Progress)
+	o.Progress = results
+	return results
+}
+
+func (c *resultCollector) Phase(phase Phase, total int) {
+	c.next.Phase(phase, total)
+}
+
+func (c *resultCollector) committed(hash string) {
+	c.commit = hash
+}
+
+func (c *resultCollector) pushedCommit() {
+	c.pushed = true
+}
+
+func (c *resultCollector) File(path string, result FileResult) {
+	c.next.File(path, result)
+	// Staging reports the blobs of the repository, not the files
+	if result == ResultAdded || result == ResultRemoved {
+		return
+	}
+	_, ok := c.results[path]
+	if !ok {
+		c.paths = append(c.paths, path)
+	}
+	// The push of a sync indexes the files the pull restored
+	if ok && result == ResultIndexed {
+		return
+	}
+	c.results[path] = result
+}
+
+func (c *resultCollector) Transfer(message string, final bool) {
+	c.next.Transfer(message, final)
+}
+
+func (c *resultCollector) Done(err error) {
+	c.next.Done(err)
+}
+
+// The last result of every file, with its hash in the index
+func (c *resultCollector) files(syncConfig SyncConfig) []SyncedFile {
+	hashes := map[string]string{}
+	if syncConfig.Path != "" {
+		hashes = hashesByPath(readIndexFile(syncConfig.IndexDir()))
+	}
+	files := []SyncedFile{}
+	for _, path := range c.paths {
+		result := c.results[path]
+		// Indexed and not copied, so it was already synced
+		if result == ResultIndexed {
+			result = ResultUnchanged
+		}
+		files = append(files, SyncedFile{Path: path, Result: result, Hash: hashes[path]})
+	}
+	return files
+}
+
+func (c *resultCollector) push(syncConfig SyncConfig, err error) PushResult {
+	return PushResult{
+		Files:  c.files(syncConfig),
+		Commit: c.commit,
+		Pushed: c.pushed,
+		Error:  resultError(CodeFailed, err),
+	}
+}
+
+func (c *resultCollector) sync(syncConfig SyncConfig, changes []FileSync, err error) SyncResult {
+	push := c.push(syncConfig, err)
+	if changes == nil {
+		changes = []FileSync{}
+	}
+	return SyncResult{
+		Changes: changes,
+		Files:   push.Files,
+		Commit:  push.Commit,
+		Pushed:  push.Pushed,
+		Error:   push.Error,
+	}
+}
+
+func (c *resultCollector) pull(syncConfig SyncConfig, err error) PullResult {
+	return PullResult{
+		Files:  c.files(syncConfig),
+		Commit: repositoryHead(syncConfig),
+		Error:  resultError(CodeFailed, err),
+	}
+}
+
+// Returns the commit HEAD of the sync directory points to, an empty string
+// if there is none
+func repositoryHead(syncConfig SyncConfig) string {
+	var g plainGitOperations = &gitExtension{}
+	if syncConfig.Git != nil {
+		g = gitBackend{syncConfig.Git}
+	}
+	repo, err := g.plainOpen(syncConfig.Path)
+	if err != nil {
+		return ""
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return ""
+	}
+	return head.Hash().String()
+}
@@ -0,0 +1,105 @@
+package dotsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateOutput(t *testing.T) {
+	assert.NoError(t, ValidateOutput(OutputText))
+	assert.NoError(t, ValidateOutput(OutputJSON))
+	assert.ErrorIs(t, ValidateOutput("yaml"), ErrInvalidOutput)
+}
+
+func TestResultError(t *testing.T) {
+	assert.Nil(t, resultError(CodeFailed, nil))
+	assert.Equal(t, &ResultError{Code: CodeConfig, Message: "missing config"},
+		resultError(CodeConfig, ErrMissingConfig))
+	err := fmt.Errorf("%w: held by 42", ErrLocked)
+	assert.Equal(t, CodeLocked, resultError(CodeFailed, err).Code)
+	err = fmt.Errorf("%w: pre-push: exit status 1", ErrHookFailed)
+	assert.Equal(t, CodeHook, resultError(CodeFailed, err).Code)
+}
+
+func TestCollectPushResult(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	content := []byte("set nu\n")
+	hash := sha1Hash(content)
+	assert.NoError(t, aferoFs.MkdirAll(dotsyncPath, 0755))
+	assert.NoError(t, writeIndexFile(dotsyncPath, map[string]FileInfo{
+		hash: {Path: "/home/user/.vimrc", Perm: 0644},
+	}))
+	syncConfig := syncConfigWith()
+
+	c := newResultCollector(nil)
+	c.Phase(PhaseIndexing, 2)
+	c.File("/home/user/.vimrc", ResultIndexed)
+	c.File("/home/user/.bashrc", ResultIndexed)
+	c.Phase(PhaseCopying, 1)
+	c.File("/home/user/.vimrc", ResultCopied)
+	c.Phase(PhaseStaging, 1)
+	c.File("/home/user/.vimrc", ResultAdded)
+	c.Phase(PhaseCommitting, 0)
+	reportCommit(c, "259293be")
+	c.Phase(PhasePushing, 0)
+
+	// Committed, but the push failed
+	result := c.push(syncConfig, fmt.Errorf("failed to push"))
+	assert.Equal(t, "259293be", result.Commit)
+	assert.False(t, result.Pushed)
+	assert.Equal(t, &ResultError{Code: CodeFailed, Message: "failed to push"}, result.Error)
+
+	reportPushed(c)
+	result = c.push(syncConfig, nil)
+	assert.Equal(t, []SyncedFile{
+		{Path: "/home/user/.vimrc", Result: ResultCopied, Hash: hash},
+		{Path: "/home/user/.bashrc", Result: ResultUnchanged},
+	}, result.Files)
+	assert.Equal(t, "259293be", result.Commit)
+	assert.True(t, result.Pushed)
+	assert.Nil(t, result.Error)
+}
+
+func TestPushResultWithoutChanges(t *testing.T) {
+	remote := newRemote(t)
+	m := newMachine(t, remote, ".vimrc")
+	m.write(".vimrc", "set nu\n")
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	push := func() (result PushResult) {
+		assert.NoError(t, m.run(func(syncConfig SyncConfig) (err error) {
+			result, err = Push(context.Background(), Options{Config: &syncConfig, Logger: logger})
+			return err
+		}))
+		return result
+	}
+
+	result := push()
+	assert.Equal(t, remoteHistory(t, remote)[0].Hash, result.Commit)
+	assert.True(t, result.Pushed)
+
+	result = push()
+	out, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"files":[{"path":"~/.vimrc","result":"unchanged","hash":"`+sha1Hash([]byte("set nu\n"))+`"}],
+		"commit":"","pushed":false,"error":null}`, string(out))
+}
+
+func TestResultSchema(t *testing.T) {
+	out, err := json.Marshal(PushResult{Files: []SyncedFile{}})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"files":[],"commit":"","pushed":false,"error":null}`, string(out))
+	out, err = json.Marshal(SyncResult{Changes: []FileSync{{Path: "/a", Change: ChangeLocal}}, Files: []SyncedFile{}})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"changes":[{"path":"/a","change":"local"}],"files":[],"commit":"","pushed":false,"error":null}`, string(out))
+	out, err = json.Marshal(StatusResult{Files: []FileStatus{{Path: "/a", State: StateNew, LocalHash: "ab"}}})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"files":[{"path":"/a","state":"new","syncedHash":"","localHash":"ab"}],"error":null}`, string(out))
+}
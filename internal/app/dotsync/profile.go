@@ -0,0 +1,168 @@
+package dotsync
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+# Profiles
+A profile adjusts the config for a group of machines. The active profile is
+the one given with --profile, else the one named in DOTSYNC_PROFILE, else the
+one named by profile in the config, else the first profile, by name, with a
+host pattern matching the hostname. Without an active profile the config is
+used as it is.
+
+Files are identified by their name, or by their path if they have no name.
+The index records this identity, so a file can live at a different path on
+every machine as long as it has the same name.
+*/
+
+const ProfileEnv = "DOTSYNC_PROFILE"
+
+var (
+	ErrUnknownProfile = errors.New("unknown profile")
+	ErrInvalidSubdir  = errors.New("invalid subdir")
+)
+
+type Profile struct {
+	// Hostname patterns selecting the profile, see path.Match
+	Hosts []string `yaml:"hosts,omitempty"`
+	// Branch of the repository to sync with
+	Branch string `yaml:"branch,omitempty"`
+	// Directory inside the repository holding the files of the profile
+	Subdir string `yaml:"subdir,omitempty"`
+	// Tracked in addition to the files of the config, replacing files with the same name
+	Files []FileEntry `yaml:"files,omitempty"`
+	// Names or paths of files of the config that aren't tracked
+	Exclude []string `yaml:"exclude,omitempty"`
+	// Paths of files of the config, keyed by name
+	Paths map[string]string `yaml:"paths,omitempty"`
+	// Merged into the variables of the config
+	Variables map[string]interface{} `yaml:"variables,omitempty"`
+}
+
+// Picks the active profile, returns an empty name if there is none
+func selectProfile(profiles map[string]Profile, flag, env, config, hostname string) (string, error) {
+	for _, name := range []string{flag, env, config} {
+		if name == "" {
+			continue
+		}
+		if _, ok := profiles[name]; !ok {
+			return "", fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+		}
+		return name, nil
+	}
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, pattern := range profiles[name].Hosts {
+			if ok, _ := path.Match(pattern, hostname); ok {
+				return name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// Applies the active profile to the config
+func (s *SyncConfig) applyProfile(name string) error {
+	profile, ok := s.Profiles[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+	}
+	s.Profile = name
+	if profile.Branch != "" {
+		s.GitConfig.Branch = profile.Branch
+	}
+	if profile.Subdir != "" {
+		s.Subdir = profile.Subdir
+	}
+	if len(profile.Variables) > 0 && s.Variables == nil {
+		s.Variables = make(map[string]interface{})
+	}
+	for k, v := range profile.Variables {
+		s.Variables[k] = v
+	}
+
+	files := []FileEntry{}
+	for _, f := range s.Files {
+		excluded := false
+		for _, e := range profile.Exclude {
+			excluded = excluded || f.Name == e || samePath(f.Path, e)
+		}
+		if excluded {
+			continue
+		}
+		if p, ok := profile.Paths[f.Name]; ok && f.Name != "" {
+			f.Path = p
+		}
+		files = append(files, f)
+	}
+	for _, added := range profile.Files {
+		replaced := false
+		for i, f := range files {
+			if f.ID() == added.ID() {
+				files[i] = added
+				replaced = true
+			}
+		}
+		if !replaced {
+			files = append(files, added)
+		}
+	}
+	s.Files = files
+	return nil
+}
+
+// Directory of the index and the blobs
+func (s *SyncConfig) IndexDir() string {
+	return filepath.Join(s.Path, s.Subdir)
+}
+
+// Path of a file in the index directory relative to the root of the repository
+func (s *SyncConfig) repoPath(k string) string {
+	return filepath.ToSlash(filepath.Join(s.Subdir, k))
+}
+
+// The subdir has to stay inside the repository
+func validSubdir(subdir string) bool {
+	clean := filepath.Clean(subdir)
+	return !filepath.IsAbs(clean) && clean != ".." &&
+		!strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+// Prints the config with the active profile applied
+func ShowConfig(opts Options) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		log.WithField("path", getConfigPath()).Error("Failed to open config file. Error: ", err)
+		exitWith(opts, ConfigResult{Error: resultError(CodeConfig, err)}, err)
+	}
+	// Already applied
+	syncConfig.Profiles = nil
+	bytes, err := yaml.Marshal(syncConfig)
+	if err != nil {
+		log.Error("Failed to show config ", err)
+		exitWith(opts, ConfigResult{Error: resultError(CodeFailed, err)}, err)
+	}
+	if opts.Output != OutputJSON {
+		fmt.Print(string(bytes))
+		return
+	}
+	// The yaml keys are the documented ones, so they are kept
+	result := ConfigResult{}
+	if err = yaml.Unmarshal(bytes, &result.Config); err != nil {
+		result.Error = resultError(CodeFailed, err)
+	}
+	printJSON(result, err)
+}
@@ -0,0 +1,96 @@
+package dotsync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+const profilesConfig = `
+gitconfig:
+  branch: main
+variables:
+  email: me@example.com
+  font: 12
+files:
+  - ~/.vimrc
+  - ~/.config/personal
+  - name: nvim
+    path: ~/.config/nvim/init.vim
+profiles:
+  work:
+    hosts: ["work-*"]
+    branch: work
+    subdir: work
+    exclude: [~/.config/personal]
+    paths:
+      nvim: ~/AppData/Local/nvim/init.vim
+    files:
+      - ~/.work-vpn
+      - path: ~/.vimrc
+        pull: skip
+    variables:
+      email: me@work.example.com
+  server:
+    hosts: ["home*", "*-server"]
+`
+
+func TestSelectProfile(t *testing.T) {
+	config := SyncConfig{}
+	assert.NoError(t, yaml.Unmarshal([]byte(profilesConfig), &config))
+	tests := []struct {
+		flag, env, config, hostname string
+		expected                    string
+	}{
+		{"", "", "", "work-laptop", "work"},
+		{"", "", "", "home", "server"},
+		{"", "", "", "web-server", "server"},
+		{"", "", "", "laptop", ""},
+		{"", "", "server", "work-laptop", "server"},
+		{"", "server", "", "work-laptop", "server"},
+		{"work", "server", "", "home", "work"},
+	}
+	for _, test := range tests {
+		name, err := selectProfile(config.Profiles, test.flag, test.env, test.config, test.hostname)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, name)
+	}
+	_, err := selectProfile(config.Profiles, "", "play", "", "home")
+	assert.ErrorIs(t, err, ErrUnknownProfile)
+	name, err := selectProfile(nil, "", "", "", "home")
+	assert.NoError(t, err)
+	assert.Empty(t, name)
+}
+
+func TestApplyProfile(t *testing.T) {
+	config := SyncConfig{Path: "/sync"}
+	assert.NoError(t, yaml.Unmarshal([]byte(profilesConfig), &config))
+	assert.NoError(t, config.applyProfile("work"))
+
+	assert.Equal(t, "work", config.Profile)
+	assert.Equal(t, "work", config.GitConfig.Branch)
+	assert.Equal(t, "/sync/work", config.IndexDir())
+	assert.Equal(t, "work/.idx", config.repoPath(IndexFileName))
+	assert.Equal(t, "me@work.example.com", config.Variables["email"])
+	assert.Equal(t, 12, config.Variables["font"])
+	assert.Equal(t, []string{"~/.vimrc", "~/AppData/Local/nvim/init.vim", "~/.work-vpn"}, config.FilePaths())
+	vimrc, _ := config.Entry("~/.vimrc")
+	assert.Equal(t, PullSkip, vimrc.Pull)
+	// The file keeps its identity at its new path
+	nvim, ok := config.Entry("nvim")
+	assert.True(t, ok)
+	assert.Equal(t, "~/AppData/Local/nvim/init.vim", nvim.Path)
+
+	assert.ErrorIs(t, config.applyProfile("play"), ErrUnknownProfile)
+}
+
+func TestValidSubdir(t *testing.T) {
+	assert.True(t, validSubdir(""))
+	assert.True(t, validSubdir("work"))
+	assert.True(t, validSubdir("hosts/work"))
+	assert.False(t, validSubdir("/work"))
+	assert.False(t, validSubdir(".."))
+	assert.False(t, validSubdir("../work"))
+	assert.False(t, validSubdir("work/../../other"))
+}
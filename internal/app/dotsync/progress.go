@@ -0,0 +1,94 @@
+package dotsync
+
+import (
+	"bytes"
+)
+
+/*
+# Progress
+A sync goes through phases, each one reported to the Progress of the options
+along with the result of every file it handles. Messages of the git server,
+like counting and compressing objects, are passed on as they arrive. Git
+rewrites them in place with \r while they progress and ends them with \n.
+*/
+
+type Phase string
+
+const (
+	PhaseIndexing   Phase = "indexing"
+	PhaseCopying    Phase = "copying"
+	PhaseStaging    Phase = "staging"
+	PhaseCommitting Phase = "committing"
+	PhaseFetching   Phase = "fetching"
+	PhasePushing    Phase = "pushing"
+	PhaseRestoring  Phase = "restoring"
+)
+
+// What happened to a file in a phase
+type FileResult string
+
+const (
+	ResultIndexed   FileResult = "indexed"
+	ResultMissing   FileResult = "missing"
+	ResultCopied    FileResult = "copied"
+	ResultAdded     FileResult = "added"
+	ResultRemoved   FileResult = "removed"
+	ResultRestored  FileResult = "restored"
+	ResultMerged    FileResult = "merged"
+	ResultConflict  FileResult = "conflict"
+	ResultKept      FileResult = "kept"
+	ResultUnchanged FileResult = "unchanged"
+)
+
+type Progress interface {
+	// A phase started, total is the number of files it handles or 0
+	Phase(phase Phase, total int)
+	// A file was handled in the current phase
+	File(path string, result FileResult)
+	// A message of the git server, final once it stops changing
+	Transfer(message string, final bool)
+	// The sync finished, successfully if err is nil
+	Done(err error)
+}
+
+type noProgress struct{}
+
+func (noProgress) Phase(Phase, int)        {}
+func (noProgress) File(string, FileResult) {}
+func (noProgress) Transfer(string, bool)   {}
+func (noProgress) Done(error)              {}
+
+func (s SyncConfig) progress() Progress {
+	if s.Progress == nil {
+		return noProgress{}
+	}
+	return s.Progress
+}
+
+// Reports the end of a sync, if it is followed
+func (o Options) done(err error) {
+	if o.Progress != nil {
+		o.Progress.Done(err)
+	}
+}
+
+// Splits the sideband output of git into messages
+type progressWriter struct {
+	progress Progress
+	pending  []byte
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexAny(w.pending, "\r\n")
+		if i < 0 {
+			return len(p), nil
+		}
+		message := string(bytes.TrimSpace(w.pending[:i]))
+		if message != "" {
+			w.progress.Transfer(message, w.pending[i] == '\n')
+		}
+		w.pending = w.pending[i+1:]
+	}
+}
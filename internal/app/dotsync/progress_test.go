@@ -0,0 +1,49 @@
+package dotsync
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordedProgress struct {
+	events []string
+}
+
+func (p *recordedProgress) Phase(phase Phase, total int) {
+	p.events = append(p.events, fmt.Sprintf("%s %d", phase, total))
+}
+
+func (p *recordedProgress) File(path string, result FileResult) {
+	p.events = append(p.events, fmt.Sprintf("%s %s", result, path))
+}
+
+func (p *recordedProgress) Transfer(message string, final bool) {
+	p.events = append(p.events, fmt.Sprintf("%s %v", message, final))
+}
+
+func (p *recordedProgress) Done(err error) {
+	p.events = append(p.events, fmt.Sprintf("done %v", err))
+}
+
+func TestProgressWriter(t *testing.T) {
+	progress := &recordedProgress{}
+	w := &progressWriter{progress: progress}
+	fmt.Fprint(w, "Counting objects:  50% (1/2)\rCounting")
+	fmt.Fprint(w, " objects: 100% (2/2), done.\n\n")
+	assert.Equal(t, []string{
+		"Counting objects:  50% (1/2) false",
+		"Counting objects: 100% (2/2), done. true",
+	}, progress.events)
+}
+
+func TestRestoreProgress(t *testing.T) {
+	path, base, remote, history := setupMerge(t, "ONE\ntwo\nthree\nfour\nfive\n", "one\ntwo\nthree\nfour\nFIVE\n")
+	progress := &recordedProgress{}
+	syncConfig := syncConfigWith(path)
+	syncConfig.Progress = progress
+	_, err := restoreFiles(syncConfig, base, remote, history)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"restoring 1", "merged " + path}, progress.events)
+}
@@ -0,0 +1,668 @@
+package dotsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+# Recipients
+When the repository has a recipients file, encrypted files are encrypted for
+every recipient listed in it instead of with a local key. Each file gets a
+random file key that encrypts the content. The file key is wrapped once per
+recipient
+
+	ephemeral X25519 key pair, shared secret with the public key of the recipient
+	wrapping key = HKDF-SHA256(shared secret, ephemeral public key | recipient public key)
+	stanza = fingerprint of the recipient | ephemeral public key | sealed file key
+
+Recipients are X25519 public keys generated with dotsync keygen, or SSH ed25519
+public keys which are converted to their X25519 equivalent. The identity used
+for decrypting is the matching private key, read from the identity file.
+
+Removing a recipient re-encrypts all files with new file keys, but a removed
+recipient can still decrypt the versions in the git history. Rotate the secrets.
+*/
+
+const (
+	RecipientsFileName      = ".recipients"
+	DefaultIdentityFileName = "identity"
+
+	x25519Prefix       = "x25519:"
+	x25519SecretPrefix = "x25519-secret:"
+	fingerprintSize    = 8
+	stanzaSize         = fingerprintSize + curve25519.PointSize + keySize + chacha20poly1305.Overhead
+	maxRecipients      = 1<<16 - 1
+)
+
+var wrapInfo = []byte("dotsync x25519 file key")
+
+var (
+	ErrInvalidRecipient = errors.New("invalid recipient")
+	ErrNotRecipient     = errors.New("local identity is not among the recipients")
+	ErrMissingIdentity  = errors.New("missing identity")
+	ErrInvalidIdentity  = errors.New("invalid identity")
+	ErrUnknownRecipient = errors.New("unknown recipient")
+	ErrLastRecipient    = errors.New("can't remove the last recipient")
+)
+
+type recipient struct {
+	// X25519 public key
+	Key []byte
+	// The key as written in the recipients file
+	Text string
+	Name string
+}
+
+type identity struct {
+	private []byte
+	public  []byte
+}
+
+func (r recipient) String() string {
+	if r.Name == "" {
+		return r.Text
+	}
+	return r.Text + " " + r.Name
+}
+
+func fingerprint(public []byte) []byte {
+	sum := sha256.Sum256(public)
+	return sum[:fingerprintSize]
+}
+
+// Parses a recipient written as x25519:<base64 key> [name] or as an SSH
+// authorized key line for an ed25519 key, where the comment is the name
+func parseRecipient(line string) (recipient, error) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, x25519Prefix) {
+		fields := strings.SplitN(line, " ", 2)
+		key, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(fields[0], x25519Prefix))
+		if err != nil || len(key) != curve25519.PointSize {
+			return recipient{}, fmt.Errorf("%w: %s", ErrInvalidRecipient, line)
+		}
+		r := recipient{Key: key, Text: fields[0]}
+		if len(fields) > 1 {
+			r.Name = strings.TrimSpace(fields[1])
+		}
+		return r, nil
+	}
+	public, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil || public.Type() != ssh.KeyAlgoED25519 {
+		return recipient{}, fmt.Errorf("%w: only x25519 and ssh-ed25519 keys are supported", ErrInvalidRecipient)
+	}
+	edPublic := public.(ssh.CryptoPublicKey).CryptoPublicKey().(ed25519.PublicKey)
+	key, err := ed25519PublicToX25519(edPublic)
+	if err != nil {
+		return recipient{}, err
+	}
+	text := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(public)))
+	return recipient{Key: key, Text: text, Name: comment}, nil
+}
+
+// Converts an ed25519 public key, a point on the twisted Edwards curve, to the
+// X25519 public key on the birationally equivalent Montgomery curve.
+// u = (1 + y) / (1 - y) mod p
+func ed25519PublicToX25519(public ed25519.PublicKey) ([]byte, error) {
+	if len(public) != ed25519.PublicKeySize {
+		return nil, ErrInvalidRecipient
+	}
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	// Little endian, the top bit holds the sign of x
+	yBytes := reverseBytes(public)
+	yBytes[0] &= 0x7f
+	y := new(big.Int).SetBytes(yBytes)
+	one := big.NewInt(1)
+	numerator := new(big.Int).Add(one, y)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, p)
+	if denominator.Sign() == 0 {
+		return nil, ErrInvalidRecipient
+	}
+	denominator.ModInverse(denominator, p)
+	u := numerator.Mul(numerator, denominator)
+	u.Mod(u, p)
+	return reverseBytes(u.FillBytes(make([]byte, curve25519.PointSize))), nil
+}
+
+// The X25519 private key of an ed25519 key is the clamped hash of its seed,
+// the same scalar ed25519 signs with
+func ed25519PrivateToX25519(private ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(private.Seed())
+	return h[:curve25519.ScalarSize]
+}
+
+func reverseBytes(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func newIdentity(private []byte) (*identity, error) {
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &identity{private: private, public: public}, nil
+}
+
+// Generates a new X25519 identity
+func generateIdentity() (*identity, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return nil, err
+	}
+	return newIdentity(private)
+}
+
+func (i *identity) recipient() string {
+	return x25519Prefix + base64.RawStdEncoding.EncodeToString(i.public)
+}
+
+func (i *identity) marshal() []byte {
+	return []byte(fmt.Sprintf("# public key: %s\n%s%s\n", i.recipient(),
+		x25519SecretPrefix, base64.RawStdEncoding.EncodeToString(i.private)))
+}
+
+// Parses an identity file, either one written by dotsync keygen
+// or an unencrypted OpenSSH ed25519 private key
+func parseIdentity(content []byte) (*identity, error) {
+	if bytes.Contains(content, []byte("PRIVATE KEY")) {
+		raw, err := ssh.ParseRawPrivateKey(content)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidIdentity, err)
+		}
+		switch key := raw.(type) {
+		case *ed25519.PrivateKey:
+			return newIdentity(ed25519PrivateToX25519(*key))
+		case ed25519.PrivateKey:
+			return newIdentity(ed25519PrivateToX25519(key))
+		}
+		return nil, fmt.Errorf("%w: only ed25519 ssh keys are supported", ErrInvalidIdentity)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, x25519SecretPrefix) {
+			continue
+		}
+		private, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(line, x25519SecretPrefix))
+		if err != nil || len(private) != curve25519.ScalarSize {
+			return nil, ErrInvalidIdentity
+		}
+		return newIdentity(private)
+	}
+	return nil, ErrInvalidIdentity
+}
+
+// Wraps the file key for every recipient
+func wrapFileKey(fileKey []byte, recipients []recipient) ([]byte, error) {
+	stanzas := []byte{}
+	for _, r := range recipients {
+		ephemeral, err := generateIdentity()
+		if err != nil {
+			return nil, err
+		}
+		shared, err := curve25519.X25519(ephemeral.private, r.Key)
+		if err != nil {
+			return nil, err
+		}
+		wrapKey, err := wrappingKey(shared, ephemeral.public, r.Key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := chacha20poly1305.New(wrapKey)
+		if err != nil {
+			return nil, err
+		}
+		stanzas = append(stanzas, fingerprint(r.Key)...)
+		stanzas = append(stanzas, ephemeral.public...)
+		// Every wrapping key is used once, a zero nonce is fine
+		stanzas = aead.Seal(stanzas, make([]byte, aead.NonceSize()), fileKey, nil)
+	}
+	return stanzas, nil
+}
+
+// Finds the stanza of the identity and unwraps the file key
+func unwrapFileKey(stanzas []byte, id *identity) ([]byte, error) {
+	ours := fingerprint(id.public)
+	for i := 0; i+stanzaSize <= len(stanzas); i += stanzaSize {
+		stanza := stanzas[i : i+stanzaSize]
+		if !bytes.Equal(stanza[:fingerprintSize], ours) {
+			continue
+		}
+		ephemeral := stanza[fingerprintSize : fingerprintSize+curve25519.PointSize]
+		shared, err := curve25519.X25519(id.private, ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		wrapKey, err := wrappingKey(shared, ephemeral, id.public)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := chacha20poly1305.New(wrapKey)
+		if err != nil {
+			return nil, err
+		}
+		fileKey, err := aead.Open(nil, make([]byte, aead.NonceSize()),
+			stanza[fingerprintSize+curve25519.PointSize:], nil)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+		return fileKey, nil
+	}
+	return nil, fmt.Errorf("%w, ask a recipient to add %s", ErrNotRecipient, id.recipient())
+}
+
+func wrappingKey(shared, ephemeral, public []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), public...)
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, wrapInfo), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func recipientsPath(syncConfig SyncConfig) string {
+	return filepath.Join(syncConfig.Path, RecipientsFileName)
+}
+
+// Reads the recipients file in the sync directory. A missing file means
+// that there are no recipients
+func readRecipients(recipientsPath string) ([]recipient, error) {
+	content, err := aferoFs.ReadFile(recipientsPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return []recipient{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	recipients := []recipient{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRecipient(line)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+func writeRecipients(recipientsPath string, recipients []recipient) error {
+	var builder strings.Builder
+	builder.WriteString("# Recipients of the encrypted files, managed with dotsync recipients\n")
+	for _, r := range recipients {
+		builder.WriteString(r.String() + "\n")
+	}
+	return writeFileAtomic(recipientsPath, []byte(builder.String()), 0644)
+}
+
+func identityPath(config EncryptionConfig) string {
+	if config.Identity != "" {
+		return expandHome(config.Identity)
+	}
+	return filepath.Join(filepath.Dir(getConfigPath()), DefaultIdentityFileName)
+}
+
+// Reads the local identity. Without an identity configured, the identity
+// generated by keygen is tried before the default ssh ed25519 key
+func readIdentity(config EncryptionConfig) (*identity, error) {
+	candidates := []string{identityPath(config)}
+	if config.Identity == "" {
+		candidates = append(candidates, expandHome("~/.ssh/id_ed25519"))
+	}
+	for _, path := range candidates {
+		content, err := aferoFs.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return parseIdentity(content)
+	}
+	return nil, fmt.Errorf("%w: run dotsync keygen or configure an ssh ed25519 key", ErrMissingIdentity)
+}
+
+// Generates a local identity and returns its public key as a recipient. With
+// key it generates the key file instead, for the first machine that encrypts
+func Keygen(key bool, opts Options) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		log.WithField("path", getConfigPath()).Error("Failed to open config file. Error: ", err)
+		os.Exit(1)
+	}
+	if key {
+		generateKeyFile(syncConfig)
+		return
+	}
+	path := identityPath(syncConfig.Encryption)
+	if exists, _ := aferoFs.Exists(path); exists {
+		log.WithField("path", path).Error("Identity already exists")
+		os.Exit(1)
+	}
+	id, err := generateIdentity()
+	if err == nil {
+		err = aferoFs.MkdirAll(filepath.Dir(path), 0700)
+	}
+	if err == nil {
+		err = writeFileAtomic(path, id.marshal(), 0600)
+	}
+	if err != nil {
+		log.Error("Failed to generate identity ", err)
+		os.Exit(1)
+	}
+	fmt.Println(id.recipient())
+}
+
+func generateKeyFile(syncConfig SyncConfig) {
+	cipher := newBlobCipher(syncConfig.Encryption)
+	path := cipher.keyFilePath()
+	if exists, _ := aferoFs.Exists(path); exists {
+		log.WithField("path", path).Error("Key file already exists")
+		os.Exit(1)
+	}
+	if _, err := cipher.generateKey(path); err != nil {
+		log.Error("Failed to generate key ", err)
+		os.Exit(1)
+	}
+	fmt.Println(path)
+}
+
+// Lists the recipients of the encrypted files
+func ListRecipients(opts Options) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		log.WithField("path", getConfigPath()).Error("Failed to open config file. Error: ", err)
+		os.Exit(1)
+	}
+	recipients, err := readRecipients(recipientsPath(syncConfig))
+	if err != nil {
+		log.Error("Failed to read recipients ", err)
+		os.Exit(1)
+	}
+	for _, r := range recipients {
+		fmt.Println(r)
+	}
+}
+
+// Adds a recipient and re-encrypts the encrypted files for everyone
+func AddRecipient(line string, opts Options) {
+	updateRecipientsOrExit(opts, func(recipients []recipient) ([]recipient, error) {
+		r, err := parseRecipient(line)
+		if err != nil {
+			return nil, err
+		}
+		for _, existing := range recipients {
+			if bytes.Equal(existing.Key, r.Key) {
+				return recipients, nil
+			}
+		}
+		if len(recipients) == maxRecipients {
+			return nil, fmt.Errorf("%w: too many recipients", ErrInvalidRecipient)
+		}
+		return append(recipients, r), nil
+	})
+}
+
+// Removes a recipient, given by key or name, and re-encrypts the encrypted
+// files for the remaining recipients
+func RemoveRecipient(keyOrName string, force bool, opts Options) {
+	updateRecipientsOrExit(opts, removeRecipient(keyOrName, force))
+}
+
+// Without recipients the files are encrypted with the key file or the
+// passphrase again, which takes force
+func removeRecipient(keyOrName string, force bool) func([]recipient) ([]recipient, error) {
+	return func(recipients []recipient) ([]recipient, error) {
+		kept := []recipient{}
+		for _, r := range recipients {
+			if r.Text != keyOrName && r.Name != keyOrName && r.String() != keyOrName {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == len(recipients) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownRecipient, keyOrName)
+		}
+		if len(kept) == 0 && !force {
+			return nil, fmt.Errorf("%w, the files would be encrypted with the key file instead. "+
+				"Use --force to remove it anyway", ErrLastRecipient)
+		}
+		return kept, nil
+	}
+}
+
+func updateRecipientsOrExit(opts Options, change func([]recipient) ([]recipient, error)) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		log.WithField("path", getConfigPath()).Error("Failed to open config file. Error: ", err)
+		os.Exit(1)
+	}
+	SetupLogging(syncConfig.Path)
+	err = withLock(syncConfig, opts.LockWait, func() error {
+		return updateRecipients(syncConfig, change)
+	})
+	if err != nil {
+		log.Error("Failed to update recipients ", err)
+		os.Exit(1)
+	}
+}
+
+func updateRecipients(syncConfig SyncConfig, change func([]recipient) ([]recipient, error)) error {
+	repository, err := NewRepository(syncConfig)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+	if err = RecoverSync(syncConfig.IndexDir()); err != nil {
+		return fmt.Errorf("failed to recover interrupted sync: %w", err)
+	}
+	if err = repository.tryAndUpdate(syncConfig.context()); err != nil {
+		return fmt.Errorf("failed to update repository: %w", err)
+	}
+
+	j, err := changeRecipients(syncConfig, change)
+	if err != nil {
+		return err
+	}
+	for _, name := range j.Root {
+		if err = repository.addFile(name); err != nil {
+			return err
+		}
+	}
+	for _, name := range j.RemoveRoot {
+		if err = repository.removeFile(name); err != nil {
+			return err
+		}
+	}
+	// Generated when the hash key is derived from the passphrase again
+	if exists, _ := aferoFs.Exists(filepath.Join(syncConfig.Path, HashSaltFileName)); exists {
+		if err = repository.addFile(HashSaltFileName); err != nil {
+			return err
+		}
+	}
+	for _, k := range append(j.Copy, IndexFileName) {
+		if err = repository.addFile(syncConfig.repoPath(k)); err != nil {
+			return err
+		}
+	}
+	for _, k := range j.Remove {
+		if err = repository.removeFile(syncConfig.repoPath(k)); err != nil {
+			return err
+		}
+	}
+	commitMessage := fmt.Sprintf("updated recipients, re-encrypted %d files", len(j.Copy))
+	if err = repository.commit(commitMessage); err != nil {
+		return err
+	}
+	if err = repository.push(syncConfig.context()); err != nil {
+		return err
+	}
+	log.Info(commitMessage)
+	return nil
+}
+
+// Writes the changed recipients and re-encrypts every encrypted file in the
+// index for them. The hash key is kept while there are recipients. Without
+// recipients it is derived again, the files are renamed after it and the
+// shared hash key is removed. Returns the applied journal
+func changeRecipients(syncConfig SyncConfig, change func([]recipient) ([]recipient, error)) (*journal, error) {
+	path := recipientsPath(syncConfig)
+	recipients, err := readRecipients(path)
+	if err != nil {
+		return nil, err
+	}
+	// Decrypt everything before the recipients change, a failure leaves the
+	// sync directory untouched
+	decrypter := newSyncCipher(syncConfig)
+	plaintexts := make(map[string][]byte)
+	index := readIndexFile(syncConfig.IndexDir())
+	for k := range index {
+		blob, err := aferoFs.ReadFile(filepath.Join(syncConfig.IndexDir(), k))
+		if err != nil {
+			return nil, err
+		}
+		if !isEncryptedBlob(k, blob) {
+			continue
+		}
+		plaintext, err := decrypter.decrypt(blob)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		plaintexts[k] = plaintext
+	}
+	keyPath := hashKeyPath(path)
+	hashKey, err := aferoFs.ReadFile(keyPath)
+	hadHashKey := err == nil
+	if hadHashKey {
+		if hashKey, err = decrypter.decrypt(hashKey); err != nil {
+			return nil, fmt.Errorf("%s: %w", HashKeyFileName, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	} else if len(plaintexts) > 0 && len(recipients) == 0 {
+		// Derived from the key file or the passphrase, becoming recipients
+		// keeps it so that the files keep their names
+		if hashKey, err = decrypter.loadHashKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	recipients, err = change(recipients)
+	if err != nil {
+		return nil, err
+	}
+	if id, err := readIdentity(syncConfig.Encryption); err == nil && !hasRecipient(recipients, id) && len(recipients) > 0 {
+		log.WithField("recipient", id.recipient()).
+			Warning("Local identity is not among the recipients, this machine can no longer decrypt")
+	}
+
+	// Staged and applied through the journal, like a sync, so that an
+	// interruption can't leave files encrypted for different recipients
+	indexDir := syncConfig.IndexDir()
+	stagingPath := filepath.Join(indexDir, StagingDirName)
+	stagingRoot := filepath.Join(stagingPath, stagingRootName)
+	if err = aferoFs.RemoveAll(stagingPath); err != nil {
+		return nil, err
+	}
+	if err = aferoFs.MkdirAll(stagingRoot, 0755); err != nil {
+		return nil, err
+	}
+	if err = writeRecipients(filepath.Join(stagingRoot, RecipientsFileName), recipients); err != nil {
+		return nil, err
+	}
+	j := &journal{Started: now(), Copy: []string{}, Remove: []string{}, Root: []string{RecipientsFileName}}
+	if j.RootDir, err = filepath.Rel(indexDir, filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	encrypter := newSyncCipher(syncConfig)
+	encrypter.recipients = append([]recipient{}, recipients...)
+	if len(recipients) > 0 {
+		encrypter.hashKey = hashKey
+	}
+	newIndex := make(map[string]FileInfo, len(index))
+	for k, info := range index {
+		newIndex[k] = info
+	}
+	for k, plaintext := range plaintexts {
+		blob, err := encrypter.encrypt(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		name, err := encrypter.contentHash(true, plaintext)
+		if err != nil {
+			return nil, err
+		}
+		if name != k {
+			delete(newIndex, k)
+			newIndex[name] = index[k]
+			j.Remove = append(j.Remove, k)
+		}
+		if err = writeFileAtomic(filepath.Join(stagingPath, name), blob, 0666); err != nil {
+			return nil, err
+		}
+		j.Copy = append(j.Copy, name)
+	}
+	sort.Strings(j.Copy)
+	sort.Strings(j.Remove)
+	if err = writeIndexFile(stagingPath, newIndex); err != nil {
+		return nil, err
+	}
+	if hadHashKey && len(recipients) == 0 {
+		j.RemoveRoot = append(j.RemoveRoot, HashKeyFileName)
+	}
+	if hashKey != nil && len(recipients) > 0 {
+		blob, err := encrypter.encrypt(hashKey)
+		if err != nil {
+			return nil, err
+		}
+		if err = writeFileAtomic(filepath.Join(stagingRoot, HashKeyFileName), blob, 0666); err != nil {
+			return nil, err
+		}
+		j.Root = append(j.Root, HashKeyFileName)
+	}
+	if err = syncConfig.context().Err(); err != nil {
+		return nil, err
+	}
+	if err = j.write(indexDir); err != nil {
+		return nil, err
+	}
+	if err = j.apply(indexDir); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func hasRecipient(recipients []recipient, id *identity) bool {
+	for _, r := range recipients {
+		if bytes.Equal(r.Key, id.public) {
+			return true
+		}
+	}
+	return false
+}
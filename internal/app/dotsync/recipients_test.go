@@ -0,0 +1,206 @@
+package dotsync
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func writeIdentity(t *testing.T, path string) *identity {
+	id, err := generateIdentity()
+	assert.NoError(t, err)
+	assert.NoError(t, aferoFs.WriteFile(path, id.marshal(), 0600))
+	return id
+}
+
+func recipientsConfig(identityPath string) SyncConfig {
+	return SyncConfig{
+		Path:       "/sync",
+		Encryption: EncryptionConfig{Identity: identityPath},
+	}
+}
+
+func TestEncryptForRecipients(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	alice := writeIdentity(t, "/alice")
+	bob := writeIdentity(t, "/bob")
+	writeIdentity(t, "/eve")
+	recipients := []recipient{}
+	for _, id := range []*identity{alice, bob} {
+		r, err := parseRecipient(id.recipient())
+		assert.NoError(t, err)
+		recipients = append(recipients, r)
+	}
+	assert.NoError(t, writeRecipients("/sync/.recipients", recipients))
+
+	blob, err := newSyncCipher(recipientsConfig("/alice")).encrypt([]byte("secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, modeRecipients, blob[len(encryptionMagic)+1])
+
+	for _, path := range []string{"/alice", "/bob"} {
+		decrypted, err := newSyncCipher(recipientsConfig(path)).decrypt(blob)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("secret"), decrypted)
+	}
+	_, err = newSyncCipher(recipientsConfig("/eve")).decrypt(blob)
+	assert.ErrorIs(t, err, ErrNotRecipient)
+}
+
+func TestParseRecipient(t *testing.T) {
+	r, err := parseRecipient("x25519:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA alice laptop")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice laptop", r.Name)
+	assert.Len(t, r.Key, 32)
+
+	_, err = parseRecipient("x25519:short")
+	assert.ErrorIs(t, err, ErrInvalidRecipient)
+	_, err = parseRecipient("ssh-rsa AAAAB3NzaC1yc2E= bob")
+	assert.ErrorIs(t, err, ErrInvalidRecipient)
+}
+
+func TestSSHRecipientMatchesSSHIdentity(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	sshPublic, err := ssh.NewPublicKey(public)
+	assert.NoError(t, err)
+
+	r, err := parseRecipient(string(ssh.MarshalAuthorizedKey(sshPublic)) + " bob@laptop")
+	assert.NoError(t, err)
+	id, err := newIdentity(ed25519PrivateToX25519(private))
+	assert.NoError(t, err)
+	assert.Equal(t, id.public, r.Key)
+}
+
+func TestChangeRecipientsReencrypts(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	alice := writeIdentity(t, "/alice")
+	bob := writeIdentity(t, "/bob")
+	syncConfig := recipientsConfig("/alice")
+	aliceRecipient, _ := parseRecipient(alice.recipient())
+	assert.NoError(t, writeRecipients(recipientsPath(syncConfig), []recipient{aliceRecipient}))
+
+	plaintext := []byte("secret")
+	blob, err := newSyncCipher(syncConfig).encrypt(plaintext)
+	assert.NoError(t, err)
+	hash, err := newSyncCipher(syncConfig).contentHash(true, plaintext)
+	assert.NoError(t, err)
+	assert.NoError(t, aferoFs.WriteFile(filepath.Join(syncConfig.Path, hash), blob, 0666))
+	assert.NoError(t, writeIndexFile(syncConfig.Path, map[string]FileInfo{
+		hash: {Path: "/home/user/.netrc", Perm: 0600, Encrypt: true},
+	}))
+
+	j, err := changeRecipients(syncConfig, func(recipients []recipient) ([]recipient, error) {
+		r, err := parseRecipient(bob.recipient() + " bob")
+		return append(recipients, r), err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{hash}, j.Copy)
+	assert.Empty(t, j.Remove)
+
+	recipients, err := readRecipients(recipientsPath(syncConfig))
+	assert.NoError(t, err)
+	assert.Len(t, recipients, 2)
+	assert.Equal(t, "bob", recipients[1].Name)
+	blob, err = aferoFs.ReadFile(filepath.Join(syncConfig.Path, hash))
+	assert.NoError(t, err)
+	decrypted, err := newSyncCipher(recipientsConfig("/bob")).decrypt(blob)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+	exists, _ := aferoFs.Exists(filepath.Join(syncConfig.Path, StagingDirName))
+	assert.False(t, exists)
+	// Bob hashes with the same key
+	bobHash, err := newSyncCipher(recipientsConfig("/bob")).contentHash(true, plaintext)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, bobHash)
+}
+
+func TestRemoveLastRecipientNeedsForce(t *testing.T) {
+	alice, err := parseRecipient("x25519:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA alice")
+	assert.NoError(t, err)
+	_, err = removeRecipient("alice", false)([]recipient{alice})
+	assert.ErrorIs(t, err, ErrLastRecipient)
+	kept, err := removeRecipient("alice", true)([]recipient{alice})
+	assert.NoError(t, err)
+	assert.Empty(t, kept)
+}
+
+func TestChangeRecipientsWithSubdir(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	alice := writeIdentity(t, "/alice")
+	syncConfig := recipientsConfig("/alice")
+	syncConfig.Subdir = "laptop"
+	assert.NoError(t, aferoFs.MkdirAll(syncConfig.IndexDir(), 0755))
+	assert.NoError(t, writeIndexFile(syncConfig.IndexDir(), map[string]FileInfo{}))
+
+	_, err := changeRecipients(syncConfig, func(recipients []recipient) ([]recipient, error) {
+		r, err := parseRecipient(alice.recipient() + " alice")
+		return append(recipients, r), err
+	})
+	assert.NoError(t, err)
+	recipients, err := readRecipients(filepath.Join(syncConfig.Path, RecipientsFileName))
+	assert.NoError(t, err)
+	assert.Len(t, recipients, 1)
+	exists, _ := aferoFs.Exists(filepath.Join(syncConfig.IndexDir(), JournalFileName))
+	assert.False(t, exists)
+}
+
+func TestChangeRecipientsKeepsOrRenewsHashKey(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	alice := writeIdentity(t, "/alice")
+	syncConfig := recipientsConfig("/alice")
+	syncConfig.Encryption.KeyFile = "/key"
+	_, err := newBlobCipher(syncConfig.Encryption).generateKey("/key")
+	assert.NoError(t, err)
+	plaintext := []byte("secret")
+	blob, err := newSyncCipher(syncConfig).encrypt(plaintext)
+	assert.NoError(t, err)
+	hash, err := newSyncCipher(syncConfig).contentHash(true, plaintext)
+	assert.NoError(t, err)
+	assert.NoError(t, aferoFs.MkdirAll(syncConfig.Path, 0755))
+	assert.NoError(t, aferoFs.WriteFile(filepath.Join(syncConfig.Path, hash), blob, 0666))
+	assert.NoError(t, writeIndexFile(syncConfig.Path, map[string]FileInfo{
+		hash: {Path: "/home/user/.netrc", Perm: 0600},
+	}))
+
+	// From the key file to recipients the files keep their names
+	j, err := changeRecipients(syncConfig, func(recipients []recipient) ([]recipient, error) {
+		r, err := parseRecipient(alice.recipient() + " alice")
+		return append(recipients, r), err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{hash}, j.Copy)
+	assert.Empty(t, j.Remove)
+	assert.Contains(t, j.Root, HashKeyFileName)
+	shared, err := newSyncCipher(syncConfig).contentHash(true, plaintext)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, shared)
+
+	// Removing a random shared key renames the files after the key file
+	assert.NoError(t, aferoFs.Remove(filepath.Join(syncConfig.Path, HashKeyFileName)))
+	_, err = newSyncCipher(syncConfig).sharedHashKey()
+	assert.NoError(t, err)
+	sharedHash, err := newSyncCipher(syncConfig).contentHash(true, plaintext)
+	assert.NoError(t, err)
+	assert.NoError(t, aferoFs.Rename(filepath.Join(syncConfig.Path, hash), filepath.Join(syncConfig.Path, sharedHash)))
+	assert.NoError(t, writeIndexFile(syncConfig.Path, map[string]FileInfo{
+		sharedHash: {Path: "/home/user/.netrc", Perm: 0600},
+	}))
+	j, err = changeRecipients(syncConfig, removeRecipient("alice", true))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{hash}, j.Copy)
+	assert.Equal(t, []string{sharedHash}, j.Remove)
+	assert.Equal(t, []string{HashKeyFileName}, j.RemoveRoot)
+	exists, _ := aferoFs.Exists(filepath.Join(syncConfig.Path, HashKeyFileName))
+	assert.False(t, exists)
+	exists, _ = aferoFs.Exists(filepath.Join(syncConfig.Path, sharedHash))
+	assert.False(t, exists)
+	assert.Equal(t, map[string]FileInfo{hash: {Path: "/home/user/.netrc", Perm: 0600}}, readIndexFile(syncConfig.Path))
+	plain, err := readBlob(syncConfig.Path, hash, newSyncCipher(syncConfig))
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, plain)
+}
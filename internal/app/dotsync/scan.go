@@ -0,0 +1,202 @@
+package dotsync
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+# Secret scan
+Before a sync is committed the blobs it adds to the sync directory are
+scanned for private keys and tokens. Any finding refuses the commit and the
+sync directory is reset, so nothing is pushed. Encrypted files aren't
+scanned, neither are files marked with allowSecrets. A single line is
+skipped by putting dotsync:allow on it.
+
+The scan runs on the blobs rather than on the local files, so it sees
+exactly what would be pushed.
+*/
+
+const (
+	scanAllowMarker = "dotsync:allow"
+	// Strings shorter than this are never reported for their entropy
+	minEntropyLength = 20
+	// Bits per character, random base64 is close to 6 and english text below 4.5
+	entropyThreshold = 4.5
+)
+
+var ErrSecretsFound = errors.New("refusing to commit possible secrets")
+
+type secretRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+var secretRules = []secretRule{
+	{"private key", regexp.MustCompile(`-----BEGIN ([A-Z0-9]+ )*PRIVATE KEY( BLOCK)?-----`)},
+	{"aws access key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"github token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"slack token", regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"slack webhook", regexp.MustCompile(`hooks\.slack\.com/services/[A-Za-z0-9/]+`)},
+	{"google api key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"stripe key", regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}\b`)},
+	{"npm token", regexp.MustCompile(`\bnpm_[A-Za-z0-9]{36}\b`)},
+}
+
+// Candidates for the entropy check, runs of base64 and url safe base64 characters
+var tokenPattern = regexp.MustCompile(`[A-Za-z0-9+/=_-]{20,}`)
+
+// A possible secret in a file
+type Finding struct {
+	Path string
+	Line int
+	Rule string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s:%d: %s", f.Path, f.Line, f.Rule)
+}
+
+// Scans content line by line, returns the findings with the given path
+func scanContent(path string, content []byte) []Finding {
+	findings := []Finding{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(content)+1)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if strings.Contains(text, scanAllowMarker) {
+			continue
+		}
+		if rule, ok := scanLine(text); ok {
+			findings = append(findings, Finding{Path: path, Line: line, Rule: rule})
+		}
+	}
+	return findings
+}
+
+// Returns the first rule the line matches
+func scanLine(line string) (string, bool) {
+	for _, rule := range secretRules {
+		if rule.Pattern.MatchString(line) {
+			return rule.Name, true
+		}
+	}
+	for _, token := range tokenPattern.FindAllString(line, -1) {
+		if looksRandom(token) {
+			return "high entropy string", true
+		}
+	}
+	return "", false
+}
+
+// Reports if the token is long enough and random enough to be a key. Tokens
+// made of only letters or only digits are words and numbers, not keys
+func looksRandom(token string) bool {
+	token = strings.TrimRight(token, "=")
+	if len(token) < minEntropyLength {
+		return false
+	}
+	hasDigit := strings.ContainsAny(token, "0123456789")
+	hasLetter := strings.IndexFunc(token, func(r rune) bool {
+		return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+	}) >= 0
+	if !hasDigit || !hasLetter {
+		return false
+	}
+	return shannonEntropy(token) >= entropyThreshold
+}
+
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+	entropy := 0.0
+	n := float64(len(s))
+	for _, c := range counts {
+		p := float64(c) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// Scans the blobs of the files in the sync directory. Encrypted files and
+// files that allow secrets are skipped
+func scanBlobs(syncConfig SyncConfig, files map[string]FileInfo) ([]Finding, error) {
+	findings := []Finding{}
+	for k, v := range files {
+		if v.Encrypt {
+			continue
+		}
+		if entry, ok := syncConfig.Entry(v.Path); ok && entry.AllowSecrets {
+			continue
+		}
+		blob, err := aferoFs.ReadFile(filepath.Join(syncConfig.IndexDir(), k))
+		if err != nil {
+			return nil, err
+		}
+		if isEncryptedBlob(k, blob) {
+			continue
+		}
+		findings = append(findings, scanContent(v.Path, blob)...)
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].Path != findings[j].Path {
+			return findings[i].Path < findings[j].Path
+		}
+		return findings[i].Line < findings[j].Line
+	})
+	return findings, nil
+}
+
+// Scans the blobs added by a sync. Findings are logged and the sync is
+// rolled back, so that nothing of it gets committed
+func scanSync(repository *repository, syncConfig SyncConfig, added, removed map[string]FileInfo) error {
+	findings, err := scanBlobs(syncConfig, added)
+	if err != nil {
+		return fmt.Errorf("failed to scan files: %w", err)
+	}
+	if len(findings) == 0 {
+		return nil
+	}
+	for _, f := range findings {
+		log.WithFields(logrus.Fields{
+			"file": f.Path,
+			"line": f.Line,
+			"rule": f.Rule,
+		}).Error("Possible secret")
+	}
+	if err = rollbackSync(repository, syncConfig, added, removed); err != nil {
+		log.Error("Failed to roll back sync directory ", err)
+	}
+	return fmt.Errorf("%w: %d findings, encrypt the files, set allowSecrets or mark the lines with %s",
+		ErrSecretsFound, len(findings), scanAllowMarker)
+}
+
+// Undoes a sync that wasn't committed. The blobs the sync added are removed,
+// the blobs it removed and the index are restored from HEAD
+func rollbackSync(repository *repository, syncConfig SyncConfig, added, removed map[string]FileInfo) error {
+	if err := cleanupOldFiles(syncConfig.IndexDir(), added); err != nil {
+		return err
+	}
+	restore := []string{syncConfig.repoPath(IndexFileName)}
+	for k := range removed {
+		restore = append(restore, syncConfig.repoPath(k))
+	}
+	err := repository.restoreFromHead(restore)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// Nothing was ever committed, the index is new as well
+		return cleanupOldFiles(syncConfig.IndexDir(), map[string]FileInfo{IndexFileName: {}})
+	}
+	return err
+}
@@ -0,0 +1,141 @@
+package dotsync
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"sort"
+	"time"
+)
+
+/*
+# Scripts
+A tracked file marked with run is a script, run after a restore. A script
+marked once runs once for every content it ever had, a script marked onchange
+runs whenever its content differs from the last content that ran. What ran is
+recorded in the local state file, together with the hash of the content.
+
+Only scripts whose local file matches the synced version run, a script that
+was changed locally and not pushed yet is left alone. Executable scripts are
+run directly, other scripts with the shell. Failing scripts follow the
+failure policy of the hooks and run again on the next restore.
+*/
+
+type RunPolicy string
+
+const (
+	RunOnce     RunPolicy = "once"
+	RunOnChange RunPolicy = "onchange"
+)
+
+var ErrInvalidRunPolicy = errors.New("invalid run policy")
+
+func (p RunPolicy) Validate() error {
+	switch p {
+	case "", RunOnce, RunOnChange:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidRunPolicy, p)
+}
+
+// Reports if a script with the given content should run
+func (s scriptState) shouldRun(policy RunPolicy, hash string) bool {
+	switch policy {
+	case RunOnce:
+		for _, ran := range s.Ran {
+			if ran == hash {
+				return false
+			}
+		}
+		return true
+	case RunOnChange:
+		return s.Hash != hash
+	}
+	return false
+}
+
+func (s scriptState) ranWith(hash string) scriptState {
+	s.Hash = hash
+	s.LastRun = now()
+	for _, ran := range s.Ran {
+		if ran == hash {
+			return s
+		}
+	}
+	s.Ran = append(s.Ran, hash)
+	return s
+}
+
+// Runs the scripts in the synced index that are due. The state is written
+// after every script, so a failure doesn't rerun the scripts before it
+func runScripts(syncConfig SyncConfig, synced map[string]FileInfo, path string) ([]string, error) {
+	ran := []string{}
+	scripts := []string{}
+	hashes := hashesByPath(synced)
+	cipher := newSyncCipher(syncConfig)
+	for id := range hashes {
+		if entry, ok := syncConfig.Entry(id); ok && entry.Run != "" {
+			scripts = append(scripts, id)
+		}
+	}
+	if len(scripts) == 0 {
+		return ran, nil
+	}
+	// Scripts run in the order of their names, like in a .d directory
+	sort.Strings(scripts)
+	state, err := readState(path)
+	if err != nil {
+		return ran, err
+	}
+	for _, id := range scripts {
+		entry, _ := syncConfig.Entry(id)
+		hash := hashes[id]
+		if !state.Scripts[id].shouldRun(entry.Run, hash) {
+			continue
+		}
+		local, err := localFileHash(entry, cipher)
+		if err != nil {
+			return ran, err
+		}
+		if local != hash {
+			log.WithField("file", entry.Path).Warning("Script differs from the synced version, not running it")
+			continue
+		}
+		runErr := runCommand(scriptCommand(expandHome(entry.Path)), entry.Path, scriptTimeout(syncConfig.Hooks), []string{
+			"DOTSYNC_HOOK=script",
+			"DOTSYNC_FILE=" + expandHome(entry.Path),
+			"DOTSYNC_OLD_HASH=" + state.Scripts[id].Hash,
+			"DOTSYNC_NEW_HASH=" + hash,
+		})
+		if err = hookFailure(syncConfig.Hooks, "script", entry.Path, runErr); err != nil {
+			return ran, err
+		}
+		if runErr != nil {
+			continue
+		}
+		state.Scripts[id] = state.Scripts[id].ranWith(hash)
+		if err = state.write(path); err != nil {
+			return ran, err
+		}
+		ran = append(ran, entry.Path)
+	}
+	return ran, nil
+}
+
+func scriptCommand(scriptPath string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", scriptPath)
+	}
+	if info, err := aferoFs.Stat(scriptPath); err == nil && info.Mode().Perm()&0111 != 0 {
+		return exec.Command(scriptPath)
+	}
+	return exec.Command("sh", scriptPath)
+}
+
+func scriptTimeout(hooks HooksConfig) time.Duration {
+	if hooks.ScriptTimeout == 0 {
+		return DefaultScriptTimeout
+	}
+	return hooks.ScriptTimeout
+}
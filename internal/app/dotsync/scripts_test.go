@@ -0,0 +1,112 @@
+package dotsync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// Scripts are run from the disk, so these tests use the real filesystem
+func scriptSetup(t *testing.T, run RunPolicy) (SyncConfig, string, string, string) {
+	requireShell(t)
+	fs := aferoFs.Fs
+	aferoFs.Fs = afero.NewOsFs()
+	t.Cleanup(func() { aferoFs.Fs = fs })
+	dir := t.TempDir()
+	script := filepath.Join(dir, "setup.sh")
+	out := filepath.Join(dir, "out")
+	assert.NoError(t, os.WriteFile(script, []byte(`echo "$DOTSYNC_FILE" >> `+out+"\n"), 0644))
+	syncConfig := SyncConfig{Files: []FileEntry{{Path: script, Run: run}}}
+	return syncConfig, script, out, filepath.Join(dir, "state.json")
+}
+
+func syncedScript(t *testing.T, script string) map[string]FileInfo {
+	hash, err := localFileHash(FileEntry{Path: script}, nil)
+	assert.NoError(t, err)
+	return map[string]FileInfo{hash: {Path: script}}
+}
+
+func runs(t *testing.T, out string) int {
+	content, err := os.ReadFile(out)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	assert.NoError(t, err)
+	lines := 0
+	for _, c := range content {
+		if c == '\n' {
+			lines++
+		}
+	}
+	return lines
+}
+
+func TestScriptRunsOnce(t *testing.T) {
+	syncConfig, script, out, state := scriptSetup(t, RunOnce)
+	first := syncedScript(t, script)
+	ran, err := runScripts(syncConfig, first, state)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{script}, ran)
+	ran, err = runScripts(syncConfig, first, state)
+	assert.NoError(t, err)
+	assert.Empty(t, ran)
+
+	// New content runs, going back to content that ran doesn't
+	original, _ := os.ReadFile(script)
+	assert.NoError(t, os.WriteFile(script, append(original, []byte("true\n")...), 0644))
+	_, err = runScripts(syncConfig, syncedScript(t, script), state)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(script, original, 0644))
+	_, err = runScripts(syncConfig, first, state)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, runs(t, out))
+}
+
+func TestScriptRunsOnChange(t *testing.T) {
+	syncConfig, script, out, state := scriptSetup(t, RunOnChange)
+	first := syncedScript(t, script)
+	_, err := runScripts(syncConfig, first, state)
+	assert.NoError(t, err)
+	_, err = runScripts(syncConfig, first, state)
+	assert.NoError(t, err)
+
+	original, _ := os.ReadFile(script)
+	assert.NoError(t, os.WriteFile(script, append(original, []byte("true\n")...), 0644))
+	_, err = runScripts(syncConfig, syncedScript(t, script), state)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(script, original, 0644))
+	_, err = runScripts(syncConfig, first, state)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, runs(t, out))
+}
+
+func TestScriptChangedLocallyDoesNotRun(t *testing.T) {
+	syncConfig, script, out, state := scriptSetup(t, RunOnce)
+	synced := syncedScript(t, script)
+	assert.NoError(t, os.WriteFile(script, []byte("echo local >> "+out+"\n"), 0644))
+	ran, err := runScripts(syncConfig, synced, state)
+	assert.NoError(t, err)
+	assert.Empty(t, ran)
+	assert.Equal(t, 0, runs(t, out))
+}
+
+func TestFailedScriptRunsAgain(t *testing.T) {
+	syncConfig, script, _, state := scriptSetup(t, RunOnce)
+	assert.NoError(t, os.WriteFile(script, []byte("exit 1\n"), 0644))
+	synced := syncedScript(t, script)
+	_, err := runScripts(syncConfig, synced, state)
+	assert.ErrorIs(t, err, ErrHookFailed)
+
+	syncConfig.Hooks.OnFailure = HookWarn
+	ran, err := runScripts(syncConfig, synced, state)
+	assert.NoError(t, err)
+	assert.Empty(t, ran)
+	saved, err := readState(state)
+	assert.NoError(t, err)
+	assert.Empty(t, saved.Scripts)
+
+	assert.ErrorIs(t, RunPolicy("always").Validate(), ErrInvalidRunPolicy)
+}
@@ -0,0 +1,69 @@
+package dotsync
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Local state of this machine, things that must never be synced
+
+const DefaultStateFileName = "state.json"
+
+// What ran of a script, keyed by the identity of the file
+type scriptState struct {
+	// Hash of the content that last ran
+	Hash string `json:"hash"`
+	// Every content that ran, for scripts that run once
+	Ran     []string  `json:"ran,omitempty"`
+	LastRun time.Time `json:"lastRun"`
+}
+
+type localState struct {
+	Scripts map[string]scriptState `json:"scripts,omitempty"`
+	// Hash of every file at its last sync, see sync.go
+	Synced map[string]string `json:"synced,omitempty"`
+	// Files waiting for a conflict to be resolved, see merge.go
+	Conflicts map[string]conflictState `json:"conflicts,omitempty"`
+}
+
+func statePath() string {
+	return filepath.Join(filepath.Dir(getConfigPath()), DefaultStateFileName)
+}
+
+// A missing state file is an empty state
+func readState(path string) (*localState, error) {
+	state := &localState{}
+	bytes, err := aferoFs.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(bytes, state); err != nil {
+			return nil, err
+		}
+	}
+	if state.Scripts == nil {
+		state.Scripts = make(map[string]scriptState)
+	}
+	if state.Synced == nil {
+		state.Synced = make(map[string]string)
+	}
+	if state.Conflicts == nil {
+		state.Conflicts = make(map[string]conflictState)
+	}
+	return state, nil
+}
+
+func (s *localState) write(path string) error {
+	bytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = aferoFs.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(bytes, '\n'), 0600)
+}
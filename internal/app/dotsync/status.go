@@ -0,0 +1,105 @@
+package dotsync
+
+import (
+	"context"
+	"fmt"
+)
+
+// State of a tracked file compared to its last synced version
+type FileState string
+
+const (
+	StateUnchanged FileState = "unchanged"
+	StateModified  FileState = "modified"
+	// Never synced
+	StateNew FileState = "new"
+	// Synced, but missing locally
+	StateMissing FileState = "missing"
+	// Waiting for conflicting changes to be resolved, see merge.go
+	StateConflict FileState = "conflict"
+)
+
+type FileStatus struct {
+	Path  string    `json:"path"`
+	State FileState `json:"state"`
+	// Hash of the file in the index, empty if it was never synced
+	SyncedHash string `json:"syncedHash"`
+	// Hash of the local file as it would be indexed, empty if there is none.
+	// Equal to the synced hash when the file is unchanged
+	LocalHash string `json:"localHash"`
+}
+
+// Returns the state of every tracked file
+func statusTracked(syncConfig SyncConfig) ([]FileStatus, error) {
+	synced := hashesByPath(readIndexFile(syncConfig.IndexDir()))
+	cipher := newSyncCipher(syncConfig)
+	saved, err := readState(statePath())
+	if err != nil {
+		return nil, err
+	}
+	statuses := []FileStatus{}
+	for _, entry := range syncConfig.Files {
+		d, err := compareTracked(syncConfig, entry, synced[entry.ID()], cipher)
+		if err != nil {
+			return nil, err
+		}
+		state := StateUnchanged
+		conflict, conflicted := saved.Conflicts[entry.ID()]
+		switch {
+		case conflicted && !conflict.resolved():
+			state = StateConflict
+		case d.Synced == nil && d.Local == nil:
+			state = StateMissing
+		case d.Synced == nil:
+			state = StateNew
+		case d.Local == nil:
+			state = StateMissing
+		}
+		// Hashed like when indexing, so templates hash their source
+		local, err := localFileHash(entry, cipher)
+		if err != nil {
+			return nil, err
+		}
+		// Templates also changed when their source did, see template.go
+		if state == StateUnchanged && (d.changed() || local != synced[entry.ID()]) {
+			state = StateModified
+		}
+		statuses = append(statuses, FileStatus{
+			Path:       entry.Path,
+			State:      state,
+			SyncedHash: synced[entry.ID()],
+			LocalHash:  local,
+		})
+	}
+	return statuses, nil
+}
+
+// Prints the state of every tracked file
+func Status(opts Options) {
+	statuses, err := Statuses(context.Background(), opts)
+	if err != nil {
+		log.Error("Failed to get status of files ", err)
+		exitWith(opts, StatusResult{Files: []FileStatus{}, Error: resultError(CodeFailed, err)}, err)
+	}
+	if opts.Output == OutputJSON {
+		printJSON(StatusResult{Files: statuses}, nil)
+		return
+	}
+	for _, s := range statuses {
+		fmt.Printf("%-10s %s\n", s.State, s.Path)
+	}
+}
+
+// Returns the state of every tracked file. Errors are an *Error
+func Statuses(ctx context.Context, opts Options) ([]FileStatus, error) {
+	defer opts.useEnvironment()()
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		return nil, newError(CodeConfig, err)
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, newError(CodeFailed, err)
+	}
+	statuses, err := statusTracked(syncConfig)
+	return statuses, newError(CodeFailed, err)
+}
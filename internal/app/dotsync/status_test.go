@@ -0,0 +1,39 @@
+package dotsync
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusTracked(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	files := []string{"/home/user/unchanged", "/home/user/modified", "/home/user/new", "/home/user/missing"}
+	synced := map[string]FileInfo{}
+	assert.NoError(t, aferoFs.MkdirAll(dotsyncPath, 0755))
+	for _, path := range []string{files[0], files[1], files[3]} {
+		content := []byte(path + "\n")
+		hash := sha1Hash(content)
+		synced[hash] = FileInfo{Path: path, Perm: 0644}
+		assert.NoError(t, aferoFs.WriteFile(filepath.Join(dotsyncPath, hash), content, 0666))
+	}
+	assert.NoError(t, writeIndexFile(dotsyncPath, synced))
+	assert.NoError(t, aferoFs.WriteFile(files[0], []byte(files[0]+"\n"), 0644))
+	assert.NoError(t, aferoFs.WriteFile(files[1], []byte("changed\n"), 0644))
+	assert.NoError(t, aferoFs.WriteFile(files[2], []byte("new\n"), 0644))
+
+	syncConfig := syncConfigWith(files...)
+	statuses, err := statusTracked(syncConfig)
+	assert.NoError(t, err)
+	hash := func(content string) string {
+		return sha1Hash([]byte(content))
+	}
+	assert.Equal(t, []FileStatus{
+		{Path: files[0], State: StateUnchanged, SyncedHash: hash(files[0] + "\n"), LocalHash: hash(files[0] + "\n")},
+		{Path: files[1], State: StateModified, SyncedHash: hash(files[1] + "\n"), LocalHash: hash("changed\n")},
+		{Path: files[2], State: StateNew, LocalHash: hash("new\n")},
+		{Path: files[3], State: StateMissing, SyncedHash: hash(files[3] + "\n")},
+	}, statuses)
+}
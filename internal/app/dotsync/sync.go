@@ -0,0 +1,300 @@
+package dotsync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+# Sync
+Push only writes local changes and pull only applies remote ones, sync does
+both. The hash of every file at its last sync is kept in the local state.
+Comparing the local file and the remote version to it tells which side
+changed
+
+	unchanged       local and remote are equal
+	local           only the local file changed, it is pushed
+	remote          only the remote changed, it is restored
+	both            both changed, they are merged, see merge.go
+	deleted-local   the local file was removed, the missing policy decides
+	deleted-remote  the remote removed the file, the local file is backed up
+	                and removed unless its pull policy is skip
+
+Files changed on both sides that couldn't be merged are not pushed, the
+remote version is kept until the conflict is resolved. Without a recorded
+hash the index from before the pull is the base.
+
+Push and pull record the hashes too. Files left out by --tag keep the hash
+from before the repository was updated, as it moves past their local version.
+*/
+
+type FileChange string
+
+const (
+	ChangeNone          FileChange = "unchanged"
+	ChangeLocal         FileChange = "local"
+	ChangeRemote        FileChange = "remote"
+	ChangeBoth          FileChange = "both"
+	ChangeLocalDeleted  FileChange = "deleted-local"
+	ChangeRemoteDeleted FileChange = "deleted-remote"
+)
+
+type FileSync struct {
+	Path   string     `json:"path"`
+	Change FileChange `json:"change"`
+}
+
+// Decides which side of a file changed from its hashes. Empty hashes are
+// missing files
+func classifyChange(local, base, remote string) FileChange {
+	switch {
+	case local == remote:
+		return ChangeNone
+	case base == remote && local == "":
+		return ChangeLocalDeleted
+	case base == remote:
+		return ChangeLocal
+	case base == local && remote == "":
+		return ChangeRemoteDeleted
+	case base == local:
+		return ChangeRemote
+	// A change wins over a delete
+	case local == "":
+		return ChangeRemote
+	case remote == "":
+		return ChangeLocal
+	}
+	return ChangeBoth
+}
+
+// Returns the change of every tracked file, sorted by path
+func classifyTracked(syncConfig SyncConfig, cipher *blobCipher, state *localState, before, remote map[string]FileInfo) ([]FileSync, error) {
+	beforeHashes, remoteHashes := hashesByPath(before), hashesByPath(remote)
+	changes := []FileSync{}
+	for _, entry := range syncConfig.Files {
+		id := entry.ID()
+		local, err := localFileHash(entry, cipher)
+		if err != nil {
+			return nil, err
+		}
+		base := state.syncedHash(id, beforeHashes)
+		changes = append(changes, FileSync{
+			Path:   id,
+			Change: classifyChange(local, base, remoteHashes[id]),
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func syncBoth(syncConfig SyncConfig) ([]FileSync, error) {
+	if err := runHook(syncConfig.Hooks, HookPrePush); err != nil {
+		return nil, err
+	}
+	if err := runHook(syncConfig.Hooks, HookPreRestore); err != nil {
+		return nil, err
+	}
+	repository, err := NewRepository(syncConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+	if err = RecoverSync(syncConfig.IndexDir()); err != nil {
+		return nil, fmt.Errorf("failed to recover interrupted sync: %w", err)
+	}
+	before := readIndexFile(syncConfig.IndexDir())
+	history := commitBlobs{repository: repository, commit: repository.headCommit(), syncConfig: syncConfig}
+	if err = repository.tryAndUpdate(syncConfig.context()); err != nil {
+		return nil, fmt.Errorf("failed to update repository: %w", err)
+	}
+	remote := readIndexFile(syncConfig.IndexDir())
+
+	restorer, err := newRestorer(syncConfig, history)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := classifyTracked(syncConfig, restorer.cipher, restorer.state, before, remote)
+	if err != nil {
+		return nil, err
+	}
+	incoming := map[string]FileInfo{}
+	base := map[string]FileInfo{}
+	removed := map[string]bool{}
+	beforeHashes := hashesByPath(before)
+	for _, change := range changes {
+		entry, _ := syncConfig.Entry(change.Path)
+		switch change.Change {
+		case ChangeRemote, ChangeBoth:
+			for hash, info := range remote {
+				if info.Path == change.Path {
+					incoming[hash] = info
+				}
+			}
+			if hash := restorer.state.syncedHash(change.Path, beforeHashes); hash != "" {
+				base[hash] = FileInfo{Path: change.Path}
+			}
+		case ChangeRemoteDeleted:
+			// Skipped files keep their local version, which is pushed again
+			if syncConfig.PullPolicy(entry) == PullSkip {
+				log.WithField("file", entry.Path).Info("Keeping file deleted on the remote")
+				continue
+			}
+			log.WithField("file", entry.Path).Info("Removing file deleted on the remote, undo brings it back")
+			if err = restorer.remove(entry); err != nil {
+				return changes, err
+			}
+			removed[change.Path] = true
+		}
+	}
+	restored, err := restorer.restore(base, incoming)
+	if err != nil {
+		return changes, err
+	}
+
+	// Files changed on both sides are only pushed once they are merged
+	held := []string{}
+	for _, change := range changes {
+		entry, _ := syncConfig.Entry(change.Path)
+		if change.Change != ChangeBoth || syncConfig.PullPolicy(entry) == PullSkip {
+			continue
+		}
+		if !containsString(restored, change.Path) {
+			held = append(held, change.Path)
+		}
+	}
+	pushConfig := syncConfig
+	pushConfig.Files = []FileEntry{}
+	for _, entry := range syncConfig.Files {
+		if !removed[entry.ID()] {
+			pushConfig.Files = append(pushConfig.Files, entry)
+		}
+	}
+	// The state of the restore, so the conflicts resolved by the push stay resolved
+	synced, err := pushFiles(repository, pushConfig, restorer.state, held)
+	if err != nil {
+		return changes, err
+	}
+	restorer.state.keepUnselected(syncConfig, before)
+	if err = recordSynced(syncConfig, restorer.cipher, restorer.state, synced, removed); err != nil {
+		return changes, err
+	}
+
+	ran, err := runScripts(syncConfig, synced, statePath())
+	if err != nil {
+		return changes, err
+	}
+	if len(ran) > 0 {
+		log.WithField("scripts", ran).Info(fmt.Sprintf("ran %d scripts", len(ran)))
+	}
+	if err = runHook(syncConfig.Hooks, HookPostRestore, "DOTSYNC_FILES="+strings.Join(restored, "\n")); err != nil {
+		return changes, err
+	}
+	return changes, runHook(syncConfig.Hooks, HookPostPush)
+}
+
+// Records the synced hash of every file both sides agree on. Files with a
+// conflict were merged against the remote version, it is their new base
+func recordSynced(syncConfig SyncConfig, cipher *blobCipher, state *localState, synced map[string]FileInfo, removed map[string]bool) error {
+	hashes := hashesByPath(synced)
+	for id := range removed {
+		delete(state.Synced, id)
+	}
+	for id, hash := range hashes {
+		entry, ok := syncConfig.Entry(id)
+		if !ok {
+			continue
+		}
+		local, err := localFileHash(entry, cipher)
+		if err != nil {
+			return err
+		}
+		if _, conflicted := state.Conflicts[id]; local == hash || conflicted {
+			state.Synced[id] = hash
+		}
+	}
+	return state.write(statePath())
+}
+
+// Hash of the file at its last sync, falling back on the given hashes
+func (s *localState) syncedHash(id string, fallback map[string]string) string {
+	if hash, ok := s.Synced[id]; ok {
+		return hash
+	}
+	return fallback[id]
+}
+
+// The index from before a pull with the hashes of the local state in place of
+// the indexed ones, the base of every file at its last sync
+func (s *localState) baseIndex(before map[string]FileInfo) map[string]FileInfo {
+	base := make(map[string]FileInfo, len(before))
+	for hash, info := range before {
+		if _, ok := s.Synced[info.Path]; !ok {
+			base[hash] = info
+		}
+	}
+	for id, hash := range s.Synced {
+		base[hash] = FileInfo{Path: id}
+	}
+	return base
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Pushes local changes and restores remote changes in one go
+func SyncBoth(opts Options) {
+	ctx, stop := interruptContext()
+	defer stop()
+	result, err := Sync(ctx, opts)
+	if err != nil {
+		log.Error("Failed to sync ", err)
+	}
+	if opts.Output == OutputJSON {
+		printJSON(result, err)
+		return
+	}
+	for _, change := range result.Changes {
+		if change.Change != ChangeNone {
+			fmt.Printf("%-15s %s\n", change.Change, change.Path)
+		}
+	}
+	if err != nil {
+		os.Exit(exitCode(err))
+	}
+}
+
+// Pushes local changes and restores remote changes, and reports which side of
+// every file changed. Errors are an *Error
+func Sync(ctx context.Context, opts Options) (SyncResult, error) {
+	defer opts.useEnvironment()()
+	results := opts.collectResults()
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		err = newError(CodeConfig, err)
+		opts.done(err)
+		return results.sync(syncConfig, nil, err), err
+	}
+	opts.setupLogging(syncConfig)
+	syncConfig.Context = ctx
+	var changes []FileSync
+	err = ctx.Err()
+	if err == nil {
+		err = withLock(syncConfig, opts.LockWait, func() error {
+			changes, err = syncBoth(syncConfig)
+			return err
+		})
+	}
+	err = newError(CodeFailed, err)
+	opts.done(err)
+	return results.sync(syncConfig, changes, err), err
+}
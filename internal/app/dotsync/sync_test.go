@@ -0,0 +1,170 @@
+package dotsync
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyChange(t *testing.T) {
+	tests := []struct {
+		local, base, remote string
+		change              FileChange
+	}{
+		{"a", "a", "a", ChangeNone},
+		{"b", "a", "b", ChangeNone},
+		{"b", "a", "a", ChangeLocal},
+		{"a", "", "", ChangeLocal},
+		{"a", "a", "b", ChangeRemote},
+		{"", "", "b", ChangeRemote},
+		{"b", "a", "c", ChangeBoth},
+		{"b", "", "c", ChangeBoth},
+		{"", "a", "a", ChangeLocalDeleted},
+		{"a", "a", "", ChangeRemoteDeleted},
+		// Changes win over deletes
+		{"", "a", "b", ChangeRemote},
+		{"b", "a", "", ChangeLocal},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.change, classifyChange(test.local, test.base, test.remote),
+			"local %q base %q remote %q", test.local, test.base, test.remote)
+	}
+}
+
+func TestClassifyTracked(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	files := []string{"/home/user/a", "/home/user/b"}
+	for _, path := range files {
+		assert.NoError(t, aferoFs.WriteFile(path, []byte(path), 0644))
+	}
+	hashA, hashB := sha1Hash([]byte(files[0])), sha1Hash([]byte(files[1]))
+	// a was last synced by this machine as "old", b never was
+	state := &localState{Synced: map[string]string{files[0]: "old"}}
+	before := map[string]FileInfo{hashA: {Path: files[0]}, "before": {Path: files[1]}}
+	remote := map[string]FileInfo{hashA: {Path: files[0]}, "before": {Path: files[1]}}
+
+	changes, err := classifyTracked(syncConfigWith(files...), nil, state, before, remote)
+	assert.NoError(t, err)
+	assert.Equal(t, []FileSync{
+		{Path: files[0], Change: ChangeNone},
+		{Path: files[1], Change: ChangeLocal},
+	}, changes)
+
+	remote = map[string]FileInfo{"new": {Path: files[0]}, hashB: {Path: files[1]}}
+	changes, err = classifyTracked(syncConfigWith(files...), nil, state, before, remote)
+	assert.NoError(t, err)
+	assert.Equal(t, ChangeBoth, changes[0].Change)
+	assert.Equal(t, ChangeNone, changes[1].Change)
+}
+
+func TestRecordSynced(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	files := []string{"/home/user/a", "/home/user/b", "/home/user/c"}
+	for _, path := range files {
+		assert.NoError(t, aferoFs.WriteFile(path, []byte(path), 0644))
+	}
+	state, err := readState(statePath())
+	assert.NoError(t, err)
+	state.Synced[files[1]] = "old"
+	state.Synced["/home/user/removed"] = "old"
+	state.Conflicts[files[2]] = conflictState{File: files[2]}
+	synced := map[string]FileInfo{
+		sha1Hash([]byte(files[0])): {Path: files[0]},
+		"held":                     {Path: files[1]},
+		"remote":                   {Path: files[2]},
+	}
+	assert.NoError(t, recordSynced(syncConfigWith(files...), nil, state, synced,
+		map[string]bool{"/home/user/removed": true}))
+
+	saved, err := readState(statePath())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		files[0]: sha1Hash([]byte(files[0])),
+		files[1]: "old",
+		files[2]: "remote",
+	}, saved.Synced)
+}
+
+func TestRemovedFilesCanBeUndone(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	path := "/home/user/.vimrc"
+	assert.NoError(t, aferoFs.WriteFile(path, []byte("set nu\n"), 0600))
+	syncConfig := syncConfigWith(path)
+	syncConfig.Backups.Dir = backupPath
+	restorer, err := newRestorer(syncConfig, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, restorer.remove(syncConfig.Files[0]))
+	exists, _ := aferoFs.Exists(path)
+	assert.False(t, exists)
+
+	reverted, err := undoBackup(syncConfig, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path}, reverted)
+	content, _ := aferoFs.ReadFile(path)
+	assert.Equal(t, "set nu\n", string(content))
+}
+
+func TestBlobsFromHistory(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	assert.NoError(t, err)
+	worktree, err := repo.Worktree()
+	assert.NoError(t, err)
+	commit := func(message string) {
+		_, err := worktree.Commit(message, &git.CommitOptions{
+			Author: &object.Signature{Name: "dotsync", When: time.Now()},
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "base"), []byte("base content"), 0644))
+	_, err = worktree.Add("sub/base")
+	assert.NoError(t, err)
+	commit("add base")
+	_, err = worktree.Remove("sub/base")
+	assert.NoError(t, err)
+	commit("remove base")
+
+	r := &repository{Repo: repo}
+	history := commitBlobs{repository: r, commit: r.headCommit(), syncConfig: SyncConfig{Subdir: "sub"}}
+	blob, err := history.blobAt("base")
+	assert.NoError(t, err)
+	assert.Equal(t, "base content", string(blob))
+	_, err = history.blobAt("other")
+	assert.ErrorIs(t, err, object.ErrFileNotFound)
+}
+
+func TestSyncResult(t *testing.T) {
+	remote := newRemote(t)
+	first := newMachine(t, remote, ".vimrc")
+	first.write(".vimrc", "set nu\n")
+	assert.NoError(t, first.run(syncOrigin))
+	second := newMachine(t, remote, ".vimrc")
+	assert.NoError(t, second.run(syncLocal))
+	first.write(".vimrc", "set nonu\n")
+	assert.NoError(t, first.run(syncOrigin))
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	var result SyncResult
+	assert.NoError(t, second.run(func(syncConfig SyncConfig) (err error) {
+		result, err = Sync(context.Background(), Options{Config: &syncConfig, Logger: logger})
+		return err
+	}))
+	assert.Equal(t, []FileSync{{Path: "~/.vimrc", Change: ChangeRemote}}, result.Changes)
+	assert.Equal(t, []SyncedFile{{Path: "~/.vimrc", Result: ResultRestored, Hash: sha1Hash([]byte("set nonu\n"))}}, result.Files)
+	// Nothing changed locally, so nothing was committed
+	assert.Empty(t, result.Commit)
+	assert.False(t, result.Pushed)
+	assert.Nil(t, result.Error)
+	assert.Equal(t, "set nonu\n", second.read(".vimrc"))
+}
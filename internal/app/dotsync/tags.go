@@ -0,0 +1,64 @@
+package dotsync
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Keeps only the tracked files that have one of the tags
+func (s *SyncConfig) selectTags(tags []string) error {
+	selected := []FileEntry{}
+	for _, f := range s.Files {
+		if f.hasTag(tags) {
+			selected = append(selected, f)
+		}
+	}
+	if len(selected) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoTaggedFiles, strings.Join(tags, ", "))
+	}
+	s.Files = selected
+	s.Tags = tags
+	return nil
+}
+
+func (f FileEntry) hasTag(tags []string) bool {
+	for _, tag := range tags {
+		for _, t := range f.Tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// When syncing a selection of the files, the files outside the selection are
+// carried over from the current index, so they are neither copied nor cleaned
+// up. Must be called after the index file has been parsed
+func (index *Indexes) carryOver(syncConfig SyncConfig) {
+	if len(syncConfig.Tags) == 0 {
+		return
+	}
+	for hash, info := range index.Current {
+		if _, selected := syncConfig.Entry(info.Path); !selected {
+			index.New[hash] = info
+		}
+	}
+}
+
+// Files outside a selection aren't restored or pushed, but updating the
+// repository moves the index past them. Their hash from before the update is
+// kept in the local state, as the base for the next sync that selects them
+func (s *localState) keepUnselected(syncConfig SyncConfig, before map[string]FileInfo) {
+	if len(syncConfig.Tags) == 0 {
+		return
+	}
+	for id, hash := range hashesByPath(before) {
+		if _, selected := syncConfig.Entry(id); selected {
+			continue
+		}
+		if _, ok := s.Synced[id]; !ok {
+			s.Synced[id] = hash
+		}
+	}
+}
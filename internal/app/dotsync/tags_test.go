@@ -0,0 +1,62 @@
+package dotsync
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectTags(t *testing.T) {
+	syncConfig := SyncConfig{Files: []FileEntry{
+		{Path: "~/.zshrc", Tags: []string{"shell"}},
+		{Path: "~/.vimrc", Tags: []string{"editor"}},
+		{Path: "~/.tmux.conf", Tags: []string{"shell", "work"}},
+		{Path: "~/.netrc"},
+	}}
+	selected := syncConfig
+	assert.NoError(t, selected.selectTags([]string{"shell"}))
+	assert.Equal(t, []string{"~/.zshrc", "~/.tmux.conf"}, selected.FilePaths())
+	assert.Equal(t, []string{"shell"}, selected.Tags)
+
+	selected = syncConfig
+	assert.NoError(t, selected.selectTags([]string{"editor", "work"}))
+	assert.Equal(t, []string{"~/.vimrc", "~/.tmux.conf"}, selected.FilePaths())
+
+	selected = syncConfig
+	assert.ErrorIs(t, selected.selectTags([]string{"games"}), ErrNoTaggedFiles)
+}
+
+func TestUnselectedFilesAreCarriedOver(t *testing.T) {
+	_, newFiles := initalise()
+	synced := InitialiseIndex(syncConfigWith(newFiles...)).New
+	assert.NoError(t, writeIndexFile(dotsyncPath, synced))
+	for hash := range synced {
+		assert.NoError(t, aferoFs.WriteFile(filepath.Join(dotsyncPath, hash), []byte(hash), 0666))
+	}
+	for _, path := range newFiles {
+		fillFileWithData(path)
+	}
+
+	syncConfig := syncConfigWith(newFiles...)
+	syncConfig.Files[0].Tags = []string{"shell"}
+	assert.NoError(t, syncConfig.selectTags([]string{"shell"}))
+	index := InitialiseIndex(syncConfig)
+	index.ParseIndexFile(dotsyncPath)
+	index.carryOver(syncConfig)
+	newIndex, err := index.CopyAndCleanup(syncConfig)
+	assert.NoError(t, err)
+
+	// Only the selected file changed, the others are kept as they were synced
+	paths := hashesByPath(newIndex)
+	assert.Len(t, paths, len(newFiles))
+	assert.Equal(t, hashesOf(newFiles[:1])[0], paths[newFiles[0]])
+	for hash, info := range synced {
+		if info.Path != newFiles[0] {
+			assert.Equal(t, hash, paths[info.Path])
+			exists, _ := aferoFs.Exists(filepath.Join(dotsyncPath, hash))
+			assert.True(t, exists)
+		}
+	}
+	assert.Len(t, index.Current, 1)
+}
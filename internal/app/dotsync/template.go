@@ -0,0 +1,129 @@
+package dotsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+/*
+# Templates
+A file marked with template is synced from its template, the source, instead
+of from the file itself. The source lives next to the file, as the file with
+.tmpl appended, unless configured otherwise. Restoring writes the source and
+renders it to the file with text/template, using
+
+	{{ .Hostname }} {{ .OS }} {{ .Arch }} {{ .User }} {{ .Home }}
+	{{ .Env.EDITOR }} {{ .Vars.email }}
+
+where Vars are the variables from the config. A variable or environment
+variable that doesn't exist is an error rather than an empty string.
+
+A template counts as changed locally when its source differs from the synced
+source, which is what a push syncs, or when the rendered file differs from the
+render of the source, which means it was edited by hand. Pulls don't overwrite
+a rendered file edited by hand unless the pull policy is overwrite.
+*/
+
+const TemplateSuffix = ".tmpl"
+
+var ErrTemplate = errors.New("failed to render template")
+
+type templateData struct {
+	Hostname string
+	OS       string
+	Arch     string
+	User     string
+	Home     string
+	Env      map[string]string
+	Vars     map[string]interface{}
+}
+
+// Path of the file that is synced for the entry, the template source for
+// templates and the file itself otherwise
+func (f FileEntry) sourcePath() string {
+	if !f.Template {
+		return expandHome(f.Path)
+	}
+	if f.Source != "" {
+		return expandHome(f.Source)
+	}
+	return expandHome(f.Path) + TemplateSuffix
+}
+
+func newTemplateData(variables map[string]interface{}) templateData {
+	data := templateData{
+		OS:   runtime.GOOS,
+		Arch: runtime.GOARCH,
+		Env:  make(map[string]string),
+		Vars: variables,
+	}
+	if data.Vars == nil {
+		data.Vars = make(map[string]interface{})
+	}
+	data.Hostname, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		data.User = u.Username
+	}
+	data.Home, _ = os.UserHomeDir()
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			data.Env[k] = v
+		}
+	}
+	return data
+}
+
+func renderTemplate(name string, source []byte, data templateData) ([]byte, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(source))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTemplate, err)
+	}
+	var out bytes.Buffer
+	if err = tmpl.Execute(&out, data); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTemplate, err)
+	}
+	return out.Bytes(), nil
+}
+
+// Reports if the rendered file of a template differs from the render of its
+// source. Missing files and sources that don't render aren't edits
+func renderEdited(syncConfig SyncConfig, entry FileEntry) (bool, error) {
+	if !entry.Template {
+		return false, nil
+	}
+	source, err := aferoFs.ReadFile(entry.sourcePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	rendered, err := aferoFs.ReadFile(expandHome(entry.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	expected, err := renderTemplate(entry.Path, source, newTemplateData(syncConfig.Variables))
+	if err != nil {
+		return false, nil
+	}
+	return !bytes.Equal(rendered, expected), nil
+}
+
+// Warns about rendered files edited by hand, only their templates are pushed
+func warnEditedRenders(syncConfig SyncConfig) {
+	for _, entry := range syncConfig.Files {
+		if edited, _ := renderEdited(syncConfig, entry); edited {
+			log.WithField("file", entry.Path).
+				Warning("Rendered file was edited, the change isn't pushed. Make it in the template")
+		}
+	}
+}
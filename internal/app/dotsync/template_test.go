@@ -0,0 +1,124 @@
+package dotsync
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const gitconfigTemplate = `[user]
+  email = {{ .Vars.email }}
+  os = {{ .OS }}
+`
+
+func TestRenderTemplate(t *testing.T) {
+	data := newTemplateData(map[string]interface{}{"email": "me@example.com"})
+	rendered, err := renderTemplate("gitconfig", []byte(gitconfigTemplate), data)
+	assert.NoError(t, err)
+	assert.Equal(t, "[user]\n  email = me@example.com\n  os = "+runtime.GOOS+"\n", string(rendered))
+
+	_, err = renderTemplate("gitconfig", []byte(gitconfigTemplate), newTemplateData(nil))
+	assert.ErrorIs(t, err, ErrTemplate)
+	_, err = renderTemplate("gitconfig", []byte("{{ .Vars.email "), data)
+	assert.ErrorIs(t, err, ErrTemplate)
+}
+
+func TestSourcePath(t *testing.T) {
+	assert.Equal(t, "/home/user/.gitconfig", FileEntry{Path: "/home/user/.gitconfig"}.sourcePath())
+	assert.Equal(t, "/home/user/.gitconfig.tmpl",
+		FileEntry{Path: "/home/user/.gitconfig", Template: true}.sourcePath())
+	assert.Equal(t, "/templates/gitconfig",
+		FileEntry{Path: "/home/user/.gitconfig", Template: true, Source: "/templates/gitconfig"}.sourcePath())
+}
+
+func TestTemplateSyncAndRestore(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	entry := FileEntry{Path: "/home/user/.gitconfig", Template: true}
+	syncConfig := SyncConfig{
+		Path:      dotsyncPath,
+		Variables: map[string]interface{}{"email": "me@example.com"},
+		Files:     []FileEntry{entry},
+	}
+	assert.NoError(t, aferoFs.WriteFile(entry.sourcePath(), []byte(gitconfigTemplate), 0644))
+
+	// The template is what gets synced
+	index := InitialiseIndex(syncConfig)
+	hash := sha1Hash([]byte(gitconfigTemplate))
+	assert.Contains(t, index.New, hash)
+	assert.Equal(t, entry.Path, index.New[hash].Path)
+	assert.NoError(t, aferoFs.MkdirAll(dotsyncPath, 0755))
+	assert.NoError(t, aferoFs.WriteFile(filepath.Join(dotsyncPath, hash), []byte(gitconfigTemplate), 0666))
+	assert.NoError(t, writeIndexFile(dotsyncPath, index.New))
+
+	// A rendered file that doesn't exist yet
+	statuses, err := statusTracked(syncConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, []FileStatus{{Path: entry.Path, State: StateMissing, SyncedHash: hash, LocalHash: hash}}, statuses)
+
+	assert.NoError(t, aferoFs.Remove(entry.sourcePath()))
+	restored, err := restoreFiles(syncConfig, map[string]FileInfo{}, index.New, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{entry.Path}, restored)
+	source, err := aferoFs.ReadFile(entry.sourcePath())
+	assert.NoError(t, err)
+	assert.Equal(t, gitconfigTemplate, string(source))
+	rendered, err := aferoFs.ReadFile(entry.Path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(rendered), "email = me@example.com")
+
+	// The rendered file matches the synced template
+	statuses, err = statusTracked(syncConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, []FileStatus{{Path: entry.Path, State: StateUnchanged, SyncedHash: hash, LocalHash: hash}}, statuses)
+	diffs, err := diffTracked(syncConfig, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+}
+
+func TestEditedRenderIsKeptOnRestore(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	entry := FileEntry{Path: "/home/user/.gitconfig", Template: true}
+	syncConfig := SyncConfig{
+		Path:      dotsyncPath,
+		Variables: map[string]interface{}{"email": "me@example.com"},
+		Files:     []FileEntry{entry},
+	}
+	assert.NoError(t, aferoFs.WriteFile(entry.sourcePath(), []byte(gitconfigTemplate), 0644))
+	index := InitialiseIndex(syncConfig)
+	hash := sha1Hash([]byte(gitconfigTemplate))
+	assert.NoError(t, aferoFs.MkdirAll(dotsyncPath, 0755))
+	assert.NoError(t, aferoFs.WriteFile(filepath.Join(dotsyncPath, hash), []byte(gitconfigTemplate), 0666))
+	assert.NoError(t, writeIndexFile(dotsyncPath, index.New))
+	assert.NoError(t, aferoFs.WriteFile(entry.Path, []byte("[user]\n  email = edited@example.com\n"), 0644))
+
+	edited, err := renderEdited(syncConfig, entry)
+	assert.NoError(t, err)
+	assert.True(t, edited)
+	statuses, err := statusTracked(syncConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, StateModified, statuses[0].State)
+
+	// The template changed remotely but the hand edit is kept
+	updated := gitconfigTemplate + "  name = me\n"
+	updatedHash := sha1Hash([]byte(updated))
+	assert.NoError(t, aferoFs.WriteFile(filepath.Join(dotsyncPath, updatedHash), []byte(updated), 0666))
+	remote := map[string]FileInfo{updatedHash: {Path: entry.Path, Perm: 0644}}
+	restored, err := restoreFiles(syncConfig, index.New, remote, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, restored)
+	rendered, err := aferoFs.ReadFile(entry.Path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(rendered), "edited@example.com")
+
+	// Overwriting replaces it
+	syncConfig.Pull = PullOverwrite
+	restored, err = restoreFiles(syncConfig, index.New, remote, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{entry.Path}, restored)
+	rendered, err = aferoFs.ReadFile(entry.Path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(rendered), "name = me")
+}
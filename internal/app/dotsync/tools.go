@@ -0,0 +1,298 @@
+package dotsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	format "github.com/go-git/go-git/v5/plumbing/format/config"
+)
+
+/*
+# External tools
+Conflicts can be merged and changes looked at in an external tool like
+vimdiff or meld. A tool is a shell command, like git's mergetool.<tool>.cmd,
+run on temporary copies of the file named by
+
+	$LOCAL   the local version, or the last synced version when diffing
+	$REMOTE  the remote version, or the local version when diffing
+	$BASE    the common ancestor, empty when there isn't one
+	$MERGED  the merged result, it starts out with conflict markers
+
+Instead of a command the name of a tool git knows can be given. Without a tool
+in the config merge.tool and diff.tool from the git config are used, along with
+their mergetool.<tool>.cmd and difftool.<tool>.cmd. The merged result is only
+read back when the tool exits successfully and changed it. The temporary files
+are removed either way.
+*/
+
+var (
+	ErrNoTool    = errors.New("no tool configured")
+	ErrNotMerged = errors.New("merge tool didn't merge the file")
+)
+
+type ToolsConfig struct {
+	// Name of a tool or a command
+	Merge string `yaml:"merge,omitempty"`
+	Diff  string `yaml:"diff,omitempty"`
+}
+
+const (
+	toolMerge = "merge"
+	toolDiff  = "diff"
+)
+
+// Commands of the tools git knows, by name
+var knownTools = map[string]map[string]string{
+	"vimdiff": {
+		toolMerge: `vimdiff -f -d -c '4wincmd w | wincmd J' "$LOCAL" "$BASE" "$REMOTE" "$MERGED"`,
+		toolDiff:  `vimdiff -f -d "$LOCAL" "$REMOTE"`,
+	},
+	"gvimdiff": {
+		toolMerge: `gvim -f -d -c '4wincmd w | wincmd J' "$LOCAL" "$BASE" "$REMOTE" "$MERGED"`,
+		toolDiff:  `gvim -f -d "$LOCAL" "$REMOTE"`,
+	},
+	"nvimdiff": {
+		toolMerge: `nvim -d -c '4wincmd w | wincmd J' "$LOCAL" "$BASE" "$REMOTE" "$MERGED"`,
+		toolDiff:  `nvim -d "$LOCAL" "$REMOTE"`,
+	},
+	"meld": {
+		toolMerge: `meld "$LOCAL" "$MERGED" "$REMOTE" --output "$MERGED"`,
+		toolDiff:  `meld "$LOCAL" "$REMOTE"`,
+	},
+	"kdiff3": {
+		toolMerge: `kdiff3 --auto --L1 base --L2 local --L3 remote -o "$MERGED" "$BASE" "$LOCAL" "$REMOTE"`,
+		toolDiff:  `kdiff3 --L1 synced --L2 local "$LOCAL" "$REMOTE"`,
+	},
+	"vscode": {
+		toolMerge: `code --wait --merge "$REMOTE" "$LOCAL" "$BASE" "$MERGED"`,
+		toolDiff:  `code --wait --diff "$LOCAL" "$REMOTE"`,
+	},
+	"opendiff": {
+		toolMerge: `opendiff "$LOCAL" "$REMOTE" -ancestor "$BASE" -merge "$MERGED" | cat`,
+		toolDiff:  `opendiff "$LOCAL" "$REMOTE" | cat`,
+	},
+}
+
+// Paths of the global git config, later ones win
+func gitConfigPaths() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" {
+		xdg = filepath.Join(home, ".config")
+	}
+	return []string{filepath.Join(xdg, "git", "config"), filepath.Join(home, ".gitconfig")}
+}
+
+// Reads an option from the global git config, empty if it isn't set
+func gitOption(section, subsection, key string) string {
+	value := ""
+	for _, path := range gitConfigPaths() {
+		content, err := aferoFs.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		config := format.New()
+		if err = format.NewDecoder(bytes.NewReader(content)).Decode(config); err != nil {
+			log.WithField("path", path).Warning("Failed to read git config ", err)
+			continue
+		}
+		s := config.Section(section)
+		if subsection != "" {
+			if !s.HasSubsection(subsection) {
+				continue
+			}
+			if v := s.Subsection(subsection).Option(key); v != "" {
+				value = v
+			}
+		} else if v := s.Option(key); v != "" {
+			value = v
+		}
+	}
+	return value
+}
+
+// Returns the command of the merge or diff tool. A configured name is looked
+// up in the git config and the known tools, anything else is a command
+func toolCommand(tools ToolsConfig, kind string) (string, error) {
+	tool := tools.Merge
+	if kind == toolDiff {
+		tool = tools.Diff
+	}
+	if tool == "" {
+		tool = gitOption(kind, "", "tool")
+	}
+	// Like git difftool, fall back on the merge tool
+	if tool == "" && kind == toolDiff {
+		if tool = tools.Merge; tool == "" {
+			tool = gitOption(toolMerge, "", "tool")
+		}
+	}
+	if tool == "" {
+		return "", fmt.Errorf("%w: set tools.%s or git's %s.tool", ErrNoTool, kind, kind)
+	}
+	if command := gitOption(kind+"tool", tool, "cmd"); command != "" {
+		return command, nil
+	}
+	if known, ok := knownTools[tool]; ok {
+		return known[kind], nil
+	}
+	if !strings.ContainsAny(tool, " $") {
+		return "", fmt.Errorf("%w: unknown tool %s", ErrNoTool, tool)
+	}
+	return tool, nil
+}
+
+// A run of an external tool on temporary copies of a file
+type ToolRun struct {
+	Cmd *exec.Cmd
+	dir string
+	// Empty when diffing
+	merged  string
+	initial []byte
+}
+
+// Writes the versions to a temporary directory, named after the file like
+// git does, and prepares the command with their paths
+func newToolRun(command, path string, versions map[string][]byte) (*ToolRun, error) {
+	dir, err := os.MkdirTemp("", "dotsync-tool-")
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	run := &ToolRun{dir: dir}
+	env := []string{}
+	for _, name := range []string{"LOCAL", "REMOTE", "BASE", "MERGED"} {
+		content, ok := versions[name]
+		if !ok {
+			// Tools that want the name of the file get the real one
+			env = append(env, name+"="+path)
+			continue
+		}
+		file := filepath.Join(dir, stem+"_"+name+ext)
+		if name == "MERGED" {
+			file = filepath.Join(dir, base)
+			run.merged, run.initial = file, content
+		}
+		if err = os.WriteFile(file, content, 0600); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		env = append(env, name+"="+file)
+	}
+	if runtime.GOOS == "windows" {
+		for _, name := range []string{"LOCAL", "REMOTE", "BASE", "MERGED"} {
+			command = strings.ReplaceAll(command, "$"+name, "%"+name+"%")
+		}
+		run.Cmd = exec.Command("cmd", "/C", command)
+	} else {
+		run.Cmd = exec.Command("sh", "-c", command)
+	}
+	run.Cmd.Env = append(os.Environ(), env...)
+	return run, nil
+}
+
+// Runs the tool in the terminal and returns the merged result
+func (r *ToolRun) Run() ([]byte, error) {
+	r.Cmd.Stdin, r.Cmd.Stdout, r.Cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return r.Finish(r.Cmd.Run())
+}
+
+// Reads the merged result back when the tool succeeded, given the error it
+// exited with, and removes the temporary files
+func (r *ToolRun) Finish(err error) ([]byte, error) {
+	defer os.RemoveAll(r.dir)
+	if err != nil {
+		return nil, fmt.Errorf("tool failed: %w", err)
+	}
+	if r.merged == "" {
+		return nil, nil
+	}
+	merged, err := os.ReadFile(r.merged)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(merged, r.initial) {
+		return nil, ErrNotMerged
+	}
+	if hasConflictMarkers(merged) {
+		return nil, ErrUnresolved
+	}
+	return merged, nil
+}
+
+func mergeToolRun(syncConfig SyncConfig, conflict Conflict) (*ToolRun, error) {
+	command, err := toolCommand(syncConfig.Tools, toolMerge)
+	if err != nil {
+		return nil, err
+	}
+	merged := conflict.Local
+	if !conflict.Binary {
+		merged = ResolveHunks(conflict.Hunks, nil)
+	}
+	return newToolRun(command, conflict.Path, map[string][]byte{
+		"LOCAL":  conflict.Local,
+		"REMOTE": conflict.Remote,
+		"BASE":   conflict.Base,
+		"MERGED": merged,
+	})
+}
+
+func diffToolRun(syncConfig SyncConfig, d FileDiff) (*ToolRun, error) {
+	command, err := toolCommand(syncConfig.Tools, toolDiff)
+	if err != nil {
+		return nil, err
+	}
+	return newToolRun(command, expandHome(d.Path), map[string][]byte{
+		"LOCAL":  d.Synced,
+		"REMOTE": d.Local,
+	})
+}
+
+// Prepares the merge tool for a conflict. The merged result is returned by
+// Run, or by Finish when the command is run by the caller
+func MergeTool(conflict Conflict, opts Options) (*ToolRun, error) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return mergeToolRun(syncConfig, conflict)
+}
+
+// Opens the local changes of the tracked files in the diff tool, one file
+// after the other
+func DiffTool(paths []string, opts Options) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		log.WithField("path", getConfigPath()).Error("Failed to open config file. Error: ", err)
+		os.Exit(1)
+	}
+	diffs, err := diffTracked(syncConfig, paths)
+	if err != nil {
+		log.Error("Failed to diff files ", err)
+		os.Exit(1)
+	}
+	for _, d := range diffs {
+		run, err := diffToolRun(syncConfig, d)
+		if errors.Is(err, ErrNoTool) {
+			log.Error(err)
+			os.Exit(1)
+		}
+		if err == nil {
+			_, err = run.Run()
+		}
+		if err != nil {
+			log.WithField("file", d.Path).Error("Failed to diff file ", err)
+		}
+	}
+}
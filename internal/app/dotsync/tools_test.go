@@ -0,0 +1,90 @@
+package dotsync
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+const toolsGitConfig = `[merge]
+	tool = mytool
+[mergetool "mytool"]
+	cmd = mytool \"$MERGED\"
+[diff]
+	tool = meld
+`
+
+func TestToolCommand(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	home := "/home/user"
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	_, err := toolCommand(ToolsConfig{}, toolMerge)
+	assert.ErrorIs(t, err, ErrNoTool)
+
+	assert.NoError(t, aferoFs.WriteFile(filepath.Join(home, ".gitconfig"), []byte(toolsGitConfig), 0644))
+	command, err := toolCommand(ToolsConfig{}, toolMerge)
+	assert.NoError(t, err)
+	assert.Equal(t, `mytool "$MERGED"`, command)
+	command, err = toolCommand(ToolsConfig{}, toolDiff)
+	assert.NoError(t, err)
+	assert.Equal(t, knownTools["meld"][toolDiff], command)
+
+	// The config wins over git
+	command, err = toolCommand(ToolsConfig{Merge: "vimdiff"}, toolMerge)
+	assert.NoError(t, err)
+	assert.Equal(t, knownTools["vimdiff"][toolMerge], command)
+	command, err = toolCommand(ToolsConfig{Merge: `cp "$REMOTE" "$MERGED"`}, toolMerge)
+	assert.NoError(t, err)
+	assert.Equal(t, `cp "$REMOTE" "$MERGED"`, command)
+	_, err = toolCommand(ToolsConfig{Merge: "unknown"}, toolMerge)
+	assert.ErrorIs(t, err, ErrNoTool)
+}
+
+func TestToolRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	versions := func() map[string][]byte {
+		return map[string][]byte{
+			"LOCAL":  []byte("local\n"),
+			"REMOTE": []byte("remote\n"),
+			"BASE":   []byte("base\n"),
+			"MERGED": []byte("<<<<<<< local\nlocal\n=======\nremote\n>>>>>>> remote\n"),
+		}
+	}
+	run, err := newToolRun(`cat "$BASE" "$REMOTE" > "$MERGED"`, "/home/user/.vimrc", versions())
+	assert.NoError(t, err)
+	assert.Equal(t, ".vimrc", filepath.Base(run.merged))
+	merged, err := run.Finish(run.Cmd.Run())
+	assert.NoError(t, err)
+	assert.Equal(t, "base\nremote\n", string(merged))
+	_, err = os.Stat(run.dir)
+	assert.True(t, os.IsNotExist(err))
+
+	// Failing or leaving the file alone doesn't merge it
+	run, err = newToolRun(`cat "$REMOTE" > "$MERGED"; exit 1`, "/home/user/.vimrc", versions())
+	assert.NoError(t, err)
+	_, err = run.Finish(run.Cmd.Run())
+	assert.Error(t, err)
+	_, statErr := os.Stat(run.dir)
+	assert.True(t, os.IsNotExist(statErr))
+
+	run, err = newToolRun("true", "/home/user/.vimrc", versions())
+	assert.NoError(t, err)
+	_, err = run.Finish(run.Cmd.Run())
+	assert.ErrorIs(t, err, ErrNotMerged)
+
+	// Diffs only get the real name of the file
+	run, err = newToolRun(`test "$MERGED" = /home/user/.vimrc`, "/home/user/.vimrc",
+		map[string][]byte{"LOCAL": []byte("a"), "REMOTE": []byte("b")})
+	assert.NoError(t, err)
+	merged, err = run.Finish(run.Cmd.Run())
+	assert.NoError(t, err)
+	assert.Nil(t, merged)
+}
@@ -0,0 +1,246 @@
+package dotsync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+# Watch mode
+Tracked files are watched through their parent directories. Most editors save
+by writing a temporary file and renaming it over the original, which silently
+drops an inotify watch placed on the file itself. Watching the directory keeps
+us informed no matter how the file is replaced.
+
+Events are debounced so that a burst of saves results in a single sync. When a
+sync fails, most likely because the remote is unreachable, it is retried with
+an exponential backoff until it succeeds or new changes come in.
+
+Only files can be watched, a tracked directory is refused when the watch
+starts since its files can't be synced one by one. The config file is watched
+too, so that files added to it are watched without a restart.
+*/
+
+const (
+	DefaultDebounce = 2 * time.Second
+	minRetryDelay   = 5 * time.Second
+	maxRetryDelay   = 5 * time.Minute
+)
+
+var ErrWatchDirectory = errors.New("directories can't be watched")
+
+// Exponential backoff between retries of a failing sync
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+// Returns the delay before the next retry and doubles it for the one after
+func (b *backoff) next() time.Duration {
+	if b.current == 0 {
+		b.current = b.min
+	} else {
+		b.current *= 2
+	}
+	if b.current > b.max {
+		b.current = b.max
+	}
+	return b.current
+}
+
+func (b *backoff) reset() {
+	b.current = 0
+}
+
+// Set of tracked paths, expanded and cleaned so they can be compared with
+// the names reported by fsnotify
+type watchedFiles map[string]struct{}
+
+func newWatchedFiles(files []string) watchedFiles {
+	w := make(watchedFiles)
+	for _, filePath := range files {
+		if filePath == "" {
+			continue
+		}
+		w[filepath.Clean(expandHome(filePath))] = struct{}{}
+	}
+	return w
+}
+
+// Parent directories of the tracked files, which are the ones that need a
+// watch
+func (w watchedFiles) dirs() []string {
+	seen := make(map[string]struct{})
+	dirs := []string{}
+	for path := range w {
+		dir := filepath.Dir(path)
+		if _, ok := seen[dir]; !ok {
+			seen[dir] = struct{}{}
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// Reports if the event name is a tracked file
+func (w watchedFiles) tracks(name string) bool {
+	_, ok := w[filepath.Clean(name)]
+	return ok
+}
+
+// Fails on the first tracked path that is a directory
+func checkWatchable(files []string) error {
+	for _, filePath := range files {
+		if isDir, _ := aferoFs.IsDir(expandHome(filePath)); isDir {
+			return fmt.Errorf("%w: %s", ErrWatchDirectory, filePath)
+		}
+	}
+	return nil
+}
+
+// Watches the tracked files and syncs them to the git repository whenever
+// they change. Runs until interrupted
+func WatchOrigin(debounce time.Duration, opts Options) {
+	syncConfig, err := OpenSyncConfig(opts)
+	if err != nil {
+		log.WithField("path", opts.configPath()).Error("Failed to open config file. Error: ", err)
+		os.Exit(1)
+	}
+	if err = checkWatchable(syncConfig.FilePaths()); err != nil {
+		log.Error("Failed to watch files ", err)
+		os.Exit(1)
+	}
+	SetupLogging(syncConfig.Path)
+
+	// Stops watching and a sync in progress
+	ctx, cancel := interruptContext()
+	defer cancel()
+	syncConfig.Context = ctx
+
+	// Picks up the files added to or removed from the config, the old config
+	// is kept when the new one is broken
+	reload := func() ([]string, error) {
+		config, err := OpenSyncConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		if err = checkWatchable(config.FilePaths()); err != nil {
+			return nil, err
+		}
+		config.Context = ctx
+		syncConfig = config
+		return syncConfig.FilePaths(), nil
+	}
+	err = watchOrigin(syncConfig.FilePaths(), opts.configPath(), debounce, func() error {
+		return withLock(syncConfig, opts.LockWait, func() error {
+			return syncOrigin(syncConfig)
+		})
+	}, reload, ctx.Done())
+	if err != nil {
+		log.Error("Failed to watch files ", err)
+		os.Exit(1)
+	}
+}
+
+func watchOrigin(files []string, configPath string, debounce time.Duration, sync func() error,
+	reload func() ([]string, error), stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	configPath = filepath.Clean(configPath)
+	watched := make(map[string]struct{})
+	watch := func(dirs []string) {
+		for _, dir := range dirs {
+			if _, ok := watched[dir]; ok {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				log.WithField("dir", dir).Warning("Failed to watch directory ", err)
+				continue
+			}
+			watched[dir] = struct{}{}
+		}
+	}
+	tracked := newWatchedFiles(files)
+	watch(tracked.dirs())
+	watch([]string{filepath.Dir(configPath)})
+
+	retry := backoff{min: minRetryDelay, max: maxRetryDelay}
+	// Earliest time the next sync may run while backing off
+	var notBefore time.Time
+	// Sync once on startup to pick up changes made while we weren't watching
+	timer := time.NewTimer(debounce)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			switch {
+			case filepath.Clean(event.Name) == configPath:
+				if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				files, err := reload()
+				if err != nil {
+					log.WithField("path", configPath).Warning("Failed to reload config, keeping the old one ", err)
+					continue
+				}
+				log.WithField("path", configPath).Info("Reloaded config")
+				tracked = newWatchedFiles(files)
+				watch(tracked.dirs())
+			case tracked.tracks(event.Name):
+				log.WithFields(logrus.Fields{
+					"file": event.Name,
+					"op":   event.Op.String(),
+				}).Debug("Tracked file changed")
+			default:
+				continue
+			}
+			delay := debounce
+			if wait := time.Until(notBefore); wait > delay {
+				delay = wait
+			}
+			resetTimer(timer, delay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Error("Watcher ran into an issue ", err)
+		case <-timer.C:
+			if err := sync(); err != nil {
+				delay := retry.next()
+				notBefore = time.Now().Add(delay)
+				log.WithField("retry", delay).Error("Failed to sync, retrying ", err)
+				timer.Reset(delay)
+				continue
+			}
+			retry.reset()
+			notBefore = time.Time{}
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// Stops and drains the timer before resetting it, so that an already fired
+// timer doesn't trigger a sync before the new delay has passed
+func resetTimer(timer *time.Timer, delay time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(delay)
+}
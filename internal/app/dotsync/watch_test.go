@@ -0,0 +1,118 @@
+package dotsync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+	b := backoff{min: time.Second, max: 5 * time.Second}
+	assert.Equal(t, time.Second, b.next())
+	assert.Equal(t, 2*time.Second, b.next())
+	assert.Equal(t, 4*time.Second, b.next())
+	assert.Equal(t, 5*time.Second, b.next())
+	b.reset()
+	assert.Equal(t, time.Second, b.next())
+}
+
+func TestWatchedFilesTracks(t *testing.T) {
+	w := newWatchedFiles([]string{"/home/user/.vimrc", "/home/user/.config/nvim/init.lua", ""})
+	assert.True(t, w.tracks("/home/user/.vimrc"))
+	assert.True(t, w.tracks("/home/user/.config/nvim/init.lua"))
+	assert.False(t, w.tracks("/home/user/.vimrc.swp"))
+	assert.False(t, w.tracks("/home/user/.config/nvim"))
+	assert.ElementsMatch(t, []string{"/home/user", "/home/user/.config/nvim"}, w.dirs())
+}
+
+func TestCheckWatchableRejectsDirectories(t *testing.T) {
+	aferoFs.Fs = afero.NewMemMapFs()
+	assert.NoError(t, aferoFs.WriteFile("/home/user/.vimrc", []byte("set nu"), 0644))
+	assert.NoError(t, aferoFs.MkdirAll("/home/user/.config/nvim", 0755))
+	assert.NoError(t, checkWatchable([]string{"/home/user/.vimrc"}))
+	err := checkWatchable([]string{"/home/user/.vimrc", "/home/user/.config/nvim"})
+	assert.ErrorIs(t, err, ErrWatchDirectory)
+	assert.Contains(t, err.Error(), "/home/user/.config/nvim")
+}
+
+func TestWatchDebouncesBurstOfSaves(t *testing.T) {
+	aferoFs.Fs = afero.NewOsFs()
+	dir := t.TempDir()
+	tracked := filepath.Join(dir, "vimrc")
+	assert.NoError(t, os.WriteFile(tracked, []byte("set nu"), 0644))
+
+	synced := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- watchOrigin([]string{tracked}, filepath.Join(dir, "config"), 100*time.Millisecond, func() error {
+			synced <- struct{}{}
+			return nil
+		}, nil, stop)
+	}()
+	// Initial sync on startup
+	<-synced
+
+	for i := 0; i < 5; i++ {
+		// Save the way most editors do, write a new file and rename it
+		tmp := filepath.Join(dir, "vimrc.tmp")
+		assert.NoError(t, os.WriteFile(tmp, []byte{byte(i)}, 0644))
+		assert.NoError(t, os.Rename(tmp, tracked))
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-synced:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a sync after the burst of saves")
+	}
+	select {
+	case <-synced:
+		t.Fatal("expected a single sync for the burst of saves")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	close(stop)
+	assert.NoError(t, <-done)
+}
+
+func TestWatchReloadsConfig(t *testing.T) {
+	aferoFs.Fs = afero.NewOsFs()
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config")
+	added := filepath.Join(dir, "added", "gitconfig")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(added), 0755))
+	assert.NoError(t, os.WriteFile(added, []byte("[user]"), 0644))
+
+	synced := make(chan struct{}, 10)
+	reloaded := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- watchOrigin(nil, configPath, 100*time.Millisecond, func() error {
+			synced <- struct{}{}
+			return nil
+		}, func() ([]string, error) {
+			reloaded <- struct{}{}
+			return []string{added}, nil
+		}, stop)
+	}()
+	<-synced
+
+	// A file added to the config is watched without a restart
+	assert.NoError(t, os.WriteFile(configPath, []byte("files: []"), 0644))
+	<-reloaded
+	<-synced
+	assert.NoError(t, os.WriteFile(added, []byte("[core]"), 0644))
+	select {
+	case <-synced:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a sync after a file added to the config changed")
+	}
+
+	close(stop)
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,172 @@
+// Package dotsync syncs dotfiles with a git repository, like the dotsync
+// command does, for embedding it in other tools.
+//
+// A Syncer is created from Options and syncs with its Push, Pull and Sync
+// methods. Its methods return what they did and never exit the process.
+// Errors are an *Error carrying the code the command line reports them with,
+// the sentinel errors below can be matched with errors.Is.
+//
+// Cancelling the context of a method stops it at the next point where the
+// sync directory is left consistent. Network operations also give up after the
+// timeouts of the config.
+//
+// dotsync keeps its filesystem, log and clock in process wide state, so the
+// methods of all Syncers of a process run one at a time.
+//
+// Only the tracked files, the index and the local state go through the Fs of
+// the Options. The git repository at the Path of the config, the lock next to
+// it, hooks, scripts and the daemon socket always use the disk of the OS, so a
+// Push or Pull needs the Fs to be the disk as well.
+package dotsync
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/gelm0/dotsync/internal/app/dotsync"
+)
+
+type (
+	// The config, like in the config file, see the README
+	Config     = dotsync.SyncConfig
+	FileEntry  = dotsync.FileEntry
+	GitConfig  = dotsync.GitConfig
+	GitBackend = dotsync.GitBackend
+	Timeouts   = dotsync.TimeoutsConfig
+
+	Progress   = dotsync.Progress
+	Phase      = dotsync.Phase
+	FileResult = dotsync.FileResult
+
+	PushResult = dotsync.PushResult
+	PullResult = dotsync.PullResult
+	SyncResult = dotsync.SyncResult
+	FileSync   = dotsync.FileSync
+	SyncedFile = dotsync.SyncedFile
+	FileStatus = dotsync.FileStatus
+	FileState  = dotsync.FileState
+	FileDiff   = dotsync.FileDiff
+	DiffStat   = dotsync.DiffStat
+
+	Error       = dotsync.Error
+	ResultError = dotsync.ResultError
+)
+
+// Codes of an Error
+const (
+	CodeConfig   = dotsync.CodeConfig
+	CodeLocked   = dotsync.CodeLocked
+	CodeHook     = dotsync.CodeHook
+	CodeSecrets  = dotsync.CodeSecrets
+	CodeTimeout  = dotsync.CodeTimeout
+	CodeCanceled = dotsync.CodeCanceled
+	CodeFailed   = dotsync.CodeFailed
+)
+
+const (
+	StateUnchanged = dotsync.StateUnchanged
+	StateModified  = dotsync.StateModified
+	StateNew       = dotsync.StateNew
+	StateMissing   = dotsync.StateMissing
+	StateConflict  = dotsync.StateConflict
+)
+
+var (
+	ErrMissingConfig  = dotsync.ErrMissingConfig
+	ErrUnknownProfile = dotsync.ErrUnknownProfile
+	ErrNoTaggedFiles  = dotsync.ErrNoTaggedFiles
+	ErrLocked         = dotsync.ErrLocked
+	ErrHookFailed     = dotsync.ErrHookFailed
+	ErrSecretsFound   = dotsync.ErrSecretsFound
+	ErrMissingFile    = dotsync.ErrMissingFile
+	ErrTimeout        = dotsync.ErrTimeout
+)
+
+type Options struct {
+	// Filesystem of the tracked files, the index and the local state, the one
+	// of the OS when nil. Git and the lock always use the disk, see above
+	Fs afero.Fs
+	// Log of the syncs, nothing is logged when nil
+	Logger *logrus.Logger
+	// Used instead of reading the config file when set
+	Config *Config
+	// Path of the config file, ~/.dotsync/config when empty
+	ConfigPath string
+	// Opens and clones the repository, plain git directories when nil
+	Git GitBackend
+	// Time of commits, backups and the like, time.Now when nil
+	Clock func() time.Time
+
+	// Profile to apply to the config, see the README
+	Profile string
+	// Only sync files with one of these tags
+	Tags []string
+	// How long to wait for another sync holding the lock
+	LockWait time.Duration
+	// Follows the progress of syncs
+	Progress Progress
+}
+
+type Syncer struct {
+	opts dotsync.Options
+}
+
+// Returns a Syncer, or an error if the config can't be read
+func New(opts Options) (*Syncer, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = logrus.New()
+		logger.SetOutput(io.Discard)
+	}
+	s := &Syncer{opts: dotsync.Options{
+		LockWait:   opts.LockWait,
+		Profile:    opts.Profile,
+		Tags:       opts.Tags,
+		Progress:   opts.Progress,
+		Config:     opts.Config,
+		ConfigPath: opts.ConfigPath,
+		Git:        opts.Git,
+		Fs:         opts.Fs,
+		Logger:     logger,
+		Clock:      opts.Clock,
+	}}
+	if _, err := s.Config(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns the config with the profile and tags of the options applied
+func (s *Syncer) Config() (Config, error) {
+	return dotsync.ReadConfig(s.opts)
+}
+
+// Syncs the tracked files to the git repository
+func (s *Syncer) Push(ctx context.Context) (PushResult, error) {
+	return dotsync.Push(ctx, s.opts)
+}
+
+// Syncs the git repository to the tracked files
+func (s *Syncer) Pull(ctx context.Context) (PullResult, error) {
+	return dotsync.Pull(ctx, s.opts)
+}
+
+// Pushes local changes and restores remote changes in one go
+func (s *Syncer) Sync(ctx context.Context) (SyncResult, error) {
+	return dotsync.Sync(ctx, s.opts)
+}
+
+// Returns the state of every tracked file
+func (s *Syncer) Status(ctx context.Context) ([]FileStatus, error) {
+	return dotsync.Statuses(ctx, s.opts)
+}
+
+// Returns the tracked files that changed since the last sync, only the ones
+// with the given paths if there are any
+func (s *Syncer) Diff(ctx context.Context, paths ...string) ([]FileDiff, error) {
+	return dotsync.Diffs(ctx, paths, s.opts)
+}
@@ -0,0 +1,135 @@
+package dotsync
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSyncer(t *testing.T) (*Syncer, afero.Fs) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, "/home/user/.ssh/id", []byte("key"), 0600))
+	assert.NoError(t, afero.WriteFile(fs, "/home/user/.vimrc", []byte("set nu\n"), 0644))
+	t.Setenv("HOME", "/home/user")
+	s, err := New(Options{
+		Fs: fs,
+		Config: &Config{
+			GitConfig: GitConfig{URL: "git@example.com:user/dotfiles.git", KeyFile: "/home/user/.ssh/id"},
+			Path:      "/home/user/.dotsync/sync",
+			Files:     []FileEntry{{Path: "/home/user/.vimrc"}, {Path: "/home/user/.bashrc"}},
+		},
+	})
+	assert.NoError(t, err)
+	return s, fs
+}
+
+func TestSyncerStatusAndDiff(t *testing.T) {
+	s, _ := newTestSyncer(t)
+	statuses, err := s.Status(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, StateNew, statuses[0].State)
+	assert.Equal(t, StateMissing, statuses[1].State)
+
+	diffs, err := s.Diff(context.Background(), "/home/user/.vimrc")
+	assert.NoError(t, err)
+	assert.Len(t, diffs, 1)
+	assert.Equal(t, DiffStat{Path: "/home/user/.vimrc", Added: 1}, diffs[0].Stat())
+}
+
+func TestSyncerErrors(t *testing.T) {
+	_, err := New(Options{Fs: afero.NewMemMapFs(), Config: &Config{}})
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, CodeConfig, e.Code)
+
+	s, _ := newTestSyncer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.Status(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	result, err := s.Push(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, CodeCanceled, result.Error.Code)
+	assert.False(t, result.Pushed)
+}
+
+// A bare repository with one commit on main, dotsync can't clone empty ones
+func newTestRemote(t *testing.T) string {
+	remote := filepath.Join(t.TempDir(), "remote.git")
+	bare, err := git.PlainInit(remote, true)
+	assert.NoError(t, err)
+	branch := plumbing.NewBranchReferenceName("main")
+	assert.NoError(t, bare.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch)))
+
+	seedDir := t.TempDir()
+	seed, err := git.PlainInit(seedDir, false)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(seedDir, "README"), []byte("dotfiles\n"), 0644))
+	worktree, err := seed.Worktree()
+	assert.NoError(t, err)
+	_, err = worktree.Add("README")
+	assert.NoError(t, err)
+	_, err = worktree.Commit("initial", &git.CommitOptions{
+		Author: &object.Signature{Name: "dotsync", When: time.Now()},
+	})
+	assert.NoError(t, err)
+	_, err = seed.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remote}})
+	assert.NoError(t, err)
+	assert.NoError(t, seed.Push(&git.PushOptions{
+		RefSpecs: []config.RefSpec{config.RefSpec("refs/heads/master:" + branch)},
+	}))
+	return remote
+}
+
+func TestSyncerPush(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	keyFile := filepath.Join(home, "id_rsa")
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(home, ".vimrc"), []byte("set nu\n"), 0644))
+	remote := newTestRemote(t)
+
+	// The repository is on disk, so is the rest
+	s, err := New(Options{
+		Config: &Config{
+			GitConfig: GitConfig{URL: remote, KeyFile: keyFile},
+			Path:      filepath.Join(home, ".dotsync", "sync"),
+			Files:     []FileEntry{{Path: "~/.vimrc"}},
+		},
+	})
+	assert.NoError(t, err)
+	result, err := s.Push(context.Background())
+	assert.NoError(t, err)
+	assert.Nil(t, result.Error)
+	assert.True(t, result.Pushed)
+	if assert.Len(t, result.Files, 1) {
+		assert.Equal(t, "~/.vimrc", result.Files[0].Path)
+		assert.Equal(t, FileResult("copied"), result.Files[0].Result)
+	}
+
+	bare, err := git.PlainOpen(remote)
+	assert.NoError(t, err)
+	head, err := bare.Reference(plumbing.NewBranchReferenceName("main"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, head.Hash().String(), result.Commit)
+}